@@ -0,0 +1,125 @@
+package access
+
+import (
+	"errors"
+	"strings"
+)
+
+// every route under /api and /billing that takes a session says here what the user needs
+// on the resource named in its path. routes without a rule can't be registered.
+
+// the resources a route can name, each is the name of the route variable.
+const (
+	ADDRESS = "address"
+	CARD    = "card" // checked against the address the card is on
+	DOMAIN  = "domain"
+)
+
+// levels, the same as the roles on addresses. domains only have owners.
+const (
+	OWNER  = "owner"
+	ADMIN  = "admin"
+	AGENT  = "agent"
+	VIEWER = "viewer"
+	NONE   = "none"
+)
+
+var ranks = map[string]int{NONE: 0, VIEWER: 1, AGENT: 2, ADMIN: 3, OWNER: 4}
+
+type Rule struct {
+	Resource  string // empty for routes that only concern the user's own things
+	Level     string
+	Unclaimed bool // also allowed when the resource doesn't exist yet
+}
+
+// Lookup returns the level a user has on a resource, and if the resource exists at all.
+type Lookup func(userId, resource, id string) (level string, exists bool, err error)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrForbidden = errors.New("not allowed")
+)
+
+var Routes = map[string]Rule{
+	"GET /api/account": {},
+	"PUT /api/account": {},
+
+	"DELETE /api/session":  {},
+	"DELETE /api/sessions": {},
+
+	"GET /api/addresses/{address}":                                 {ADDRESS, VIEWER, false},
+	"PUT /api/addresses/{address}":                                 {ADDRESS, OWNER, true},
+	"DELETE /api/addresses/{address}":                              {ADDRESS, OWNER, false},
+	"PUT /api/addresses/{address}/settings":                        {ADDRESS, ADMIN, false},
+	"GET /api/addresses/{address}/sla":                             {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/statuses":                        {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/reports":                         {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/aliases":                         {ADDRESS, OWNER, false},
+	"POST /api/addresses/{address}/aliases":                        {ADDRESS, OWNER, false},
+	"PUT /api/addresses/{address}/aliases/primary":                 {ADDRESS, OWNER, false},
+	"DELETE /api/addresses/{address}/aliases/{alias}":              {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/members":                         {ADDRESS, ADMIN, false},
+	"PUT /api/addresses/{address}/members/{member}":                {ADDRESS, OWNER, false},
+	"DELETE /api/addresses/{address}/members/{member}":             {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/endpoints":                       {ADDRESS, OWNER, false},
+	"POST /api/addresses/{address}/endpoints":                      {ADDRESS, OWNER, false},
+	"DELETE /api/addresses/{address}/endpoints/{endpoint}":         {ADDRESS, OWNER, false},
+	"GET /api/addresses/{address}/endpoints/{endpoint}/deliveries": {ADDRESS, OWNER, false},
+	"POST /api/addresses/{address}/endpoints/{endpoint}/ping":      {ADDRESS, OWNER, false},
+
+	"GET /api/cards/{card}/sla":    {CARD, OWNER, false},
+	"GET /api/cards/{card}/status": {CARD, OWNER, false},
+	"GET /api/cards/{card}/export": {CARD, OWNER, false},
+	"POST /api/cards/{card}/merge": {CARD, OWNER, false},
+	"POST /api/cards/{card}/split": {CARD, OWNER, false},
+
+	"GET /api/contacts":           {},
+	"GET /api/contacts/{contact}": {},
+	"GET /api/privacy/export":     {},
+	"POST /api/privacy/erase":     {},
+	"GET /api/privacy/requests":   {},
+	"GET /api/search":             {},
+	"GET /api/mails":              {},
+
+	"POST /api/check-dns/{domain}": {DOMAIN, OWNER, false},
+
+	"GET /billing/{address}/paypal":    {ADDRESS, OWNER, false},
+	"DELETE /billing/{address}/paypal": {ADDRESS, OWNER, false},
+}
+
+// RuleFor returns the rule for a method and path template as given to the router.
+func RuleFor(method, path string) (rule Rule, ok bool) {
+	rule, ok = Routes[method+" "+path]
+	return
+}
+
+// Check tells if the user may call a route with the given variables. addresses users
+// can't see at all are not found rather than forbidden.
+func Check(rule Rule, userId string, vars map[string]string, lookup Lookup) error {
+	if rule.Resource == "" {
+		return nil
+	}
+
+	id := strings.TrimSpace(vars[rule.Resource])
+	if id == "" {
+		return ErrNotFound
+	}
+
+	level, exists, err := lookup(userId, rule.Resource, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if rule.Unclaimed {
+			return nil
+		}
+		return ErrNotFound
+	}
+	if ranks[level] == 0 {
+		return ErrNotFound
+	}
+	if ranks[level] < ranks[rule.Level] {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package access
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/gorilla/mux"
+	. "github.com/onsi/gomega"
+)
+
+// the fake graph: "a" is an address, "c" a card on it and "d" a domain, all owned by
+// "owner". every other user has the level of their name on them.
+func fakeLookup(userId, resource, id string) (string, bool, error) {
+	if id == "broken" {
+		return NONE, false, errors.New("db is down")
+	}
+	if id != "a" && id != "c" && id != "d" {
+		return NONE, false, nil
+	}
+	if _, ok := ranks[userId]; !ok {
+		return NONE, true, nil
+	}
+	if resource == DOMAIN && userId != OWNER {
+		return NONE, true, nil
+	}
+	return userId, true, nil
+}
+
+func TestAccess(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("access", func() {
+
+		g.It("should have a rule for sensible routes only", func() {
+			for route, rule := range Routes {
+				parts := strings.SplitN(route, " ", 2)
+				Expect(parts).To(HaveLen(2), route)
+				Expect(parts[0]).To(BeElementOf("GET", "PUT", "POST", "DELETE"), route)
+				Expect(parts[1]).To(SatisfyAny(HavePrefix("/api/"), HavePrefix("/billing/")), route)
+
+				if rule.Resource != "" {
+					Expect(parts[1]).To(ContainSubstring("{"+rule.Resource+"}"), route)
+					Expect(ranks[rule.Level]).To(BeNumerically(">", 0), route)
+				}
+				// addresses and cards say who they belong to, domains only on the domain routes
+				if strings.Contains(parts[1], "{address}") {
+					Expect(rule.Resource).To(Equal(ADDRESS), route)
+				}
+				if strings.Contains(parts[1], "{card}") {
+					Expect(rule.Resource).To(Equal(CARD), route)
+				}
+				if strings.Contains(parts[1], "{domain}") {
+					Expect(rule.Resource).To(Equal(DOMAIN), route)
+				}
+			}
+		})
+
+		g.It("should register all routes with a rule through the guard in main.go", func() {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "../main.go", nil, 0)
+			Expect(err).ToNot(HaveOccurred())
+
+			literal := func(e ast.Expr) string {
+				lit, ok := e.(*ast.BasicLit)
+				if !ok {
+					return ""
+				}
+				value, _ := strconv.Unquote(lit.Value)
+				return value
+			}
+
+			protectedIsGuard := false
+			registered := make(map[string]bool)
+			var unprotected []string
+			ast.Inspect(file, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.AssignStmt:
+					if id, ok := n.Lhs[0].(*ast.Ident); ok && id.Name == "protected" {
+						sel, ok := n.Rhs[0].(*ast.SelectorExpr)
+						protectedIsGuard = ok && sel.Sel.Name == "Handle"
+					}
+				case *ast.CallExpr:
+					if id, ok := n.Fun.(*ast.Ident); ok && id.Name == "protected" {
+						Expect(n.Args).To(HaveLen(3))
+						route := literal(n.Args[0]) + " " + literal(n.Args[1])
+						Expect(registered).ToNot(HaveKey(route))
+						registered[route] = true
+					}
+					if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Path" && len(n.Args) == 1 {
+						unprotected = append(unprotected, literal(n.Args[0]))
+					}
+				}
+				return true
+			})
+
+			Expect(protectedIsGuard).To(BeTrue())
+			for route := range Routes {
+				Expect(registered).To(HaveKey(route))
+			}
+			for route := range registered {
+				Expect(Routes).To(HaveKey(route))
+			}
+			// only logging in and paypal coming back don't take a session
+			for _, path := range unprotected {
+				if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/billing/") {
+					Expect(path).To(BeElementOf(
+						"/api/session",
+						"/api/session/refresh",
+						"/billing/{address}/paypal/success",
+						"/billing/{address}/paypal/failure",
+					))
+				}
+			}
+		})
+
+		g.It("should check routes registered through the guard", func() {
+			var denied error
+			guard := &Guard{
+				Router: mux.NewRouter(),
+				Session: func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if r.Header.Get("User") == "" {
+							w.WriteHeader(401)
+							return
+						}
+						next.ServeHTTP(w, r)
+					})
+				},
+				UserId: func(r *http.Request) string { return r.Header.Get("User") },
+				Lookup: fakeLookup,
+				Denied: func(w http.ResponseWriter, r *http.Request, rule Rule, err error) {
+					denied = err
+					w.WriteHeader(403)
+				},
+			}
+			guard.Handle("PUT", "/api/addresses/{address}/settings", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(204)
+			})
+
+			call := func(userId, path string) int {
+				denied = nil
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("PUT", path, nil)
+				r.Header.Set("User", userId)
+				guard.Router.ServeHTTP(w, r)
+				return w.Code
+			}
+			Expect(call(ADMIN, "/api/addresses/a/settings")).To(Equal(204))
+			Expect(call(OWNER, "/api/addresses/a/settings")).To(Equal(204))
+			Expect(call(AGENT, "/api/addresses/a/settings")).To(Equal(403))
+			Expect(denied).To(Equal(ErrForbidden))
+			Expect(call("stranger", "/api/addresses/a/settings")).To(Equal(403))
+			Expect(denied).To(Equal(ErrNotFound))
+			Expect(call(OWNER, "/api/addresses/x/settings")).To(Equal(403))
+			Expect(denied).To(Equal(ErrNotFound))
+			Expect(call("", "/api/addresses/a/settings")).To(Equal(401))
+
+			Expect(func() {
+				guard.Handle("GET", "/api/addresses/{address}/secrets", func(http.ResponseWriter, *http.Request) {})
+			}).To(Panic())
+		})
+
+		g.It("should find the level of users on addresses, cards and domains", func() {
+			store := Store{
+				BaseDomain: "boardthreads.com",
+				AddressForCard: func(card string) (string, error) {
+					if card == "c1" {
+						return "bob@boardthreads.com", nil
+					}
+					return "", nil
+				},
+				UserForDomain: func(host string) (string, error) {
+					if host == "bob.com" {
+						return "bob", nil
+					}
+					return "", nil
+				},
+				UserForAddress: func(address string) (string, error) {
+					if address == "bob@boardthreads.com" {
+						return "bob", nil
+					}
+					return "", nil
+				},
+				Role: func(userId, address string) (string, error) {
+					return map[string]string{"bob": OWNER, "maria": ADMIN, "joao": AGENT}[userId], nil
+				},
+			}
+			level := func(userId, resource, id string) string {
+				level, _, err := store.Level(userId, resource, id)
+				Expect(err).ToNot(HaveOccurred())
+				return level
+			}
+
+			Expect(level("bob", ADDRESS, "bob")).To(Equal(OWNER))
+			Expect(level("maria", ADDRESS, "bob")).To(Equal(ADMIN))
+			Expect(level("bob", CARD, "c1")).To(Equal(OWNER))
+			Expect(level("joao", CARD, "c1")).To(Equal(AGENT))
+			Expect(level("bob", DOMAIN, "bob.com")).To(Equal(OWNER))
+			Expect(level("maria", DOMAIN, "bob.com")).To(Equal(NONE))
+			_, exists, _ := store.Level("maria", DOMAIN, "bob.com")
+			Expect(exists).To(BeTrue())
+			for _, missing := range [][]string{{ADDRESS, "maria"}, {CARD, "c2"}, {DOMAIN, "maria.com"}} {
+				_, exists, err := store.Level("bob", missing[0], missing[1])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeFalse(), missing[1])
+			}
+
+			// only the owner can point an existing address somewhere else, anyone can take a new one
+			rule := Routes["PUT /api/addresses/{address}"]
+			Expect(Check(rule, "bob", map[string]string{"address": "bob"}, store.Level)).To(Succeed())
+			Expect(Check(rule, "maria", map[string]string{"address": "bob"}, store.Level)).To(Equal(ErrForbidden))
+			Expect(Check(rule, "stranger", map[string]string{"address": "bob"}, store.Level)).To(Equal(ErrNotFound))
+			Expect(Check(rule, "maria", map[string]string{"address": "maria"}, store.Level)).To(Succeed())
+
+			rule = Routes["POST /api/check-dns/{domain}"]
+			Expect(Check(rule, "bob", map[string]string{"domain": "bob.com"}, store.Level)).To(Succeed())
+			Expect(Check(rule, "maria", map[string]string{"domain": "bob.com"}, store.Level)).To(Equal(ErrNotFound))
+			rule = Routes["POST /api/cards/{card}/split"]
+			Expect(Check(rule, "joao", map[string]string{"card": "c1"}, store.Level)).To(Equal(ErrForbidden))
+
+			failing := store
+			failing.Role = func(string, string) (string, error) { return "", errors.New("db is down") }
+			Expect(Check(rule, "bob", map[string]string{"card": "c1"}, failing.Level)).To(MatchError("db is down"))
+		})
+
+		g.It("should not know routes without a rule", func() {
+			_, ok := RuleFor("GET", "/api/addresses/{address}/secrets")
+			Expect(ok).To(BeFalse())
+			_, ok = RuleFor("PATCH", "/api/addresses/{address}")
+			Expect(ok).To(BeFalse())
+		})
+
+		g.It("should only let owners pay or delete", func() {
+			for _, route := range []string{
+				"DELETE /api/addresses/{address}",
+				"GET /billing/{address}/paypal",
+				"DELETE /billing/{address}/paypal",
+				"PUT /api/addresses/{address}/members/{member}",
+			} {
+				Expect(Routes[route].Level).To(Equal(OWNER), route)
+			}
+		})
+
+		g.It("should fail on lookup errors and empty variables", func() {
+			rule := Routes["GET /api/addresses/{address}"]
+			Expect(Check(rule, OWNER, map[string]string{"address": "broken"}, fakeLookup)).To(MatchError("db is down"))
+			Expect(Check(rule, OWNER, map[string]string{"address": " "}, fakeLookup)).To(Equal(ErrNotFound))
+			Expect(Check(rule, OWNER, nil, fakeLookup)).To(Equal(ErrNotFound))
+		})
+
+		keys := map[string]string{"k2": "secret", "k1": "old", "k0": ""}
+		secrets := func(kid string) (string, bool) {
+			secret, ok := keys[kid]
+			return secret, ok
+		}
+
+		g.It("should sign and parse states", func() {
+			now := time.Unix(1500000000, 0)
+			state := SignState("k2", "secret", now.Add(time.Hour), "paypal", "u1", "maria@boardthreads.com")
+
+			Expect(ParseState(secrets, state, now)).To(Equal([]string{"paypal", "u1", "maria@boardthreads.com"}))
+			Expect(state).ToNot(ContainSubstring("maria"))
+			Expect(state).To(HavePrefix("k2."))
+		})
+
+		g.It("should parse states signed with a previous key", func() {
+			now := time.Unix(1500000000, 0)
+			state := SignState("k1", "old", now.Add(time.Hour), "paypal", "u1")
+			Expect(ParseState(secrets, state, now)).To(Equal([]string{"paypal", "u1"}))
+
+			// but not after it is gone
+			delete(keys, "k1")
+			_, err := ParseState(secrets, state, now)
+			Expect(err).To(Equal(ErrInvalidState))
+			keys["k1"] = "old"
+		})
+
+		g.It("should reject changed, foreign or expired states", func() {
+			now := time.Unix(1500000000, 0)
+			state := SignState("k2", "secret", now.Add(time.Hour), "paypal", "u1", "maria@boardthreads.com")
+			other := SignState("k2", "secret", now.Add(time.Hour), "paypal", "u2", "maria@boardthreads.com")
+			parts := strings.Split(state, ".")
+			otherParts := strings.Split(other, ".")
+
+			for _, bad := range []string{
+				"",
+				"garbage",
+				parts[0] + "." + parts[1],
+				parts[0] + "." + otherParts[1] + "." + parts[2],
+				parts[0] + "." + parts[1] + "." + otherParts[2],
+				"k1." + parts[1] + "." + parts[2],
+				"k9." + parts[1] + "." + parts[2],
+				state + ".more",
+			} {
+				_, err := ParseState(secrets, bad, now)
+				Expect(err).To(Equal(ErrInvalidState), bad)
+			}
+
+			// signed with a key that isn't the one it names
+			_, err := ParseState(secrets, SignState("k2", "other", now.Add(time.Hour), "paypal"), now)
+			Expect(err).To(Equal(ErrInvalidState))
+			_, err = ParseState(secrets, SignState("k0", "", now.Add(time.Hour), "paypal"), now)
+			Expect(err).To(Equal(ErrInvalidState))
+
+			_, err = ParseState(secrets, state, now.Add(2*time.Hour))
+			Expect(err).To(Equal(ErrExpiredState))
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package access
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Guard registers the routes that take a session. each one is checked against its rule
+// before the handler runs, there is no way to register one without it.
+type Guard struct {
+	Router  *mux.Router
+	Session func(http.Handler) http.Handler // authenticates the request, UserId is called after it
+	UserId  func(r *http.Request) string
+	Lookup  Lookup
+	Denied  func(w http.ResponseWriter, r *http.Request, rule Rule, err error) // ErrNotFound, ErrForbidden or from Lookup
+}
+
+// Handle registers a route. routes without a rule make it panic, so the server won't start.
+func (g *Guard) Handle(method, path string, handler http.HandlerFunc) *mux.Route {
+	return g.Router.Path(path).Methods(method).Handler(g.Session(g.Authorize(method, path, handler)))
+}
+
+// Authorize wraps a handler with the rule of its route. it must be given the same path as
+// the router.
+func (g *Guard) Authorize(method, path string, next http.Handler) http.Handler {
+	rule, ok := RuleFor(method, path)
+	if !ok {
+		panic("route has no access rule: " + method + " " + path)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := Check(rule, g.UserId(r), mux.Vars(r), g.Lookup)
+		if err != nil {
+			g.Denied(w, r, rule, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Store is where the levels come from. each function returns empty when nothing is found.
+type Store struct {
+	BaseDomain     string // addresses are named by what comes before it on the routes
+	AddressForCard func(card string) (address string, err error)
+	UserForDomain  func(host string) (userId string, err error)
+	UserForAddress func(address string) (userId string, err error)
+	Role           func(userId, address string) (role string, err error)
+}
+
+// Level is a Lookup. cards are checked by the address they are on, domains only have owners.
+func (s Store) Level(userId, resource, id string) (level string, exists bool, err error) {
+	var address string
+	switch resource {
+	case ADDRESS:
+		address = id + "@" + s.BaseDomain
+	case CARD:
+		address, err = s.AddressForCard(id)
+	case DOMAIN:
+		ownerId, err := s.UserForDomain(id)
+		if err != nil || ownerId == "" {
+			return NONE, false, err
+		}
+		if ownerId == userId {
+			return OWNER, true, nil
+		}
+		return NONE, true, nil
+	default:
+		return NONE, false, nil
+	}
+	if err != nil || address == "" {
+		return NONE, false, err
+	}
+
+	ownerId, err := s.UserForAddress(address)
+	if err != nil || ownerId == "" {
+		return NONE, false, err
+	}
+	role, err := s.Role(userId, address)
+	return role, true, err
+}
@@ -0,0 +1,68 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// a state carries values through a third party, like paypal's return urls, signed so they
+// can't be changed on the way and with an expiration so they can't be reused forever.
+// it names the key it was signed with, so states survive the key changing.
+
+var (
+	ErrInvalidState = errors.New("invalid state")
+	ErrExpiredState = errors.New("expired state")
+)
+
+// Secrets finds a secret by its key id, like sessions.Keyring.Secret.
+type Secrets func(kid string) (secret string, ok bool)
+
+func SignState(kid, secret string, expires time.Time, values ...string) string {
+	payload, _ := json.Marshal(struct {
+		Expires int64    `json:"e"`
+		Values  []string `json:"v"`
+	}{expires.Unix(), values})
+	signed := kid + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + stateSignature(secret, signed)
+}
+
+func ParseState(secrets Secrets, state string, now time.Time) (values []string, err error) {
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidState
+	}
+	secret, ok := secrets(parts[0])
+	if !ok || secret == "" {
+		return nil, ErrInvalidState
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(stateSignature(secret, parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidState
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	var decoded struct {
+		Expires int64    `json:"e"`
+		Values  []string `json:"v"`
+	}
+	if err = json.Unmarshal(payload, &decoded); err != nil {
+		return nil, ErrInvalidState
+	}
+	if now.Unix() > decoded.Expires {
+		return nil, ErrExpiredState
+	}
+	return decoded.Values, nil
+}
+
+func stateSignature(secret, encoded string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
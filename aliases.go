@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bt/db"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// aliases are more inbound addresses for the same list, see db/aliases.go.
+
+const MAX_ALIASES = 10
+
+func GetAliases(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	aliases, err := db.ListAliases(userId, vars["address"]+"@"+settings.BaseDomain)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func AddAlias(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   receives the local part of the alias, like the address itself it lives on our domain.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	data := struct {
+		Alias string `json:"alias"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	// validation
+	alias := data.Alias + "@" + settings.BaseDomain
+	if data.Alias == "" || !isEmail(alias) {
+		sendJSONError(w, errors.New("invalid alias."), 400, logger)
+		return
+	}
+
+	existing, err := db.ListAliases(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if len(existing) >= MAX_ALIASES {
+		sendJSONError(w, errors.New("too many aliases for this address"), 400, logger)
+		return
+	}
+
+	err = db.AddAlias(userId, address, alias)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":    userId,
+		"address": address,
+		"alias":   alias,
+	}).Info("added alias")
+
+	aliases, err := db.ListAliases(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func RemoveAlias(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	err := db.RemoveAlias(userId, vars["address"]+"@"+settings.BaseDomain, vars["alias"]+"@"+settings.BaseDomain)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func SetPrimaryAlias(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   the primary alias is where replies come from on threads that didn't arrive on
+	   any alias. an empty alias makes the address itself the primary again.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	data := struct {
+		Alias string `json:"alias"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	alias := ""
+	if data.Alias != "" {
+		alias = data.Alias + "@" + settings.BaseDomain
+	}
+	err = db.SetPrimaryAlias(userId, address, alias)
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	aliases, err := db.ListAliases(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -13,10 +14,14 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
-	"github.com/segmentio/analytics-go"
 
+	"bt/calendar"
 	"bt/db"
+	"bt/events"
+	"bt/helpers"
+	"bt/hooks"
 	"bt/mailgun"
+	"bt/reports"
 	"bt/trello"
 )
 
@@ -50,13 +55,8 @@ func SetSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// send the jwt token for this user
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims["id"] = user.Id
-	token.Claims["token"] = data.TrelloToken
-	token.Claims["iat"] = time.Now().Unix()
-	token.Claims["exp"] = time.Now().Add(time.Second * 3600 * 24 * 365).Unix()
-	jwtString, err := token.SignedString([]byte(settings.SessionSecret))
+	// start a session, the trello token stays with us
+	tokens, err := startSession(user.Id, data.TrelloToken)
 	if err != nil {
 		sendJSONError(w, err, 500, logger)
 		return
@@ -66,17 +66,15 @@ func SetSession(w http.ResponseWriter, r *http.Request) {
 	}).Info("logged in")
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"jwt": jwtString})
+	json.NewEncoder(w).Encode(tokens)
 
 	// tracking
 	if new {
-		segment.Identify(&analytics.Identify{
-			UserId: user.Id,
-			Traits: map[string]interface{}{
-				"username": user.Username,
-				"name":     user.FullName,
-				"avatar":   user.AvatarSource,
-			},
+		tracking.Publish(events.UserSignedUp{
+			UserId:   user.Id,
+			Username: user.Username,
+			FullName: user.FullName,
+			Avatar:   user.AvatarSource,
 		})
 	}
 }
@@ -104,6 +102,11 @@ func GetAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	optedOut, err := db.AnalyticsOptedOut(userId)
+	if err != nil {
+		logger.WithFields(log.Fields{"err": err, "user": userId}).Warn("error fetching analytics opt-out")
+	}
+
 	// making sure arrays are not null
 	if addresses == nil {
 		addresses = make([]db.Address, 0)
@@ -111,8 +114,9 @@ func GetAccount(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(db.Account{
-		Addresses:    addresses,
-		LastMessages: messages,
+		Addresses:       addresses,
+		LastMessages:    messages,
+		AnalyticsOptOut: optedOut,
 	})
 }
 
@@ -127,8 +131,8 @@ func GetAddress(w http.ResponseWriter, r *http.Request) {
 
 	// address data
 	address, err := db.GetAddress(userId, vars["address"]+"@"+settings.BaseDomain)
-	if err != nil {
-		sendJSONError(w, err, 404, logger)
+	if err != nil || address == nil {
+		sendJSONError(w, errors.New("address not found"), 404, logger)
 		return
 	}
 	MaybeFillDomainInformation(address)
@@ -138,6 +142,30 @@ func GetAddress(w http.ResponseWriter, r *http.Request) {
 }
 
 func SetAccount(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/* account preferences
+	   for now this is just {analyticsOptOut: true|false}
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	data := struct {
+		AnalyticsOptOut bool `json:"analyticsOptOut"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	err = db.SetAnalyticsOptOut(userId, data.AnalyticsOptOut)
+	if err != nil {
+		logger.WithFields(log.Fields{"err": err, "user": userId}).Error("error saving analytics opt-out")
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.WriteHeader(200)
 }
 
 func SetAddress(w http.ResponseWriter, r *http.Request) {
@@ -147,9 +175,14 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 		   add bot to board
 		   send welcome message */
 	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
-	trelloToken := context.Get(r, "user").(*jwt.Token).Claims["token"].(string)
 	vars := mux.Vars(r)
 
+	trelloToken, err := sessionTrelloToken(r)
+	if err != nil {
+		sendJSONError(w, err, 401, logger)
+		return
+	}
+
 	data := struct {
 		ListId       string `json:"listId"`
 		InboundAddr  string `json:"inboundAddr"  validate:"email"`
@@ -157,12 +190,18 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 	}{
 		InboundAddr: vars["address"] + "@" + settings.BaseDomain,
 	}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err = json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		sendJSONError(w, err, 400, logger)
 		return
 	}
 
+	// the address is the one on the path, that is what was authorized
+	if !strings.EqualFold(data.InboundAddr, vars["address"]+"@"+settings.BaseDomain) {
+		sendJSONError(w, errors.New("inboundAddr doesn't match the address on the url."), 400, logger)
+		return
+	}
+
 	// outboundaddr defaults to inboundaddr
 	if data.OutboundAddr == "" {
 		data.OutboundAddr = data.InboundAddr
@@ -178,6 +217,26 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// an alias of some other address can't become an address
+	if resolved, err := db.ResolveAlias(data.InboundAddr); err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	} else if resolved != strings.ToLower(data.InboundAddr) {
+		sendJSONError(w, errors.New("this address is already in use as an alias."), 400, logger)
+		return
+	}
+
+	// people with lesser roles on an existing address can't take it over
+	oldAddress, err := db.GetAddress(userId, data.InboundAddr)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if oldAddress != nil && oldAddress.Role != db.OWNER {
+		sendJSONError(w, errors.New("only the owner can change where the address goes."), 403, logger)
+		return
+	}
+
 	logger.WithFields(log.Fields{
 		"user":         userId,
 		"address":      data.InboundAddr,
@@ -194,7 +253,6 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 		logger.WithFields(log.Fields{
 			"err":     err.Error(),
 			"user":    userId,
-			"token":   trelloToken,
 			"address": data.InboundAddr,
 			"list":    data.ListId,
 		}).Error("couldn't fetch board or ensure the existence of the bot on the board")
@@ -203,8 +261,7 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// first remove old domains and routes
-	oldAddress, err := db.GetAddress(userId, data.InboundAddr)
-	if err == nil {
+	if oldAddress != nil {
 		MaybeDeleteDomainAndRouteFlow(oldAddress, data.OutboundAddr)
 	}
 
@@ -262,16 +319,16 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(newAddress)
 
+	// roles come from the members of the board
+	go SyncBoardFlow(board.ShortLink)
+
 	// tracking
 	if new {
-		segment.Track(&analytics.Track{
-			Event:  "Created address",
-			UserId: userId,
-			Properties: map[string]interface{}{
-				"listId":  data.ListId,
-				"boardId": board.Id,
-				"address": data.InboundAddr,
-			},
+		tracking.Publish(events.AddressCreated{
+			UserId:  userId,
+			Address: data.InboundAddr,
+			ListId:  data.ListId,
+			BoardId: board.Id,
 		})
 
 		mailgun.Send(mailgun.NewMessage{
@@ -288,6 +345,8 @@ func SetAddress(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+const MAX_PLUS_TAGS = 20
+
 func ChangeAddressSettings(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
 
@@ -296,8 +355,14 @@ func ChangeAddressSettings(w http.ResponseWriter, r *http.Request) {
 
 	address := vars["address"] + "@" + settings.BaseDomain
 
+	addr, err := db.GetAddress(userId, address)
+	if err != nil || addr == nil {
+		sendJSONError(w, errors.New("address not found"), 404, logger)
+		return
+	}
+
 	var params db.AddressSettings
-	err := json.NewDecoder(r.Body).Decode(&params)
+	err = json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		sendJSONError(w, err, 400, logger)
 		return
@@ -309,6 +374,108 @@ func ChangeAddressSettings(w http.ResponseWriter, r *http.Request) {
 		params.SignatureTemplate = params.SignatureTemplate[:250]
 	}
 	// ReplyTo is verified to be a valid email at send time.
+	switch params.ThreadingMode {
+	case db.NEW_CARD, db.REOPEN, db.LINK:
+	default:
+		params.ThreadingMode = db.REOPEN
+	}
+	if params.ReopenDays <= 0 {
+		params.ReopenDays = db.DEFAULT_REOPEN_DAYS
+	}
+	if params.FirstResponseHours < 0 {
+		params.FirstResponseHours = 0
+	}
+	if params.NextResponseHours < 0 {
+		params.NextResponseHours = 0
+	}
+	params.AutoAckTemplate = strings.TrimSpace(params.AutoAckTemplate)
+	if len(params.AutoAckTemplate) > 2000 {
+		params.AutoAckTemplate = params.AutoAckTemplate[:2000]
+	}
+	_, err = parseAcknowledgementTemplate(params.AutoAckTemplate)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	params.TicketTag = strings.TrimSpace(strings.NewReplacer("[", "", "]", "", "#", "").Replace(params.TicketTag))
+	if len(params.TicketTag) > 30 {
+		params.TicketTag = params.TicketTag[:30]
+	}
+	if len(params.Reminders) > 10 {
+		params.Reminders = params.Reminders[:10]
+	}
+	for _, reminder := range params.Reminders {
+		switch reminder.Action {
+		case db.MENTION, db.OVERDUE, db.MOVE_TO_TOP:
+		default:
+			sendJSONError(w, errors.New("invalid reminder action: "+string(reminder.Action)), 400, logger)
+			return
+		}
+		if reminder.Hours <= 0 {
+			sendJSONError(w, errors.New("reminders must be set for a positive number of hours"), 400, logger)
+			return
+		}
+	}
+	for status, placement := range params.Statuses {
+		switch status {
+		case db.NEW, db.WAITING_ON_US, db.WAITING_ON_CUSTOMER, db.CLOSED:
+		default:
+			sendJSONError(w, errors.New("invalid status: "+string(status)), 400, logger)
+			return
+		}
+		placement.Label = strings.TrimSpace(placement.Label)
+		params.Statuses[status] = placement
+	}
+	if len(params.PlusTags) > MAX_PLUS_TAGS {
+		sendJSONError(w, errors.New("too many plus tags for this address"), 400, logger)
+		return
+	}
+	plusTags := make(map[string]db.PlusTagRoute, len(params.PlusTags))
+	for tag, route := range params.PlusTags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !helpers.ValidPlusTag(tag) {
+			sendJSONError(w, errors.New("invalid plus tag: "+tag), 400, logger)
+			return
+		}
+		route.Label = strings.TrimSpace(route.Label)
+		route.MemberId = strings.TrimSpace(route.MemberId)
+		route.ListId = strings.TrimSpace(route.ListId)
+		plusTags[tag] = route
+	}
+	params.PlusTags = plusTags
+	params.TimeZone = strings.TrimSpace(params.TimeZone)
+	_, err = calendar.New(params.TimeZone, params.BusinessHours, params.Holidays)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	// lists must be on the same board as the address' list
+	params.CustomerReplyList = strings.TrimSpace(params.CustomerReplyList)
+	params.AgentReplyList = strings.TrimSpace(params.AgentReplyList)
+	var lists []string
+	for _, listId := range []string{params.CustomerReplyList, params.AgentReplyList} {
+		if listId != "" {
+			lists = append(lists, listId)
+		}
+	}
+	for _, placement := range params.Statuses {
+		if placement.ListId != "" {
+			lists = append(lists, placement.ListId)
+		}
+	}
+	for _, route := range params.PlusTags {
+		if route.ListId != "" {
+			lists = append(lists, route.ListId)
+		}
+	}
+	if len(lists) > 0 {
+		err = validateListsOnBoard(addr.ListId, lists...)
+		if err != nil {
+			sendJSONError(w, err, 400, logger)
+			return
+		}
+	}
 
 	logger.WithFields(log.Fields{
 		"address": address,
@@ -316,20 +483,25 @@ func ChangeAddressSettings(w http.ResponseWriter, r *http.Request) {
 		"params":  params,
 	}).Info("changing settings")
 
-	err = db.ChangeAddressSettings(userId, address, params)
+	// settings are kept under the owner
+	err = db.ChangeAddressSettings(addr.UserId, address, params)
 	if err != nil {
 		sendJSONError(w, err, 400, logger)
 		return
 	}
 
+	// sla policies may have changed
+	go UpdateSLAsForAddressFlow(address)
+
+	go NotifyEndpointsFlow(address, hooks.SETTINGS_CHANGED, struct {
+		Settings db.AddressSettings `json:"settings"`
+	}{params})
+
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Changed settings",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"address":  vars["address"] + "@" + settings.BaseDomain,
-			"settings": params,
-		},
+	tracking.Publish(events.SettingsChanged{
+		UserId:   userId,
+		Address:  vars["address"] + "@" + settings.BaseDomain,
+		Settings: params,
 	})
 }
 
@@ -363,6 +535,9 @@ func DeleteAddress(w http.ResponseWriter, r *http.Request) {
 	// remove old domains and routes
 	MaybeDeleteDomainAndRouteFlow(address, "")
 
+	// mail bodies only this address had
+	DeleteArchivedBodiesFlow(address.InboundAddr)
+
 	// actually delete
 	err = address.Delete()
 	if err != nil {
@@ -384,15 +559,279 @@ func DeleteAddress(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Deleted address",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"address": vars["address"] + "@" + settings.BaseDomain,
-		},
+	tracking.Publish(events.AddressDeleted{
+		UserId:  userId,
+		Address: vars["address"] + "@" + settings.BaseDomain,
 	})
 }
 
+func GetAddressSLA(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   sla timers for all threads in this address that are waiting for a response
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	states, err := db.GetSLAsForAddress(userId, vars["address"]+"@"+settings.BaseDomain)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+func GetCardSLA(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	state, err := db.GetSLAForCard(userId, vars["card"])
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func GetAddressStatuses(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   statuses of all threads in this address, optionally only the ones with ?status=
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	states, err := db.GetStatusesForAddress(
+		userId,
+		vars["address"]+"@"+settings.BaseDomain,
+		db.ThreadStatus(r.URL.Query().Get("status")),
+	)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+func GetCardStatus(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	state, err := db.GetStatusForCard(userId, vars["card"])
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func MergeCard(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   merges this card into another of the same address, {"into": "<shortLink or url>"}
+	   the same as commenting "/merge into <url>" on it.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	data := struct {
+		Into string `json:"into"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	target := helpers.CardShortLink(data.Into)
+	if target == "" {
+		sendJSONError(w, errors.New("into should be a trello card url or shortLink"), 400, logger)
+		return
+	}
+
+	// the user must control the address of the card, the other must be on the same address
+	if _, err := db.GetStatusForCard(userId, vars["card"]); err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	err = MergeCardsFlow(vars["card"], target)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func SplitCard(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   moves a message we received on this card, and the later ones from the same sender,
+	   to a new card. {"message": "<message-id or comment id>"}
+	   the same as commenting "/split from <link to the comment>" on it.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	data := struct {
+		Message string `json:"message"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	if data.Message == "" {
+		sendJSONError(w, errors.New("which message?"), 400, logger)
+		return
+	}
+
+	if _, err := db.GetStatusForCard(userId, vars["card"]); err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	card, err := SplitThreadFlow(vars["card"], data.Message)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newHookCard(card.Id, card.ShortLink))
+}
+
+func GetAddressReport(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   volume and response times for the address.
+	   ?from=2016-07-01&to=2016-07-31 (both included, the last 30 days by default)
+	   ?tz=America/Sao_Paulo (the address time zone by default)
+	   ?format=csv&table=daily|weekly|senders|members
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+	query := r.URL.Query()
+
+	// time zone
+	var loc *time.Location
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			sendJSONError(w, fmt.Errorf("unknown time zone %s", tz), 400, logger)
+			return
+		}
+	} else {
+		cal, err := db.GetCalendarForAddress(address)
+		if err != nil {
+			sendJSONError(w, err, 404, logger)
+			return
+		}
+		loc = cal.Location()
+	}
+
+	// date range
+	now := time.Now().In(loc)
+	to := now
+	from := now.AddDate(0, 0, -29)
+	for param, date := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.ParseInLocation(reports.DAY, value, loc)
+			if err != nil {
+				sendJSONError(w, fmt.Errorf("%s should be a date like 2006-01-02", param), 400, logger)
+				return
+			}
+			*date = parsed
+		}
+	}
+	if to.Before(from) {
+		sendJSONError(w, errors.New("the report ends before it starts"), 400, logger)
+		return
+	}
+	if to.Sub(from) > MAX_REPORT_DAYS*24*time.Hour {
+		sendJSONError(w, fmt.Errorf("reports can't be longer than %d days", MAX_REPORT_DAYS), 400, logger)
+		return
+	}
+
+	table := query.Get("table")
+	if table == "" {
+		table = "daily"
+	}
+	csv := query.Get("format") == "csv"
+	if csv && !reports.ValidTable(table) {
+		sendJSONError(w, fmt.Errorf("unknown report table %s", table), 400, logger)
+		return
+	}
+
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	messages, err := db.GetReportMessages(userId, address, start.UnixNano()/int64(time.Millisecond), end.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	report := reports.Build(messages, from, to, loc)
+	for i, member := range report.Members {
+		if m, err := trello.Client.Member(member.Key); err == nil {
+			report.Members[i].Name = m.FullName
+		}
+	}
+
+	if csv {
+		w.Header().Add("Content-Type", "text/csv")
+		w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s-%s-%s.csv"`,
+			vars["address"], table, report.From, report.To))
+		reports.WriteCSV(w, report, table)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+const MAX_REPORT_DAYS = 366
+
+// validateListsOnBoard checks that the lists exist and are on the same board as targetListId.
+func validateListsOnBoard(targetListId string, listIds ...string) error {
+	target, err := trello.Client.List(targetListId)
+	if err != nil {
+		return err
+	}
+	for _, listId := range listIds {
+		list, err := trello.Client.List(listId)
+		if err != nil {
+			return fmt.Errorf("list %s not found on trello", listId)
+		}
+		if list.IdBoard != target.IdBoard {
+			return fmt.Errorf("list %s is not on the same board", list.Name)
+		}
+		if list.Closed {
+			return fmt.Errorf("list %s is archived", list.Name)
+		}
+	}
+	return nil
+}
+
 func CheckDomainDNS(w http.ResponseWriter, r *http.Request) {
 	domain := mux.Vars(r)["domain"]
 	mailgun.VerifyDNS(domain)
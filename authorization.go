@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bt/access"
+	"bt/db"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+)
+
+// the rules for each route are in access/access.go.
+
+// PAYPAL_STATE_TTL is how long someone has to finish paying on paypal, which keeps its
+// own checkout tokens for 3 hours.
+const PAYPAL_STATE_TTL = 3 * time.Hour
+
+func sessionUser(r *http.Request) string {
+	return context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+}
+
+func accessDenied(w http.ResponseWriter, r *http.Request, rule access.Rule, err error) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	switch err {
+	case access.ErrNotFound:
+		sendJSONError(w, errors.New(rule.Resource+" not found"), 404, logger)
+	case access.ErrForbidden:
+		logger.WithFields(log.Fields{
+			"user":  sessionUser(r),
+			"path":  r.URL.Path,
+			"level": rule.Level,
+		}).Warn("not allowed")
+		sendJSONError(w, errors.New("you need to be "+rule.Level+" to do this"), 403, logger)
+	default:
+		sendJSONError(w, err, 500, logger)
+	}
+}
+
+func accessStore() access.Store {
+	return access.Store{
+		BaseDomain: settings.BaseDomain,
+		AddressForCard: func(card string) (string, error) {
+			address, err := db.GetAddressForCard(card)
+			return address, ignoreNoRows(err)
+		},
+		UserForDomain: func(host string) (string, error) {
+			userId, err := db.GetUserForDomain(host)
+			return userId, ignoreNoRows(err)
+		},
+		UserForAddress: func(address string) (string, error) {
+			userId, err := db.GetUserForAddress(address)
+			return userId, ignoreNoRows(err)
+		},
+		Role: func(userId, address string) (string, error) {
+			role, err := db.GetRole(userId, address)
+			return string(role), err
+		},
+	}
+}
+
+func ignoreNoRows(err error) error {
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil
+	}
+	return err
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"bt/access"
 	"bt/db"
+	"bt/events"
 	"bt/paypal"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
-	"github.com/segmentio/analytics-go"
 )
 
 func UpgradeList(w http.ResponseWriter, r *http.Request) {
@@ -21,25 +25,14 @@ func UpgradeList(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	emailAddress := vars["address"] + "@" + settings.BaseDomain
 
-	addressOwnerId, err := db.GetUserForAddress(emailAddress)
-	if addressOwnerId != userId {
-		err = errors.New(userId + " doesn't own " + emailAddress + " because " + addressOwnerId + " does")
-	}
-	if err != nil {
-		logger.WithFields(log.Fields{
-			"err":     err.Error(),
-			"address": emailAddress,
-			"userId":  userId,
-			"ownerId": addressOwnerId,
-		}).Error("couldn't verify user ownership of this address")
-		sendJSONError(w, err, 403, logger)
-		return
-	}
-
+	// paypal gives the state back to us on the return urls
+	state := url.Values{}
+	kid, secret := keyring.Current()
+	state.Set("state", access.SignState(kid, secret, time.Now().Add(PAYPAL_STATE_TTL), "paypal", userId, emailAddress))
 	successURL, _ := router.Get("paypal-success").URL("address", vars["address"])
-	successURL.RawQuery = "userId=" + userId
+	successURL.RawQuery = state.Encode()
 	failureURL, _ := router.Get("paypal-failure").URL("address", vars["address"])
-	failureURL.RawQuery = "userId=" + userId
+	failureURL.RawQuery = state.Encode()
 
 	paypalPayURL, err := paypal.GetAuthURL(userId,
 		emailAddress,
@@ -60,13 +53,10 @@ func UpgradeList(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, paypalPayURL)
 
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Started subscription creation",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"address":  emailAddress,
-			"provider": "Paypal",
-		},
+	tracking.Publish(events.SubscriptionStarted{
+		UserId:   userId,
+		Address:  emailAddress,
+		Provider: "Paypal",
 	})
 }
 
@@ -97,10 +87,19 @@ func PaypalSuccess(w http.ResponseWriter, r *http.Request) {
 	emailAddress := vars["address"] + "@" + settings.BaseDomain
 
 	query := r.URL.Query()
-	userId := query.Get("userId")
 	token := query.Get("token")
 	payerId := query.Get("PayerID")
 
+	userId, err := paypalStateUser(query.Get("state"), emailAddress)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"err":     err.Error(),
+			"address": emailAddress,
+		}).Warn("paypal returned with a bad state")
+		http.Redirect(w, r, settings.DashboardURL+"#error=This payment link is invalid or has expired, please try again.", http.StatusFound)
+		return
+	}
+
 	profileId, err := paypal.CreateSubscription(userId, emailAddress, token, payerId)
 	if err != nil {
 		logger.WithFields(log.Fields{
@@ -128,27 +127,46 @@ func PaypalSuccess(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, settings.DashboardURL+"#success=Your subscription has been successfully created.", http.StatusFound)
 
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Created subscription",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"address":  emailAddress,
-			"value":    18,
-			"provider": "Paypal",
-		},
+	tracking.Publish(events.SubscriptionCreated{
+		UserId:   userId,
+		Address:  emailAddress,
+		Provider: "Paypal",
+		Value:    18,
 	})
 }
 
 func PaypalFailure(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	userId := query.Get("userId")
-
 	vars := mux.Vars(r)
+	emailAddress := vars["address"] + "@" + settings.BaseDomain
+
+	// only for the logs, nothing is changed here
+	userId, _ := paypalStateUser(r.URL.Query().Get("state"), emailAddress)
 
 	log.WithFields(log.Fields{
-		"address": vars["address"] + "@" + settings.BaseDomain,
+		"address": emailAddress,
 		"userId":  userId,
 	}).Error("paypal failure")
 
 	http.Redirect(w, r, settings.DashboardURL+"#error=Couldn't authorize the payment. That's all we know.", http.StatusFound)
 }
+
+// paypalStateUser returns who started paying for the address, if they still own it.
+func paypalStateUser(state, emailAddress string) (userId string, err error) {
+	values, err := access.ParseState(keyring.Secret, state, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(values) != 3 || values[0] != "paypal" || !strings.EqualFold(values[2], emailAddress) {
+		return "", access.ErrInvalidState
+	}
+	userId = values[1]
+
+	ownerId, err := db.GetUserForAddress(emailAddress)
+	if err != nil {
+		return "", err
+	}
+	if ownerId != userId {
+		return "", errors.New(userId + " doesn't own " + emailAddress + " anymore")
+	}
+	return userId, nil
+}
@@ -0,0 +1,105 @@
+package blobs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestBlobs(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("blobs", func() {
+
+		dir, _ := ioutil.TempDir("", "blobs")
+		g.After(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("should make keys that are safe paths", func() {
+			key := Key("mails", "<weird/../id@example.com>")
+			Expect(key).To(HavePrefix("mails/"))
+			Expect(validKey(key)).To(BeTrue())
+			Expect(Key("mails", "a")).ToNot(Equal(Key("mails", "b")))
+
+			Expect(validKey("../etc/passwd")).To(BeFalse())
+			Expect(validKey("/etc/passwd")).To(BeFalse())
+			Expect(validKey("")).To(BeFalse())
+		})
+
+		for name, open := range map[string]func() (Store, error){
+			"file":   func() (Store, error) { return Open(dir) },
+			"memory": func() (Store, error) { return Open("memory:") },
+		} {
+			open := open
+			g.It("should put, get and delete with the "+name+" store", func() {
+				store, err := open()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(store.Put("a/b/c", []byte("hello"))).To(Succeed())
+				Expect(store.Put("a/b/c", []byte("hello again"))).To(Succeed())
+				Expect(store.Get("a/b/c")).To(Equal([]byte("hello again")))
+
+				Expect(store.Delete("a/b/c")).To(Succeed())
+				_, err = store.Get("a/b/c")
+				Expect(err).To(Equal(ErrNotFound))
+				Expect(store.Delete("a/b/c")).To(Succeed())
+
+				Expect(store.Put("../outside", []byte("x"))).ToNot(Succeed())
+			})
+		}
+
+		g.It("should keep messages", func() {
+			store := NewMemoryStore()
+			key, err := PutMessage(store, "Help@example.com", Message{
+				Id:      "<m1@example.com>",
+				Inbound: true,
+				Subject: "Hello",
+				Text:    "how are you?",
+				Headers: [][2]string{{"Message-Id", "<m1@example.com>"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key).To(Equal(Key("mails", "help@example.com/<m1@example.com>")))
+
+			// the same message id on another address is another message
+			other, err := PutMessage(store, "sales@example.com", Message{Id: "<m1@example.com>", Subject: "Spoofed"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other).ToNot(Equal(key))
+
+			message, err := GetMessage(store, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message.Subject).To(Equal("Hello"))
+			Expect(message.Headers[0][1]).To(Equal("<m1@example.com>"))
+		})
+
+		g.It("should build the search text", func() {
+			Expect(SearchText(Message{
+				Subject: "Order  #123",
+				From:    "Someone@Example.com",
+				To:      []string{"help@example.com"},
+				Text:    "Where\nis it?",
+			})).To(Equal(`order #123 someone@example.com help@example.com where is it?`))
+			Expect(SearchTerms("  Where IS ")).To(Equal([]string{"where", "is"}))
+			Expect(SearchTerms("")).To(BeEmpty())
+
+			long := SearchText(Message{Text: strings.Repeat("é", MAX_SEARCH_TEXT)})
+			Expect(len(long)).To(BeNumerically("<=", MAX_SEARCH_TEXT))
+			Expect(strings.HasSuffix(long, "é")).To(BeTrue())
+		})
+
+		g.It("should cut snippets around the terms", func() {
+			text := strings.Repeat("a ", 100) + "needle" + strings.Repeat(" b", 100)
+			snippet := Snippet(text, []string{"needle"}, 20)
+			Expect(snippet).To(ContainSubstring("needle"))
+			Expect(snippet).To(HavePrefix("…"))
+			Expect(snippet).To(HaveSuffix("…"))
+			Expect(Snippet("short", []string{"nothing"}, 20)).To(Equal("short"))
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package blobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message is how mail bodies are kept in the store.
+type Message struct {
+	Id      string      `json:"id"`
+	Inbound bool        `json:"inbound"`
+	Subject string      `json:"subject"`
+	From    string      `json:"from"`
+	To      []string    `json:"to"`
+	Date    int64       `json:"date"`
+	Text    string      `json:"text"`
+	HTML    string      `json:"html"`
+	Headers [][2]string `json:"headers"`
+
+	Attachments []AttachmentRef `json:"attachments,omitempty"`
+}
+
+// AttachmentRef points to an attachment kept in the store by itself.
+type AttachmentRef struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Key         string `json:"key"`
+}
+
+// PutAttachment keeps an attachment of a message archived by an address. like messages,
+// each address has its own copy.
+func PutAttachment(store Store, address, messageId string, index int, name, contentType string, data []byte) (ref AttachmentRef, err error) {
+	ref = AttachmentRef{
+		Name:        name,
+		ContentType: contentType,
+		Size:        len(data),
+		Key:         Key("attachments", fmt.Sprintf("%s/%s/%d/%s", strings.ToLower(address), messageId, index, name)),
+	}
+	err = store.Put(ref.Key, data)
+	return
+}
+
+// PutMessage keeps a message archived by an address. message ids come from senders, so
+// they only name a message within the address that received it.
+func PutMessage(store Store, address string, message Message) (key string, err error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	key = Key("mails", strings.ToLower(address)+"/"+message.Id)
+	err = store.Put(key, data)
+	return
+}
+
+func GetMessage(store Store, key string) (message Message, err error) {
+	data, err := store.Get(key)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &message)
+	return
+}
+
+// MAX_SEARCH_TEXT limits how much of each message is kept in the graph for searching.
+const MAX_SEARCH_TEXT = 20000
+
+// SearchText is what the search looks into: subject, sender and text, lowercased and
+// with whitespace collapsed.
+func SearchText(message Message) string {
+	text := strings.ToLower(strings.Join(strings.Fields(
+		message.Subject+" "+message.From+" "+strings.Join(message.To, " ")+" "+message.Text,
+	), " "))
+	if len(text) > MAX_SEARCH_TEXT {
+		// cut on a rune boundary
+		cut := 0
+		for i := range text {
+			if i > MAX_SEARCH_TEXT {
+				break
+			}
+			cut = i
+		}
+		text = text[:cut]
+	}
+	return text
+}
+
+// SearchTerms splits a query the same way SearchText is built.
+func SearchTerms(query string) []string {
+	terms := strings.Fields(strings.ToLower(query))
+	if terms == nil {
+		terms = make([]string, 0)
+	}
+	return terms
+}
+
+// Snippet is a piece of the search text around the first term found in it.
+func Snippet(text string, terms []string, width int) string {
+	at := -1
+	for _, term := range terms {
+		if i := strings.Index(text, term); i != -1 && (at == -1 || i < at) {
+			at = i
+		}
+	}
+	if at == -1 {
+		at = 0
+	}
+
+	start := at - width/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + width
+	if end > len(text) {
+		end = len(text)
+	}
+	// cut on rune boundaries
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	snippet := text[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
@@ -17,17 +17,28 @@ export default function app ({MAIN, NAV, HTTP, TRELLO}) {
     .select('login')
     .mergeAll()
 
-  let jwt$ = loginResponse$
+  let refreshResponse$ = HTTP
+    .select('refresh')
+    .mergeAll()
+
+  // {jwt, refresh, expires}, the jwt is short-lived and the refresh token gets the next
+  let session$ = Rx.Observable.merge(loginResponse$, refreshResponse$)
     .filter(res => res.status < 300)
-    .map(res => res.body.jwt)
+    .map(res => res.body)
+    .share()
+
+  let jwt$ = session$
+    .map(session => session.jwt)
     .share()
     .startWith(null)
 
   let logout$ = Rx.Observable.merge(
     menuClick$.filter(item => item === 'logout'),
-    loginResponse$.filter(res => res.status >= 300)
+    loginResponse$.filter(res => res.status >= 300),
+    refreshResponse$.filter(res => res.status >= 300)
   )
     .map(false)
+    .share()
 
   let logged$ = Rx.Observable.merge(jwt$, logout$)
     .map(x => !!x)
@@ -248,6 +259,26 @@ export default function app ({MAIN, NAV, HTTP, TRELLO}) {
         method: 'POST',
         send: {trello_token: token}
       })),
+    // get a new jwt a minute before the current one expires
+    session$
+      .flatMapLatest(({refresh, expires}) =>
+        Rx.Observable.timer(Math.max(expires * 1000 - Date.now() - 60000, 0))
+          .map({
+            category: 'refresh',
+            url: API + '/api/session/refresh',
+            method: 'POST',
+            send: {refresh}
+          })
+          .takeUntil(logout$)
+      ),
+    // end the session on our side too
+    menuClick$
+      .filter(item => item === 'logout')
+      .map(() => ({
+        category: 'logout',
+        url: API + '/api/session',
+        method: 'DELETE'
+      })),
     // get boardthreads account info
     Rx.Observable.merge(
       logged$.filter(logged => logged === true),
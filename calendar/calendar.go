@@ -0,0 +1,243 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how far ahead we look for an opening before giving up
+const horizon = 2 * 366
+
+type Span struct {
+	Start string `json:"start"` // "09:00"
+	End   string `json:"end"`   // "18:00", "24:00" for the end of the day
+}
+
+type Calendar struct {
+	location *time.Location
+	week     [7][]span
+	holidays map[string]bool
+}
+
+// minutes since midnight, local time
+type span struct {
+	start int
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Always is open every minute of every day.
+var Always, _ = New("UTC", nil, nil)
+
+// New builds a calendar from the settings of an address. an empty timezone means UTC,
+// empty hours mean open all day every day and days missing from hours are closed.
+// holidays are local dates formatted as 2006-01-02.
+func New(timezone string, hours map[string][]Span, holidays []string) (*Calendar, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", timezone)
+	}
+
+	c := &Calendar{
+		location: location,
+		holidays: make(map[string]bool),
+	}
+
+	if len(hours) == 0 {
+		for day := range c.week {
+			c.week[day] = []span{{0, 24 * 60}}
+		}
+	}
+
+	open := false
+	for name, spans := range hours {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %s", name)
+		}
+
+		for _, s := range spans {
+			start, err := parseClock(s.Start)
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseClock(s.End)
+			if err != nil {
+				return nil, err
+			}
+			if start >= end {
+				return nil, fmt.Errorf("business hours on %s end before they start", name)
+			}
+			c.week[day] = append(c.week[day], span{start, end})
+			open = true
+		}
+
+		sort.Sort(byStart(c.week[day]))
+		for i := 1; i < len(c.week[day]); i++ {
+			if c.week[day][i].start < c.week[day][i-1].end {
+				return nil, fmt.Errorf("business hours on %s overlap", name)
+			}
+		}
+	}
+	if len(hours) > 0 && !open {
+		return nil, errors.New("there are no business hours in the week")
+	}
+
+	for _, h := range holidays {
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(h))
+		if err != nil {
+			return nil, fmt.Errorf("invalid holiday %s, dates should look like 2006-01-02", h)
+		}
+		c.holidays[date.Format("2006-01-02")] = true
+	}
+
+	return c, nil
+}
+
+func (c *Calendar) Location() *time.Location {
+	return c.location
+}
+
+func (c *Calendar) IsOpen(t time.Time) bool {
+	for _, o := range c.openings(t.In(c.location), 0) {
+		if !t.Before(o[0]) && t.Before(o[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextBusinessMoment returns t itself if we are open at t, otherwise the moment we open next.
+// it returns the zero time if the calendar doesn't open again in the foreseeable future.
+func (c *Calendar) NextBusinessMoment(t time.Time) time.Time {
+	return c.Add(t, 0)
+}
+
+// Add returns the moment when d of business time will have passed since t.
+func (c *Calendar) Add(t time.Time, d time.Duration) time.Time {
+	local := t.In(c.location)
+	for i := 0; i < horizon; i++ {
+		for _, o := range c.openings(local, i) {
+			if !o[1].After(t) {
+				continue
+			}
+			start := o[0]
+			if start.Before(t) {
+				start = t
+			}
+
+			available := o[1].Sub(start)
+			if d <= available {
+				return start.Add(d).In(c.location)
+			}
+			d -= available
+		}
+	}
+	return time.Time{}
+}
+
+// Between returns how much business time there is from one moment to the other.
+func (c *Calendar) Between(from, to time.Time) time.Duration {
+	var total time.Duration
+	if !to.After(from) {
+		return total
+	}
+
+	local := from.In(c.location)
+	for i := 0; i < horizon; i++ {
+		for _, o := range c.openings(local, i) {
+			if !o[0].Before(to) {
+				return total
+			}
+			start, end := o[0], o[1]
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(to) {
+				end = to
+			}
+			if end.After(start) {
+				total += end.Sub(start)
+			}
+		}
+	}
+	return total
+}
+
+// openings returns the absolute start and end of each business span on the
+// local date that is `offset` days after the date of `local`.
+func (c *Calendar) openings(local time.Time, offset int) [][2]time.Time {
+	// walk the civil calendar at noon UTC so DST never shifts the date
+	y, m, d := local.Date()
+	y, m, d = time.Date(y, m, d+offset, 12, 0, 0, 0, time.UTC).Date()
+	date := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+
+	if c.holidays[date.Format("2006-01-02")] {
+		return nil
+	}
+
+	spans := c.week[date.Weekday()]
+	openings := make([][2]time.Time, 0, len(spans))
+	for _, s := range spans {
+		start := c.at(y, m, d, s.start)
+		end := c.at(y, m, d, s.end)
+		if end.After(start) {
+			openings = append(openings, [2]time.Time{start, end})
+		}
+	}
+	return openings
+}
+
+// at returns the first moment when the wall clock shows the given local time or later.
+// inside a DST gap time.Date would go back to the previous offset, so we look for the
+// moment the clocks jumped instead.
+func (c *Calendar) at(y int, m time.Month, d, minutes int) time.Time {
+	wall := time.Date(y, m, d, 0, minutes, 0, 0, time.UTC)
+	t := time.Date(y, m, d, 0, minutes, 0, 0, c.location)
+	if civil(t).Equal(wall) {
+		return t
+	}
+
+	lo, hi := t.Unix()-6*3600, t.Unix()+6*3600
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if civil(time.Unix(mid, 0).In(c.location)).Before(wall) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return time.Unix(hi, 0).In(c.location)
+}
+
+// civil is the wall clock reading of t, as if it were UTC
+func civil(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(strings.TrimSpace(clock), "%d:%d", &hour, &minute)
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %s, it should look like 09:30", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+type byStart []span
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].start < s[j].start }
@@ -0,0 +1,210 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestCalendar(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	newYork, _ := time.LoadLocation("America/New_York")
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	london, _ := time.LoadLocation("Europe/London")
+
+	nineToFive := []Span{{"09:00", "17:00"}}
+	weekdays := map[string][]Span{
+		"monday":    nineToFive,
+		"tuesday":   nineToFive,
+		"wednesday": nineToFive,
+		"thursday":  nineToFive,
+		"friday":    nineToFive,
+	}
+	allDaySunday := map[string][]Span{"sunday": {{"00:00", "24:00"}}}
+
+	g.Describe("building calendars", func() {
+
+		g.It("should default to UTC and open all the time", func() {
+			c, err := New("", nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Location()).To(Equal(time.UTC))
+
+			start := time.Date(2016, 7, 2, 3, 4, 0, 0, time.UTC)
+			Expect(c.IsOpen(start)).To(Equal(true))
+			Expect(c.Add(start, 50*time.Hour)).To(Equal(start.Add(50 * time.Hour)))
+			Expect(c.Between(start, start.Add(50*time.Hour))).To(Equal(50 * time.Hour))
+			Expect(Always.Add(start, time.Hour)).To(Equal(start.Add(time.Hour)))
+		})
+
+		g.It("should refuse invalid settings", func() {
+			_, err := New("Mars/Olympus_Mons", nil, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"someday": nineToFive}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"monday": {{"9h", "17:00"}}}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"monday": {{"09:00", "24:30"}}}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"monday": {{"17:00", "09:00"}}}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"monday": {{"09:00", "12:00"}, {"11:00", "17:00"}}}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", map[string][]Span{"monday": {}}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = New("UTC", nil, []string{"25/12/2016"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		g.It("should accept capitalized weekdays and unsorted spans", func() {
+			c, err := New("UTC", map[string][]Span{"Monday": {{"14:00", "18:00"}, {"08:00", "12:00"}}}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 9, 0, 0, 0, time.UTC))).To(Equal(true))
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 13, 0, 0, 0, time.UTC))).To(Equal(false))
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 15, 0, 0, 0, time.UTC))).To(Equal(true))
+		})
+	})
+
+	g.Describe("business hours", func() {
+		c, _ := New("America/New_York", weekdays, []string{"2016-12-26"})
+
+		g.It("should know when it is open", func() {
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 10, 0, 0, 0, newYork))).To(Equal(true))
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 8, 59, 0, 0, newYork))).To(Equal(false))
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 17, 0, 0, 0, newYork))).To(Equal(false))
+			Expect(c.IsOpen(time.Date(2016, 7, 2, 10, 0, 0, 0, newYork))).To(Equal(false)) // saturday
+			Expect(c.IsOpen(time.Date(2016, 12, 26, 10, 0, 0, 0, newYork))).To(Equal(false))
+		})
+
+		g.It("should use the calendar's time zone whatever the zone of the input", func() {
+			// 13:30 UTC is 09:30 in New York during the summer
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 13, 30, 0, 0, time.UTC))).To(Equal(true))
+			Expect(c.IsOpen(time.Date(2016, 7, 4, 12, 30, 0, 0, time.UTC))).To(Equal(false))
+		})
+
+		g.It("should find the next business moment", func() {
+			open := time.Date(2016, 7, 5, 11, 0, 0, 0, newYork)
+			Expect(c.NextBusinessMoment(open)).To(BeTemporally("==", open))
+
+			friday := time.Date(2016, 7, 8, 18, 0, 0, 0, newYork)
+			Expect(c.NextBusinessMoment(friday)).To(BeTemporally("==", time.Date(2016, 7, 11, 9, 0, 0, 0, newYork)))
+
+			closing := time.Date(2016, 7, 5, 17, 0, 0, 0, newYork)
+			Expect(c.NextBusinessMoment(closing)).To(BeTemporally("==", time.Date(2016, 7, 6, 9, 0, 0, 0, newYork)))
+		})
+
+		g.It("should add business time over the weekend", func() {
+			friday := time.Date(2016, 7, 8, 16, 0, 0, 0, newYork)
+			Expect(c.Add(friday, 2*time.Hour)).To(BeTemporally("==", time.Date(2016, 7, 11, 10, 0, 0, 0, newYork)))
+			Expect(c.Add(friday, 9*time.Hour)).To(BeTemporally("==", time.Date(2016, 7, 11, 17, 0, 0, 0, newYork)))
+			Expect(c.Add(friday, 10*time.Hour)).To(BeTemporally("==", time.Date(2016, 7, 12, 10, 0, 0, 0, newYork)))
+		})
+
+		g.It("should end exactly at closing time", func() {
+			monday := time.Date(2016, 7, 11, 13, 0, 0, 0, newYork)
+			Expect(c.Add(monday, 4*time.Hour)).To(BeTemporally("==", time.Date(2016, 7, 11, 17, 0, 0, 0, newYork)))
+		})
+
+		g.It("should skip holidays", func() {
+			friday := time.Date(2016, 12, 23, 16, 0, 0, 0, newYork)
+			Expect(c.Add(friday, 2*time.Hour)).To(BeTemporally("==", time.Date(2016, 12, 27, 10, 0, 0, 0, newYork)))
+			Expect(c.Between(friday, time.Date(2016, 12, 27, 10, 0, 0, 0, newYork))).To(Equal(2 * time.Hour))
+		})
+
+		g.It("should measure business time between two moments", func() {
+			friday := time.Date(2016, 7, 8, 16, 0, 0, 0, newYork)
+			Expect(c.Between(friday, time.Date(2016, 7, 11, 10, 0, 0, 0, newYork))).To(Equal(2 * time.Hour))
+			Expect(c.Between(friday, friday)).To(Equal(time.Duration(0)))
+			Expect(c.Between(friday, friday.Add(-time.Hour))).To(Equal(time.Duration(0)))
+
+			saturday := time.Date(2016, 7, 9, 10, 0, 0, 0, newYork)
+			Expect(c.Between(saturday, saturday.Add(24*time.Hour))).To(Equal(time.Duration(0)))
+		})
+	})
+
+	g.Describe("daylight saving time", func() {
+
+		g.It("should have a 23 hour day when the clocks go forward", func() {
+			c, _ := New("America/New_York", allDaySunday, nil)
+			start := time.Date(2016, 3, 13, 0, 0, 0, 0, newYork)
+			end := time.Date(2016, 3, 14, 0, 0, 0, 0, newYork)
+			Expect(c.Between(start, end)).To(Equal(23 * time.Hour))
+
+			// twelve hours after midnight it is 13:00 on the wall
+			Expect(c.Add(start, 12*time.Hour)).To(BeTemporally("==", time.Date(2016, 3, 13, 13, 0, 0, 0, newYork)))
+			Expect(c.Add(start, 23*time.Hour)).To(BeTemporally("==", end))
+		})
+
+		g.It("should have a 25 hour day when the clocks go back", func() {
+			c, _ := New("America/New_York", allDaySunday, nil)
+			start := time.Date(2016, 11, 6, 0, 0, 0, 0, newYork)
+			end := time.Date(2016, 11, 7, 0, 0, 0, 0, newYork)
+			Expect(c.Between(start, end)).To(Equal(25 * time.Hour))
+			Expect(c.Add(start, 12*time.Hour)).To(BeTemporally("==", time.Date(2016, 11, 6, 11, 0, 0, 0, newYork)))
+		})
+
+		g.It("should count spans that contain the transition in real time", func() {
+			c, _ := New("America/New_York", map[string][]Span{"sunday": {{"01:00", "04:00"}}}, nil)
+			spring := time.Date(2016, 3, 13, 0, 0, 0, 0, newYork)
+			Expect(c.Between(spring, spring.Add(24*time.Hour))).To(Equal(2 * time.Hour))
+			autumn := time.Date(2016, 11, 6, 0, 0, 0, 0, newYork)
+			Expect(c.Between(autumn, autumn.Add(24*time.Hour))).To(Equal(4 * time.Hour))
+
+			// 01:30 happens twice in the autumn, both are open
+			Expect(c.IsOpen(time.Date(2016, 11, 6, 5, 30, 0, 0, time.UTC))).To(Equal(true))
+			Expect(c.IsOpen(time.Date(2016, 11, 6, 6, 30, 0, 0, time.UTC))).To(Equal(true))
+		})
+
+		g.It("should open late when the opening time doesn't exist", func() {
+			c, _ := New("America/New_York", map[string][]Span{"sunday": {{"02:30", "05:00"}}}, nil)
+			spring := time.Date(2016, 3, 13, 0, 0, 0, 0, newYork)
+
+			// clocks jump from 01:59:59 EST to 03:00 EDT, which is when we open
+			opening := c.NextBusinessMoment(spring)
+			Expect(opening).To(BeTemporally("==", time.Date(2016, 3, 13, 7, 0, 0, 0, time.UTC)))
+			Expect(opening.Hour()).To(Equal(3))
+			Expect(c.IsOpen(opening.Add(-time.Second))).To(Equal(false))
+			Expect(c.Between(spring, spring.Add(24*time.Hour))).To(Equal(2 * time.Hour))
+		})
+
+		g.It("should keep business hours on the wall clock across the transition", func() {
+			c, _ := New("America/New_York", weekdays, nil)
+			friday := time.Date(2016, 3, 11, 16, 0, 0, 0, newYork) // EST
+			due := c.Add(friday, 2*time.Hour)
+			Expect(due.Hour()).To(Equal(10))
+			Expect(due).To(BeTemporally("==", time.Date(2016, 3, 14, 14, 0, 0, 0, time.UTC))) // EDT
+
+			Expect(c.Between(friday, due)).To(Equal(2 * time.Hour))
+		})
+
+		g.It("should handle days that don't start at midnight", func() {
+			// in 2016 Sao Paulo jumped from 23:59:59 on the 15th to 01:00 on the 16th
+			c, _ := New("America/Sao_Paulo", allDaySunday, nil)
+			saturday := time.Date(2016, 10, 15, 23, 30, 0, 0, saoPaulo)
+
+			opening := c.NextBusinessMoment(saturday)
+			Expect(opening).To(BeTemporally("==", time.Date(2016, 10, 16, 3, 0, 0, 0, time.UTC)))
+			Expect(opening.Hour()).To(Equal(1))
+			Expect(c.Between(saturday, saturday.Add(48*time.Hour))).To(Equal(23 * time.Hour))
+		})
+
+		g.It("should handle transitions in the other hemisphere", func() {
+			// clocks went back at midnight on 2016-02-21 in Sao Paulo
+			c, _ := New("America/Sao_Paulo", allDaySunday, nil)
+			sunday := time.Date(2016, 2, 21, 0, 0, 0, 0, saoPaulo)
+			Expect(c.Between(sunday.Add(-time.Hour), sunday.Add(48*time.Hour))).To(Equal(24 * time.Hour))
+		})
+
+		g.It("should handle transitions during the weekend in Europe", func() {
+			c, _ := New("Europe/London", weekdays, nil)
+			friday := time.Date(2016, 3, 25, 16, 30, 0, 0, london) // GMT
+			due := c.Add(friday, time.Hour)
+			Expect(due).To(BeTemporally("==", time.Date(2016, 3, 28, 8, 30, 0, 0, time.UTC))) // 09:30 BST
+			Expect(c.Between(friday, due)).To(Equal(time.Hour))
+		})
+	})
+}
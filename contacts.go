@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bt/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// contacts are the people on the other side of the threads, see db/contacts.go.
+
+const (
+	DEFAULT_CONTACTS = 50
+	MAX_CONTACTS     = 500
+)
+
+func GetContacts(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   everybody who has written to or was written from any of the user's addresses.
+	   ?q=part of the address, name or organisation
+	   ?limit=50
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	query := r.URL.Query()
+
+	limit := DEFAULT_CONTACTS
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MAX_CONTACTS {
+			sendJSONError(w, fmt.Errorf("limit must be a number between 1 and %d", MAX_CONTACTS), 400, logger)
+			return
+		}
+	}
+
+	contacts, err := db.ListContacts(userId, strings.TrimSpace(query.Get("q")), limit)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contacts)
+}
+
+func GetContact(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   a contact and all the threads they took part in, on any of the user's addresses.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	contact, threads, err := db.GetContact(userId, vars["contact"])
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*db.Contact
+		Threads []db.ContactThread `json:"threads"`
+	}{contact, threads})
+}
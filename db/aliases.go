@@ -0,0 +1,105 @@
+package db
+
+import (
+	"errors"
+	"strings"
+)
+
+// aliases are other inbound addresses for the same list, they have no settings of their
+// own and everything that arrives on them is handled as if it arrived on the address.
+
+type Alias struct {
+	Address string `json:"address" db:"address"`
+	Primary bool   `json:"primary" db:"isPrimary"` // replies on threads without a known alias are sent from it
+	Date    int64  `json:"date"    db:"date"`
+}
+
+func AddAlias(userId, address, alias string) (err error) {
+	var created bool
+	err = DB.Get(&created, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+OPTIONAL MATCH (taken:EmailAddress {address: {2}})
+OPTIONAL MATCH (takenAlias:Alias {address: {2}})
+WITH addr, taken, takenAlias
+WHERE taken IS NULL AND takenAlias IS NULL
+CREATE (addr)<-[:ALIAS_OF]-(:Alias {address: {2}, date: TIMESTAMP()})
+RETURN true
+    `, userId, strings.ToLower(address), strings.ToLower(alias))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return errors.New("couldn't add " + alias + ", it may be already in use")
+	}
+	return
+}
+
+func ListAliases(userId, address string) (aliases []Alias, err error) {
+	aliases = make([]Alias, 0)
+	err = DB.Select(&aliases, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)<-[:ALIAS_OF]-(a:Alias)
+RETURN
+  a.address AS address,
+  CASE WHEN a.address = addr.primaryAlias THEN true ELSE false END AS isPrimary,
+  a.date AS date
+ORDER BY a.date
+    `, userId, strings.ToLower(address))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return aliases, nil
+	}
+	return
+}
+
+func RemoveAlias(userId, address, alias string) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)<-[r:ALIAS_OF]-(a:Alias {address: {2}})
+SET addr.primaryAlias = CASE WHEN addr.primaryAlias = a.address THEN null ELSE addr.primaryAlias END
+DELETE r, a
+    `, userId, strings.ToLower(address), strings.ToLower(alias))
+	return
+}
+
+// SetPrimaryAlias makes replies without a known alias go out from the given alias.
+// an empty alias makes the address itself the primary again.
+func SetPrimaryAlias(userId, address, alias string) (err error) {
+	var found bool
+	err = DB.Get(&found, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+OPTIONAL MATCH (addr)<-[:ALIAS_OF]-(a:Alias {address: {2}})
+WITH addr, a
+WHERE a IS NOT NULL OR {2} = ""
+SET addr.primaryAlias = CASE WHEN a IS NOT NULL THEN a.address ELSE null END
+RETURN true
+    `, userId, strings.ToLower(address), strings.ToLower(alias))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return errors.New("couldn't find alias " + alias)
+	}
+	return
+}
+
+// ResolveAlias returns the address a recipient stands for, which is the recipient
+// itself when it is not an alias.
+func ResolveAlias(recipient string) (address string, err error) {
+	recipient = strings.ToLower(recipient)
+	err = DB.Get(&address, `
+MATCH (:Alias {address: {0}})-[:ALIAS_OF]->(addr:EmailAddress)
+RETURN addr.address
+    `, recipient)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return recipient, nil
+	}
+	return
+}
+
+// SaveMailArrival records on which of the address's aliases (or the address itself) a
+// mail arrived, and with which plus tag. the card keeps the last alias and tag so replies
+// go out from the same alias and keep the tag.
+func SaveMailArrival(cardShortLink, messageId, recipient, tag string) (err error) {
+	_, err = DB.Exec(`
+MATCH (c:Card {shortLink: {0}})-[r:CONTAINS]->(:Mail {id: {1}})
+SET r.arrivedOn = {2},
+    c.arrivedOn = {2},
+    r.plusTag = {3},
+    c.plusTag = CASE WHEN {3} <> "" THEN {3} ELSE c.plusTag END
+    `, cardShortLink, messageId, strings.ToLower(recipient), tag)
+	return
+}
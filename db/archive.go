@@ -0,0 +1,152 @@
+package db
+
+import (
+	"strings"
+)
+
+// mail bodies live in a blob store. each address that archived a mail has its own copy,
+// pointed to by "body" on its ARCHIVED relationship along with a lowercased "searchText",
+// the sender and the subject. archived mails stay searchable even after their card is gone.
+// message ids come from senders and mails with the same one are the same Mail node, so
+// nothing archived is ever kept on it.
+
+// ArchiveMail keeps the reference to the body of a mail on an address. the first one stays,
+// a later mail reusing the message id doesn't replace it.
+func ArchiveMail(address, mailId, bodyKey, searchText, sender, subject string) (err error) {
+	_, err = DB.Exec(`
+MATCH (addr:EmailAddress {address: {0}})
+MATCH (m:Mail {id: {1}})
+MERGE (addr)-[a:ARCHIVED]->(m)
+  ON CREATE SET
+    a.body = {2},
+    a.searchText = {3},
+    a.sender = {4},
+    a.subject = {5}
+    `, strings.ToLower(address), mailId, bodyKey, searchText, strings.ToLower(sender), subject)
+	return
+}
+
+// IsArchived tells if the address already has a body for the mail.
+func IsArchived(address, mailId string) (archived bool, err error) {
+	err = DB.Get(&archived, `
+OPTIONAL MATCH (:EmailAddress {address: {0}})-[a:ARCHIVED]->(:Mail {id: {1}})
+RETURN count(a) > 0
+    `, strings.ToLower(address), mailId)
+	return
+}
+
+// GetArchivedMail returns the key of the body of a mail in any of the user's addresses.
+func GetArchivedMail(userId, mailId string) (bodyKey string, err error) {
+	err = DB.Get(&bodyKey, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(:EmailAddress)-[a:ARCHIVED]->(:Mail {id: {1}})
+RETURN a.body
+LIMIT 1
+    `, userId, mailId)
+	return
+}
+
+// ListArchivedBodies returns the keys of the bodies archived by this address.
+func ListArchivedBodies(address string) (keys []string, err error) {
+	keys = make([]string, 0)
+	err = DB.Select(&keys, `
+MATCH (:EmailAddress {address: {0}})-[a:ARCHIVED]->(:Mail)
+RETURN a.body
+    `, strings.ToLower(address))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return keys, nil
+	}
+	return
+}
+
+type SearchParams struct {
+	Terms   []string
+	Sender  string
+	Address string
+	Since   int64 // unix milliseconds, 0 for no limit
+	Until   int64
+	Limit   int
+}
+
+type SearchResult struct {
+	Id            string `json:"id"            db:"id"`
+	Address       string `json:"address"       db:"address"`
+	CardShortLink string `json:"cardShortLink" db:"cardShortLink"`
+	Subject       string `json:"subject"       db:"subject"`
+	Sender        string `json:"sender"        db:"sender"`
+	Date          int64  `json:"date"          db:"date"`
+	Inbound       bool   `json:"inbound"       db:"inbound"`
+	Text          string `json:"-"             db:"searchText"`
+	Snippet       string `json:"snippet"`
+}
+
+func SearchMails(userId string, p SearchParams) (results []SearchResult, err error) {
+	results = make([]SearchResult, 0)
+	err = DB.Select(&results, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)-[a:ARCHIVED]->(m:Mail)
+WHERE ({1} = "" OR addr.address = {1})
+  AND ({2} = "" OR a.sender CONTAINS {2})
+  AND ({3} = 0 OR m.date >= {3})
+  AND ({4} = 0 OR m.date < {4})
+  AND ALL(term IN {5} WHERE a.searchText CONTAINS term)
+OPTIONAL MATCH (addr)<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m)
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH addr, a, m, collect(c.shortLink)[0] AS card, count(cm) = 0 AS inbound
+RETURN
+  m.id AS id,
+  addr.address AS address,
+  CASE WHEN card IS NOT NULL THEN card ELSE "" END AS cardShortLink,
+  CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE a.subject END AS subject,
+  a.sender AS sender,
+  m.date AS date,
+  inbound,
+  a.searchText AS searchText
+ORDER BY m.date DESC
+LIMIT {6}
+    `, userId, strings.ToLower(p.Address), strings.ToLower(p.Sender), p.Since, p.Until, p.Terms, p.Limit)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return results, nil
+	}
+	return
+}
+
+// ExportMail is a message of a thread being exported, Body is empty when it wasn't archived.
+type ExportMail struct {
+	CardId    string `db:"cardId"`
+	Id        string `db:"id"`
+	Date      int64  `db:"date"`
+	Subject   string `db:"subject"`
+	From      string `db:"from"`
+	CommentId string `db:"commentId"`
+	Body      string `db:"body"`
+	Inbound   bool   `db:"inbound"`
+	Outbound  string `db:"outbound"`
+}
+
+// GetExportMails returns the messages of a card, in order, if the user controls its address.
+func GetExportMails(userId, card string) (mails []ExportMail, err error) {
+	mails = make([]ExportMail, 0)
+	err = DB.Select(&mails, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)<-[:LINKED_TO]-(c:Card)
+WHERE c.shortLink = {1} OR c.id = {1}
+MATCH (addr)-[:SENDS_THROUGH]->(outbound:EmailAddress)
+MATCH (c)-[r:CONTAINS]->(m:Mail) WHERE NOT m.id =~ "fake-.*"
+OPTIONAL MATCH (addr)-[a:ARCHIVED]->(m)
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH c, r, outbound, m, a, count(cm) = 0 AS inbound
+RETURN
+  c.id AS cardId,
+  m.id AS id,
+  m.date AS date,
+  CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE "" END AS subject,
+  CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
+  CASE WHEN r.commentId IS NOT NULL THEN r.commentId WHEN m.commentId IS NOT NULL THEN m.commentId ELSE "" END AS commentId,
+  CASE WHEN a IS NOT NULL THEN a.body ELSE "" END AS body,
+  inbound,
+  LOWER(outbound.address) AS outbound
+ORDER BY m.date
+    `, userId, card)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return mails, nil
+	}
+	return
+}
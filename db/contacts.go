@@ -0,0 +1,185 @@
+package db
+
+import (
+	"strings"
+)
+
+type Contact struct {
+	Address      string `json:"address"      db:"address"`
+	Name         string `json:"name"         db:"name"`
+	Organisation string `json:"organisation" db:"organisation"`
+	Inbound      int    `json:"inbound"      db:"inbound"`  // mails they sent us
+	Outbound     int    `json:"outbound"     db:"outbound"` // mails we sent them
+	LastMail     int64  `json:"lastMail"     db:"lastMail"`
+}
+
+type ContactThread struct {
+	Address       string `json:"address"       db:"address"`
+	CardId        string `json:"cardId"        db:"cardId"`
+	CardShortLink string `json:"cardShortLink" db:"cardShortLink"`
+	Subject       string `json:"subject"       db:"subject"`
+	Mails         int    `json:"mails"         db:"mails"`
+	LastMail      int64  `json:"lastMail"      db:"lastMail"`
+}
+
+type PreviousConversation struct {
+	CardShortLink string `db:"cardShortLink"`
+	Subject       string `db:"subject"`
+	SameContact   bool   `db:"sameContact"` // otherwise it was someone else from the organisation
+	LastMail      int64  `db:"lastMail"`
+}
+
+// contactTotals sums up the mails of each contact, taking (ct, m, rel, name) rows. the
+// name is the last one they used on these mails.
+const contactTotals = `
+WITH ct, m, rel, name ORDER BY m.date DESC
+WITH ct,
+  sum(CASE WHEN rel = "SENT" THEN 1 ELSE 0 END) AS inbound,
+  sum(CASE WHEN rel = "RECEIVED" THEN 1 ELSE 0 END) AS outbound,
+  max(m.date) AS lastMail,
+  head(filter(n IN collect(name) WHERE n IS NOT NULL AND n <> "")) AS name
+WITH ct, inbound, outbound, lastMail, CASE WHEN name IS NOT NULL THEN name ELSE "" END AS name
+`
+
+type UnlinkedSender struct {
+	MailId string `db:"id"`
+	From   string `db:"from"`
+}
+
+// SaveContact links a mail to the external address that sent it (inbound) or
+// that received it (outbound), creating the contact if needed. contacts are shared by
+// all users, so the name used on the mail is kept on the link: each user only sees the
+// names on their own mails.
+func SaveContact(mailId, address, name, organisation string, inbound bool) (err error) {
+	rel := "RECEIVED"
+	if inbound {
+		rel = "SENT"
+	}
+	_, err = DB.Exec(`
+MATCH (m:Mail {id: {0}})
+MERGE (ct:Contact {address: {1}})
+  ON CREATE SET
+    ct.organisation = {3},
+    ct.date = TIMESTAMP()
+MERGE (ct)-[r:`+rel+`]->(m)
+  ON CREATE SET r.name = {2}
+    `, mailId, strings.ToLower(address), name, organisation)
+	return
+}
+
+// ListUnlinkedSenders returns inbound mails saved before contacts existed.
+func ListUnlinkedSenders(limit int) (senders []UnlinkedSender, err error) {
+	senders = make([]UnlinkedSender, 0)
+	err = DB.Select(&senders, `
+MATCH (m:Mail)
+WHERE m.from IS NOT NULL AND m.from <> ""
+  AND NOT m.id =~ "fake-.*"
+  AND NOT (m)<-[:COMMENTED]-(:User)
+  AND NOT (m)<-[:SENT]-(:Contact)
+RETURN m.id AS id, m.from AS from
+LIMIT {0}
+    `, limit)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return senders, nil
+	}
+	return
+}
+
+// ListContacts returns the people who wrote to or were written from any of the
+// user's addresses, most recent first. query filters by address, name or organisation.
+func ListContacts(userId, query string, limit int) (contacts []Contact, err error) {
+	contacts = make([]Contact, 0)
+	err = DB.Select(&contacts, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(:EmailAddress)<-[:LINKED_TO]-(:Card)-[:CONTAINS]->(m:Mail)<-[r:SENT|RECEIVED]-(ct:Contact)
+WITH DISTINCT ct, m, type(r) AS rel, r.name AS name
+`+contactTotals+`
+WHERE {1} = ""
+   OR ct.address CONTAINS {1}
+   OR LOWER(name) CONTAINS {1}
+   OR ct.organisation CONTAINS {1}
+RETURN
+  ct.address AS address,
+  name,
+  CASE WHEN ct.organisation IS NOT NULL THEN ct.organisation ELSE "" END AS organisation,
+  inbound,
+  outbound,
+  lastMail
+ORDER BY lastMail DESC
+LIMIT {2}
+    `, userId, strings.ToLower(query), limit)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return contacts, nil
+	}
+	return
+}
+
+// GetContact returns a contact and the threads it took part in, if the user
+// controls any of the addresses involved.
+func GetContact(userId, address string) (contact *Contact, threads []ContactThread, err error) {
+	contact = &Contact{}
+	err = DB.Get(contact, `
+MATCH (ct:Contact {address: {1}})
+MATCH (:User {id: {0}})-[:CONTROLS]->(:EmailAddress)<-[:LINKED_TO]-(:Card)-[:CONTAINS]->(m:Mail)<-[r:SENT|RECEIVED]-(ct)
+WITH DISTINCT ct, m, type(r) AS rel, r.name AS name
+`+contactTotals+`
+RETURN
+  ct.address AS address,
+  name,
+  CASE WHEN ct.organisation IS NOT NULL THEN ct.organisation ELSE "" END AS organisation,
+  inbound,
+  outbound,
+  lastMail
+    `, userId, strings.ToLower(address))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	threads = make([]ContactThread, 0)
+	err = DB.Select(&threads, `
+MATCH (ct:Contact {address: {1}})
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m:Mail)<-[:SENT|RECEIVED]-(ct)
+WITH addr, c, count(DISTINCT m) AS mails, max(m.date) AS lastMail
+OPTIONAL MATCH (c)-[:CONTAINS]->(s:Mail) WHERE s.subject IS NOT NULL
+WITH addr, c, mails, lastMail, s ORDER BY s.date
+WITH addr, c, mails, lastMail, head(collect(s.subject)) AS subject
+RETURN
+  addr.address AS address,
+  CASE WHEN c.id IS NOT NULL THEN c.id ELSE "" END AS cardId,
+  c.shortLink AS cardShortLink,
+  CASE WHEN subject IS NOT NULL THEN subject ELSE "" END AS subject,
+  mails,
+  lastMail
+ORDER BY lastMail DESC
+    `, userId, strings.ToLower(address))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return contact, threads, nil
+	}
+	return
+}
+
+// GetPreviousConversations returns the other cards on the same address where the contact
+// or someone from their organisation took part, most recent first.
+func GetPreviousConversations(cardShortLink, address, organisation string, limit int) (previous []PreviousConversation, err error) {
+	previous = make([]PreviousConversation, 0)
+	err = DB.Select(&previous, `
+MATCH (card:Card {shortLink: {0}})-[:LINKED_TO]->(addr:EmailAddress)
+MATCH (addr)<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m:Mail)<-[:SENT|RECEIVED]-(ct:Contact)
+WHERE c <> card
+  AND (ct.address = {1} OR ({2} <> "" AND ct.organisation = {2}))
+WITH c, max(m.date) AS lastMail, any(a IN collect(ct.address) WHERE a = {1}) AS sameContact
+OPTIONAL MATCH (c)-[:CONTAINS]->(s:Mail) WHERE s.subject IS NOT NULL
+WITH c, lastMail, sameContact, s ORDER BY s.date
+WITH c, lastMail, sameContact, head(collect(s.subject)) AS subject
+RETURN
+  c.shortLink AS cardShortLink,
+  CASE WHEN subject IS NOT NULL THEN subject ELSE "" END AS subject,
+  sameContact,
+  lastMail
+ORDER BY sameContact DESC, lastMail DESC
+LIMIT {3}
+    `, cardShortLink, strings.ToLower(address), organisation, limit)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return previous, nil
+	}
+	return
+}
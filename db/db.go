@@ -1,9 +1,13 @@
 package db
 
 import (
+	"bt/calendar"
 	"bt/mailgun"
+	"bt/reports"
+	"encoding/json"
 	"errors"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
@@ -12,7 +16,7 @@ import (
 	"gopkg.in/cq.v1/types"
 )
 
-var DB *sqlx.DB
+var DB timedDB
 
 type Settings struct {
 	Neo4jURL   string `envconfig:"GRAPHSTORY_URL" default:"http://localhost:7474/"`
@@ -28,7 +32,7 @@ func init() {
 		log.Fatal(err.Error())
 	}
 
-	DB = sqlx.MustConnect("neo4j-cypher", settings.Neo4jURL)
+	DB = timedDB{sqlx.MustConnect("neo4j-cypher", settings.Neo4jURL)}
 }
 
 func EnsureUser(id string) (new bool, err error) {
@@ -44,6 +48,27 @@ RETURN new
 	return
 }
 
+// AnalyticsOptedOut tells if the user doesn't want to be tracked. unknown users weren't
+// asked yet, so they are not opted out.
+func AnalyticsOptedOut(userId string) (optedOut bool, err error) {
+	err = DB.Get(&optedOut, `
+MATCH (u:User {id: {0}})
+RETURN CASE WHEN u.analyticsOptOut IS NOT NULL THEN u.analyticsOptOut ELSE false END
+    `, userId)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	}
+	return
+}
+
+func SetAnalyticsOptOut(userId string, optOut bool) (err error) {
+	_, err = DB.Exec(`
+MERGE (u:User {id: {0}})
+SET u.analyticsOptOut = {1}
+    `, userId, optOut)
+	return
+}
+
 func GetUserForAddress(address string) (userId string, err error) {
 	err = DB.Get(&userId, `
 MATCH (u:User)-[:CONTROLS]->(:EmailAddress {address: {0}})
@@ -52,16 +77,29 @@ RETURN u.id AS userId
 	return
 }
 
+func GetUserForDomain(host string) (userId string, err error) {
+	err = DB.Get(&userId, `
+MATCH (u:User)-[:OWNS]->(:Domain {host: {0}})
+RETURN u.id AS userId
+    `, strings.ToLower(host))
+	return
+}
+
 func GetAddress(userId, emailAddress string) (*Address, error) {
 	emailAddress = strings.ToLower(emailAddress)
 
 	address := Address{}
 	err := DB.Get(&address, `
-MATCH (out)<-[s:SENDS_THROUGH]-(addr:EmailAddress {address: {0}})<-[c:CONTROLS]-()
+MATCH (addr:EmailAddress {address: {0}})<-[:CONTROLS]-(owner:User)
+`+roleOf("{1}")+`
+MATCH (out)<-[s:SENDS_THROUGH]-(addr)<-[c:CONTROLS]-(owner)
+WHERE role <> "none"
 MATCH (addr)-[t:TARGETS]->(l:List)
 OPTIONAL MATCH (addr)-[sends:SENDS_THROUGH]->(o) WHERE o.address <> addr.address
-OPTIONAL MATCH (out)<-[:OWNS]-(d:Domain)<-[:OWNS]-(:User {id: {1}})
+OPTIONAL MATCH (out)<-[:OWNS]-(d:Domain)<-[:OWNS]-(owner)
 RETURN
+  owner.id AS userId,
+  role,
   l.id AS listId,
   addr.date AS date,
   addr.address AS inboundaddr,
@@ -74,7 +112,22 @@ RETURN
   CASE WHEN addr.addReplier IS NOT NULL THEN addr.addReplier ELSE false END AS addReplier,
   CASE WHEN addr.messageInDesc IS NOT NULL THEN addr.messageInDesc ELSE false END AS messageInDesc,
   CASE WHEN addr.signatureTemplate IS NOT NULL THEN addr.signatureTemplate ELSE "" END AS signatureTemplate,
-  CASE WHEN addr.moveToTop IS NOT NULL THEN addr.moveToTop ELSE false END AS moveToTop
+  CASE WHEN addr.moveToTop IS NOT NULL THEN addr.moveToTop ELSE false END AS moveToTop,
+  CASE WHEN addr.threadingMode IS NOT NULL THEN addr.threadingMode ELSE "reopen" END AS threadingMode,
+  CASE WHEN addr.reopenDays IS NOT NULL THEN addr.reopenDays ELSE 15 END AS reopenDays,
+  CASE WHEN addr.firstResponseHours IS NOT NULL THEN addr.firstResponseHours ELSE 0 END AS firstResponseHours,
+  CASE WHEN addr.nextResponseHours IS NOT NULL THEN addr.nextResponseHours ELSE 0 END AS nextResponseHours,
+  CASE WHEN addr.timezone IS NOT NULL THEN addr.timezone ELSE "" END AS timezone,
+  CASE WHEN addr.businessHours IS NOT NULL THEN addr.businessHours ELSE "" END AS businessHours,
+  CASE WHEN addr.holidays IS NOT NULL THEN addr.holidays ELSE [] END AS holidays,
+  CASE WHEN addr.autoAck IS NOT NULL THEN addr.autoAck ELSE false END AS autoAck,
+  CASE WHEN addr.autoAckTemplate IS NOT NULL THEN addr.autoAckTemplate ELSE "" END AS autoAckTemplate,
+  CASE WHEN addr.ticketTag IS NOT NULL THEN addr.ticketTag ELSE "" END AS ticketTag,
+  CASE WHEN addr.reminders IS NOT NULL THEN addr.reminders ELSE "" END AS reminders,
+  CASE WHEN addr.statuses IS NOT NULL THEN addr.statuses ELSE "" END AS statuses,
+  CASE WHEN addr.customerReplyList IS NOT NULL THEN addr.customerReplyList ELSE "" END AS customerReplyList,
+  CASE WHEN addr.agentReplyList IS NOT NULL THEN addr.agentReplyList ELSE "" END AS agentReplyList,
+  CASE WHEN addr.plusTags IS NOT NULL THEN addr.plusTags ELSE "" END AS plusTags
 LIMIT 1
 `, emailAddress, userId)
 	if err != nil {
@@ -88,7 +141,6 @@ LIMIT 1
 	}
 
 	// post processing
-	address.UserId = userId
 	address.PostProcess()
 
 	return &address, nil
@@ -96,10 +148,17 @@ LIMIT 1
 
 func GetAddresses(userId string) (addresses []Address, err error) {
 	err = DB.Select(&addresses, `
-MATCH (u:User {id: {0}})
-MATCH (u)-[c:CONTROLS]->(addr:EmailAddress)-->(l:List)
+MATCH (owner:User)-[:CONTROLS]->(addr:EmailAddress)
+WHERE owner.id = {0}
+   OR (addr)<-[:HAS_ROLE]-(:User {id: {0}})
+   OR (addr)-[:TARGETS]->(:List)<-[:CONTAINS]-(:Board)-[:MEMBER]->(:User {id: {0}})
+`+roleOf("{0}")+`
+MATCH (owner)-[c:CONTROLS]->(addr)-->(l:List)
+WHERE role <> "none"
 OPTIONAL MATCH (addr)-[:SENDS_THROUGH]->(o) WHERE o.address <> addr.address
 RETURN
+  owner.id AS userId,
+  role,
   l.id AS listId,
   addr.date AS date,
   addr.address AS inboundaddr,
@@ -119,7 +178,6 @@ ORDER BY date
 
 	// post processing
 	for i := range addresses {
-		addresses[i].UserId = userId
 		addresses[i].PostProcess()
 	}
 
@@ -133,7 +191,13 @@ OPTIONAL MATCH ()<-[s:SENDS_THROUGH]-(addr)
 OPTIONAL MATCH (addr)-[h]-(card:Card)
 OPTIONAL MATCH (m:Mail)-[mr]-(card)
 OPTIONAL MATCH ()-[cmm:COMMENTED]->(m)
-DELETE s, t, addr, c, h, card, m, mr, cmm
+OPTIONAL MATCH (addr)-[ack:ACKNOWLEDGED]->()
+OPTIONAL MATCH (addr)-[n:NOTIFIES]->(e:Endpoint)
+OPTIONAL MATCH (e)-[a:ATTEMPTED]->(d:Delivery)
+OPTIONAL MATCH (addr)-[arc:ARCHIVED]->()
+OPTIONAL MATCH (addr)<-[al:ALIAS_OF]-(alias:Alias)
+OPTIONAL MATCH (addr)<-[grant:HAS_ROLE]-()
+DELETE s, t, addr, c, h, card, m, mr, cmm, ack, n, e, a, d, arc, al, alias, grant
     `, address.InboundAddr)
 	return
 }
@@ -279,6 +343,40 @@ MERGE (o)<-[:SENDS_THROUGH]-(e)
 func ChangeAddressSettings(userId, address string, p AddressSettings) error {
 	address = strings.ToLower(address)
 
+	// business hours, reminders, statuses and plus tags are stored as JSON, neo4j can't have maps as properties
+	var businessHours string
+	if len(p.BusinessHours) > 0 {
+		hours, err := json.Marshal(p.BusinessHours)
+		if err != nil {
+			return err
+		}
+		businessHours = string(hours)
+	}
+	var reminders string
+	if len(p.Reminders) > 0 {
+		r, err := json.Marshal(p.Reminders)
+		if err != nil {
+			return err
+		}
+		reminders = string(r)
+	}
+	var statuses string
+	if len(p.Statuses) > 0 {
+		st, err := json.Marshal(p.Statuses)
+		if err != nil {
+			return err
+		}
+		statuses = string(st)
+	}
+	var plusTags string
+	if len(p.PlusTags) > 0 {
+		pt, err := json.Marshal(p.PlusTags)
+		if err != nil {
+			return err
+		}
+		plusTags = string(pt)
+	}
+
 	var tmp string
 	err := DB.Get(&tmp, `
 MATCH (addr:EmailAddress {address: {1}})<-[:CONTROLS]-(user:User {id: {0}})
@@ -288,9 +386,28 @@ SET addr.addReplier = {4}
 SET addr.messageInDesc = {5}
 SET addr.signatureTemplate = {6}
 SET addr.moveToTop = {7}
+SET addr.threadingMode = {8}
+SET addr.reopenDays = {9}
+SET addr.firstResponseHours = {10}
+SET addr.nextResponseHours = {11}
+SET addr.timezone = {12}
+SET addr.businessHours = {13}
+SET addr.holidays = {14}
+SET addr.autoAck = {15}
+SET addr.autoAckTemplate = {16}
+SET addr.ticketTag = {17}
+SET addr.reminders = {18}
+SET addr.statuses = {19}
+SET addr.customerReplyList = {20}
+SET addr.agentReplyList = {21}
+SET addr.plusTags = {22}
+SET addr.reminderLevels = {23}
 RETURN user.id // just to fail when "no rows..."
     `, userId, address,
-		p.ReplyTo, p.SenderName, p.AddReplier, p.MessageInDesc, p.SignatureTemplate, p.MoveToTop)
+		p.ReplyTo, p.SenderName, p.AddReplier, p.MessageInDesc, p.SignatureTemplate, p.MoveToTop,
+		p.ThreadingMode, p.ReopenDays, p.FirstResponseHours, p.NextResponseHours,
+		p.TimeZone, businessHours, p.Holidays, p.AutoAck, p.AutoAckTemplate, p.TicketTag,
+		reminders, statuses, p.CustomerReplyList, p.AgentReplyList, plusTags, len(p.Reminders))
 	return err
 }
 
@@ -352,49 +469,69 @@ RETURN e.address ORDER BY e.date LIMIT 1
 	return
 }
 
-func GetCardForMessage(messageId, rawSubject, senderAddress, recipientAddress string) (string, error) {
+func GetCardForMessage(messageId, rawSubject, senderAddress, recipientAddress string) (shortLink string, previous string, err error) {
 	var queryResult struct {
 		ShortLink   string         `db:"cardShortLink"`
-		Address     string         `db:"address"`
 		LastMessage types.NullTime `db:"last"`
 		Expired     bool           `db:"expired"`
 	}
-	err := DB.Get(&queryResult, `
-MATCH (m:Mail) WHERE m.id = {0} OR
-                     ((m.subject = {1} OR m.subject = {2}) AND m.from = {3})
-MATCH (m)--(c:Card)--(addr:EmailAddress)
+	// a known ticket tag in the subject wins over everything else
+	tag, ticket := mailgun.ParseSubjectTag(rawSubject)
+
+	err = DB.Get(&queryResult, `
+MATCH (addr:EmailAddress {address: {4}})<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m:Mail)
+  // cards tied to other addresses are ignored
+  WHERE m.id = {0} OR
+        ((m.subject = {1} OR m.subject = {2}) AND m.from = {3}) OR
+        (c.ticket = {5} AND addr.ticketTag = {6} AND addr.ticketTag <> "")
 
 WITH addr, c, MAX(m.date) AS last
+ORDER BY CASE WHEN c.ticket = {5} AND addr.ticketTag = {6} AND addr.ticketTag <> "" THEN 0 ELSE 1 END, last DESC
 
 RETURN
  c.shortLink AS cardShortLink,
- addr.address AS address,
  last,
- (TIMESTAMP() - last > 1000*60*60*24*15) AS expired // expiration: 15 days
+ CASE
+   WHEN addr.reopenDays IS NOT NULL THEN TIMESTAMP() - last > 1000*60*60*24*addr.reopenDays
+   ELSE TIMESTAMP() - last > 1000*60*60*24*15 // default expiration: 15 days
+ END AS expired
 LIMIT 1
-    `, messageId, rawSubject, mailgun.TrimSubject(rawSubject), strings.ToLower(senderAddress))
+    `, messageId, rawSubject, mailgun.TrimSubject(rawSubject), strings.ToLower(senderAddress),
+		strings.ToLower(recipientAddress), ticket, tag)
 
 	if err != nil {
 		if err.Error() != "sql: no rows in result set" {
 			// a real error
-			return "", err
+			return "", "", err
 		} else {
 			// nothing found
-			return "", nil
+			return "", "", nil
 		}
 	}
 
-	// old messages are ignored so that we create a new card
+	// old messages are ignored so that we create a new card,
+	// but we still tell which was the card so it can be referenced.
 	if queryResult.Expired {
-		return "", nil
+		return "", queryResult.ShortLink, nil
 	}
 
-	// cards that are somehow tied to a different @boardthreads address are also ignored
-	if queryResult.Address != recipientAddress {
+	return queryResult.ShortLink, "", nil
+}
+
+// GetCardForReplyTag returns the card a signed reply address points to, or the card it
+// was merged into, if it is still on the address. there's no guessing as with messages.
+func GetCardForReplyTag(shortLink, recipientAddress string) (cardShortLink string, err error) {
+	err = DB.Get(&cardShortLink, `
+MATCH (c:Card {shortLink: {0}})
+OPTIONAL MATCH (target:Card) WHERE target.shortLink = c.mergedInto
+WITH CASE WHEN target IS NOT NULL THEN target ELSE c END AS card
+MATCH (card)-[:LINKED_TO]->(:EmailAddress {address: {1}})
+RETURN card.shortLink
+    `, shortLink, strings.ToLower(recipientAddress))
+	if err != nil && err.Error() == "sql: no rows in result set" {
 		return "", nil
 	}
-
-	return queryResult.ShortLink, nil
+	return
 }
 
 func ListAddressesOnDomain(domainName string) (domains []string, err error) {
@@ -416,14 +553,14 @@ RETURN LOWER(e.address)
 func LastMessagesForUser(userId string, quantity int) (messages []Email, err error) {
 	messages = make([]Email, 0)
 	err = DB.Select(&messages, `
-MATCH (u:User {id: {0}})--(e:EmailAddress)--(c:Card)--(m:Mail)
+MATCH (u:User {id: {0}})--(e:EmailAddress)--(c:Card)-[r:CONTAINS]->(m:Mail)
 RETURN
   e.address AS address,
   c.shortLink AS cardShortLink,
   CASE WHEN m.id IS NOT NULL THEN m.id ELSE "" END AS id,
   CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
   CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE "" END AS subject,
-  CASE WHEN m.commentId IS NOT NULL THEN m.commentId ELSE "" END AS commentId,
+  CASE WHEN r.commentId IS NOT NULL THEN r.commentId WHEN m.commentId IS NOT NULL THEN m.commentId ELSE "" END AS commentId,
   m.date AS date
 ORDER BY m.date DESC LIMIT {1}
     `, userId, quantity)
@@ -462,6 +599,22 @@ SET c.webhookId = {3}
 	return
 }
 
+func AssignTicketNumber(cardShortLink string) (ticket int, err error) {
+	// setting the lock property first makes neo4j lock the address node
+	// before the counter is read, so no two cards get the same number.
+	err = DB.Get(&ticket, `
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+MATCH (c)-[:LINKED_TO]->(addr:EmailAddress)
+SET addr._lock = true
+WITH c, addr, CASE WHEN addr.lastTicket IS NOT NULL THEN addr.lastTicket ELSE 0 END AS last
+SET addr.lastTicket = CASE WHEN c.ticket IS NULL THEN last + 1 ELSE last END
+SET c.ticket = CASE WHEN c.ticket IS NULL THEN last + 1 ELSE c.ticket END
+REMOVE addr._lock
+RETURN c.ticket
+    `, cardShortLink)
+	return
+}
+
 func RemoveCard(id string) (err error) {
 	_, err = DB.Exec(`
 MATCH (:EmailAddress)-[l]-(c:Card) WHERE c.shortLink = {0} OR c.id = {0}
@@ -479,13 +632,15 @@ DELETE c, rl, ru, l, unlinked, cr
 
 func GetEmailFromCommentId(commentId string) (email Email, err error) {
 	err = DB.Get(&email, `
-MATCH (m:Mail {commentId: {0}})
+MATCH (:Card)-[r:CONTAINS]->(m:Mail)
+WHERE r.commentId = {0} OR m.commentId = {0}
 RETURN
   m.id AS id,
   m.date AS date,
   CASE WHEN m.subject THEN m.subject ELSE '' END AS subject,
   CASE WHEN m.from THEN LOWER(m.from) ELSE '' END AS from,
-  m.commentId AS commentId
+  {0} AS commentId
+LIMIT 1
     `, commentId)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
@@ -502,12 +657,36 @@ func GetReceivingParams(address string) (params receivingParams, err error) {
 MATCH (addr:EmailAddress {address: {0}})
 RETURN
   CASE WHEN addr.messageInDesc IS NOT NULL THEN addr.messageInDesc ELSE false END AS messageInDesc,
-  CASE WHEN addr.moveToTop IS NOT NULL THEN addr.moveToTop ELSE false END AS moveToTop
+  CASE WHEN addr.moveToTop IS NOT NULL THEN addr.moveToTop ELSE false END AS moveToTop,
+  CASE WHEN addr.threadingMode IS NOT NULL THEN addr.threadingMode ELSE "reopen" END AS threadingMode,
+  CASE WHEN addr.autoAck IS NOT NULL THEN addr.autoAck ELSE false END AS autoAck,
+  CASE WHEN addr.autoAckTemplate IS NOT NULL THEN addr.autoAckTemplate ELSE "" END AS autoAckTemplate,
+  CASE WHEN addr.firstResponseHours IS NOT NULL THEN addr.firstResponseHours ELSE 0 END AS firstResponseHours,
+  CASE WHEN addr.customerReplyList IS NOT NULL THEN addr.customerReplyList ELSE "" END AS customerReplyList,
+  CASE WHEN addr.plusTags IS NOT NULL THEN addr.plusTags ELSE "" END AS plusTags
 LIMIT 1
     `, address)
 	return
 }
 
+func ClaimAutoAck(address, recipient string, interval time.Duration) (claimed bool, err error) {
+	// the MERGE locks the relationship, so concurrent messages from the same
+	// sender will not both get an acknowledgement.
+	err = DB.Get(&claimed, `
+MATCH (addr:EmailAddress {address: {0}})
+MERGE (s:Sender {address: {1}})
+MERGE (addr)-[ack:ACKNOWLEDGED]->(s)
+  ON CREATE SET ack.date = 0
+WITH ack, ack.date < TIMESTAMP() - {2} AS claimed
+SET ack.date = CASE WHEN claimed THEN TIMESTAMP() ELSE ack.date END
+RETURN claimed
+    `, strings.ToLower(address), strings.ToLower(recipient), int64(interval/time.Millisecond))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	}
+	return
+}
+
 func GetEmailParamsForCard(shortLink string) (params sendingParams, err error) {
 	err = DB.Get(&params, `
 MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
@@ -519,7 +698,11 @@ WITH
   c, outbound, addr,
   reduce(lastMail = {}, m IN collect(m) | CASE WHEN lastMail.date > m.date THEN lastMail ELSE m END) AS lastMail,
   filter(r IN collect(DISTINCT LOWER(m.from)) WHERE r <> "") AS recipients
-        
+
+// the alias the thread arrived on, or else the primary one, unless it arrived on the address
+OPTIONAL MATCH (addr)<-[:ALIAS_OF]-(arrived:Alias) WHERE arrived.address = c.arrivedOn
+OPTIONAL MATCH (addr)<-[:ALIAS_OF]-(primary:Alias) WHERE primary.address = addr.primaryAlias
+
 RETURN
   lastMail.id AS lastMailId,
   lastMail.subject AS lastMailSubject,
@@ -529,8 +712,33 @@ RETURN
   CASE WHEN addr.senderName IS NOT NULL THEN addr.senderName ELSE "" END AS senderName,
   CASE WHEN addr.addReplier IS NOT NULL THEN addr.addReplier ELSE false END AS addReplier,
   CASE WHEN addr.signatureTemplate IS NOT NULL THEN addr.signatureTemplate ELSE "" END AS signatureTemplate,
+  CASE WHEN c.ticket IS NOT NULL THEN c.ticket ELSE 0 END AS ticket,
+  CASE WHEN addr.ticketTag IS NOT NULL THEN addr.ticketTag ELSE "" END AS ticketTag,
+  CASE WHEN addr.agentReplyList IS NOT NULL THEN addr.agentReplyList ELSE "" END AS agentReplyList,
+  CASE
+    WHEN arrived IS NOT NULL THEN arrived.address
+    WHEN c.arrivedOn = addr.address THEN ""
+    WHEN primary IS NOT NULL THEN primary.address
+    ELSE ""
+  END AS sendAs,
+  CASE WHEN c.plusTag IS NOT NULL THEN c.plusTag ELSE "" END AS plusTag,
   recipients
 LIMIT 1`, shortLink)
+	if err != nil {
+		return
+	}
+
+	// a customer may have written to more than one of our addresses
+	params.Recipients, err = ExternalAddresses(shortLink, params.Recipients)
+	return
+}
+
+func GetAddressForCard(cardId string) (address string, err error) {
+	err = DB.Get(&address, `
+MATCH (c:Card)-[:LINKED_TO]->(addr:EmailAddress) WHERE c.shortLink = {0} OR c.id = {0}
+RETURN addr.address
+LIMIT 1
+    `, cardId)
 	return
 }
 
@@ -541,11 +749,12 @@ MERGE (m:Mail {id: {1}})
   ON CREATE SET
     m.subject = {2},
     m.from = {3},
-    m.commentId = {4},
     m.date = TIMESTAMP()
   ON MATCH SET
     m.from = {3}
-MERGE (c)-[:CONTAINS]->(m)
+// the same mail can be on more than one card, each with its own comment
+MERGE (c)-[r:CONTAINS]->(m)
+  ON CREATE SET r.commentId = {4}
 
 WITH c
   SET c.id = {5}
@@ -576,10 +785,9 @@ MERGE (m:Mail {id: {2}})
   ON CREATE SET m.date = TIMESTAMP()
 
 WITH m, commenter, card, b
-SET m.commentId = {3}
-
 MERGE (b)-[:MEMBER]->(commenter)
-MERGE (card)-[:CONTAINS]->(m)
+MERGE (card)-[r:CONTAINS]->(m)
+SET r.commentId = {3}
 MERGE (commenter)-[:COMMENTED]->(m)
     `, cardShortLink, commenterId, messageId, commentId)
 	return
@@ -603,3 +811,333 @@ SET c.paypalProfileId = null
 `, address)
 	return
 }
+
+func ListCardsForAddress(address string) (cards []string, err error) {
+	err = DB.Select(&cards, `
+MATCH (c:Card)-[:LINKED_TO]->(:EmailAddress {address: {0}})
+RETURN c.shortLink
+    `, strings.ToLower(address))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return cards, nil
+		} else {
+			return nil, err
+		}
+	}
+	return cards, nil
+}
+
+func GetSLAParamsForCard(shortLink string) (params slaParams, err error) {
+	err = DB.Get(&params, `
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+MATCH (c)-[:LINKED_TO]->(addr:EmailAddress)
+RETURN
+  addr.address AS address,
+  CASE WHEN addr.firstResponseHours IS NOT NULL THEN addr.firstResponseHours ELSE 0 END AS firstResponseHours,
+  CASE WHEN addr.nextResponseHours IS NOT NULL THEN addr.nextResponseHours ELSE 0 END AS nextResponseHours
+LIMIT 1
+    `, shortLink)
+	return
+}
+
+func GetCalendarForAddress(address string) (*calendar.Calendar, error) {
+	var params calendarParams
+	err := DB.Get(&params, `
+MATCH (addr:EmailAddress {address: {0}})
+RETURN
+  CASE WHEN addr.timezone IS NOT NULL THEN addr.timezone ELSE "" END AS timezone,
+  CASE WHEN addr.businessHours IS NOT NULL THEN addr.businessHours ELSE "" END AS businessHours,
+  CASE WHEN addr.holidays IS NOT NULL THEN addr.holidays ELSE [] END AS holidays
+LIMIT 1
+    `, strings.ToLower(address))
+	if err != nil {
+		return nil, err
+	}
+	return params.Calendar()
+}
+
+func GetThreadMessages(shortLink string) (messages []ThreadMessage, err error) {
+	messages = make([]ThreadMessage, 0)
+	err = DB.Select(&messages, `
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+MATCH (c)-[:CONTAINS]->(m:Mail) WHERE NOT m.id =~ "fake-.*" // fake mails are not real messages
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+
+WITH DISTINCT m, CASE WHEN cm IS NULL THEN true ELSE false END AS inbound
+RETURN
+  m.id AS id,
+  m.date AS date,
+  inbound
+ORDER BY m.date
+    `, shortLink)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return messages, nil
+		} else {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// GetReportMessages returns every message of the threads of the address that had some
+// activity between from and to (unix milliseconds), including the messages outside of it.
+func GetReportMessages(userId, address string, from, to int64) ([]reports.Message, error) {
+	rows := make([]reportMessage, 0)
+	err := DB.Select(&rows, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (c:Card)-[:LINKED_TO]->(addr)
+MATCH (c)-[:CONTAINS]->(m:Mail) WHERE NOT m.id =~ "fake-.*"
+WITH c, collect(m) AS mails
+WHERE any(m IN mails WHERE m.date >= {2} AND m.date < {3})
+UNWIND mails AS m
+OPTIONAL MATCH (m)<-[:COMMENTED]-(u:User)
+RETURN
+  c.shortLink AS thread,
+  m.date AS date,
+  CASE WHEN u IS NULL THEN true ELSE false END AS inbound,
+  CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
+  CASE WHEN u IS NOT NULL THEN u.id ELSE "" END AS member
+    `, userId, strings.ToLower(address), from, to)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+
+	messages := make([]reports.Message, len(rows))
+	for i, row := range rows {
+		messages[i] = reports.Message{
+			Thread:  row.Thread,
+			Date:    time.Unix(row.Date/1000, (row.Date%1000)*int64(time.Millisecond)),
+			Inbound: row.Inbound,
+			From:    row.From,
+			Member:  row.Member,
+		}
+	}
+	return messages, nil
+}
+
+func ListThreadsAwaitingReply() (threads []AwaitingThread, err error) {
+	threads = make([]AwaitingThread, 0)
+	err = DB.Select(&threads, `
+MATCH (addr:EmailAddress)<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m:Mail)
+  WHERE addr.reminders IS NOT NULL AND addr.reminders <> "" AND NOT m.id =~ "fake-.*"
+    AND (c.status IS NULL OR c.status <> "closed")
+WITH addr, c, m ORDER BY m.date DESC
+WITH addr, c, HEAD(COLLECT(m)) AS last
+WITH addr, c, last, CASE WHEN c.reminderMail = last.id THEN c.reminderLevel ELSE 0 END AS level
+  WHERE NOT (last)<-[:COMMENTED]-(:User) // the last message is from the customer
+    // past the largest reminder there is nothing left to do until the next mail
+    AND (addr.reminderLevels IS NULL OR level < addr.reminderLevels)
+RETURN
+  c.shortLink AS cardShortLink,
+  c.id AS cardId,
+  addr.address AS address,
+  addr.reminders AS reminders,
+  last.id AS mailId,
+  last.date AS mailDate,
+  level
+    `)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return threads, nil
+		} else {
+			return nil, err
+		}
+	}
+	return threads, nil
+}
+
+func ClaimReminders(cardShortLink, mailId string, fromLevel, toLevel int) (claimed bool, err error) {
+	// locking the card first so only one instance can move it from one level to the other.
+	err = DB.Get(&claimed, `
+MATCH (c:Card {shortLink: {0}})
+SET c._lock = true
+WITH c, CASE WHEN c.reminderMail = {1} THEN c.reminderLevel ELSE 0 END AS level
+SET c.reminderMail = CASE WHEN level = {2} THEN {1} ELSE c.reminderMail END
+SET c.reminderLevel = CASE WHEN level = {2} THEN {3} ELSE c.reminderLevel END
+REMOVE c._lock
+RETURN level = {2}
+    `, cardShortLink, mailId, fromLevel, toLevel)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	}
+	return
+}
+
+func SetThreadStatus(cardShortLink string, status ThreadStatus) (change statusChange, err error) {
+	err = DB.Get(&change, `
+MATCH (c:Card)-[:LINKED_TO]->(addr:EmailAddress) WHERE c.shortLink = {0} OR c.id = {0}
+WITH c, addr, CASE WHEN c.status IS NOT NULL THEN c.status ELSE "" END AS previous
+// a thread is still new until we reply to it
+WITH c, addr, previous, CASE WHEN previous = "new" AND {1} = "waiting-on-us" THEN "new" ELSE {1} END AS current
+SET c.statusSince = CASE WHEN previous = current THEN c.statusSince ELSE TIMESTAMP() END
+SET c.status = current
+RETURN
+  previous,
+  current,
+  CASE WHEN addr.statuses IS NOT NULL THEN addr.statuses ELSE "" END AS statuses
+LIMIT 1
+    `, cardShortLink, status)
+	return
+}
+
+func GetStatusForList(cardShortLink, listId string) (status ThreadStatus, err error) {
+	var change statusChange
+	err = DB.Get(&change, `
+MATCH (c:Card)-[:LINKED_TO]->(addr:EmailAddress) WHERE c.shortLink = {0} OR c.id = {0}
+RETURN CASE WHEN addr.statuses IS NOT NULL THEN addr.statuses ELSE "" END AS statuses
+LIMIT 1
+    `, cardShortLink)
+	if err != nil {
+		return "", err
+	}
+	placements, err := change.Placements()
+	if err != nil {
+		return "", err
+	}
+	for s, placement := range placements {
+		if placement.ListId == listId {
+			return s, nil
+		}
+	}
+	return "", nil
+}
+
+func GetStatusForCard(userId, shortLink string) (*ThreadState, error) {
+	state := ThreadState{}
+	err := DB.Get(&state, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)<-[:LINKED_TO]-(c:Card)
+  WHERE c.shortLink = {1} OR c.id = {1}
+RETURN
+  c.shortLink AS cardShortLink,
+  addr.address AS address,
+  CASE WHEN c.ticket IS NOT NULL THEN c.ticket ELSE 0 END AS ticket,
+  CASE WHEN c.status IS NOT NULL THEN c.status ELSE "" END AS status,
+  CASE WHEN c.statusSince IS NOT NULL THEN c.statusSince ELSE 0 END AS since
+LIMIT 1
+    `, userId, shortLink)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func GetStatusesForAddress(userId, address string, status ThreadStatus) (states []ThreadState, err error) {
+	states = make([]ThreadState, 0)
+	err = DB.Select(&states, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})<-[:LINKED_TO]-(c:Card)
+  WHERE c.status IS NOT NULL AND ({2} = "" OR c.status = {2})
+RETURN
+  c.shortLink AS cardShortLink,
+  addr.address AS address,
+  CASE WHEN c.ticket IS NOT NULL THEN c.ticket ELSE 0 END AS ticket,
+  c.status AS status,
+  c.statusSince AS since
+ORDER BY c.statusSince
+    `, userId, strings.ToLower(address), status)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return states, nil
+		} else {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+func SaveSLATimer(shortLink, kind string, waitingSince, due int64) (err error) {
+	if kind == "" {
+		_, err = DB.Exec(`
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+REMOVE c.slaKind, c.slaWaitingSince, c.slaDue, c.slaBreachedAt
+        `, shortLink)
+		return
+	}
+
+	_, err = DB.Exec(`
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+SET c.slaBreachedAt = CASE WHEN c.slaDue = {3} THEN c.slaBreachedAt ELSE null END // a new timer
+SET c.slaKind = {1}
+SET c.slaWaitingSince = {2}
+SET c.slaDue = {3}
+    `, shortLink, kind, waitingSince, due)
+	return
+}
+
+func ClaimBreachedSLAs() (breached []ThreadSLA, err error) {
+	breached = make([]ThreadSLA, 0)
+	err = DB.Select(&breached, `
+MATCH (c:Card)-[:LINKED_TO]->(addr:EmailAddress)
+  WHERE c.slaDue IS NOT NULL AND c.slaDue < TIMESTAMP() AND c.slaBreachedAt IS NULL
+SET c.slaBreachedAt = TIMESTAMP()
+RETURN
+  c.shortLink AS cardShortLink,
+  c.id AS cardId,
+  addr.address AS address,
+  c.slaKind AS kind,
+  c.slaWaitingSince AS waitingSince,
+  c.slaDue AS due,
+  c.slaBreachedAt AS breachedAt
+    `)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return breached, nil
+		} else {
+			return nil, err
+		}
+	}
+	for i := range breached {
+		breached[i].PostProcess()
+	}
+	return breached, nil
+}
+
+func GetSLAForCard(userId, shortLink string) (*ThreadSLA, error) {
+	state := ThreadSLA{}
+	err := DB.Get(&state, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)<-[:LINKED_TO]-(c:Card)
+  WHERE c.shortLink = {1} OR c.id = {1}
+RETURN
+  c.shortLink AS cardShortLink,
+  c.id AS cardId,
+  addr.address AS address,
+  CASE WHEN c.slaKind IS NOT NULL THEN c.slaKind ELSE "" END AS kind,
+  CASE WHEN c.slaWaitingSince IS NOT NULL THEN c.slaWaitingSince ELSE 0 END AS waitingSince,
+  CASE WHEN c.slaDue IS NOT NULL THEN c.slaDue ELSE 0 END AS due,
+  CASE WHEN c.slaBreachedAt IS NOT NULL THEN c.slaBreachedAt ELSE 0 END AS breachedAt
+LIMIT 1
+    `, userId, shortLink)
+	if err != nil {
+		return nil, err
+	}
+	state.PostProcess()
+	return &state, nil
+}
+
+func GetSLAsForAddress(userId, address string) (states []ThreadSLA, err error) {
+	states = make([]ThreadSLA, 0)
+	err = DB.Select(&states, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})<-[:LINKED_TO]-(c:Card)
+  WHERE c.slaDue IS NOT NULL
+RETURN
+  c.shortLink AS cardShortLink,
+  c.id AS cardId,
+  addr.address AS address,
+  c.slaKind AS kind,
+  c.slaWaitingSince AS waitingSince,
+  c.slaDue AS due,
+  CASE WHEN c.slaBreachedAt IS NOT NULL THEN c.slaBreachedAt ELSE 0 END AS breachedAt
+ORDER BY c.slaDue
+    `, userId, strings.ToLower(address))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return states, nil
+		} else {
+			return nil, err
+		}
+	}
+	for i := range states {
+		states[i].PostProcess()
+	}
+	return states, nil
+}
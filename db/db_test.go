@@ -1,7 +1,9 @@
 package db
 
 import (
+	"bt/calendar"
 	"testing"
+	"time"
 
 	. "github.com/franela/goblin"
 	. "github.com/onsi/gomega"
@@ -34,6 +36,18 @@ DELETE n,r
 			Expect(EnsureUser("u47284")).To(Equal(false))
 		})
 
+		g.It("should not have users opted out of analytics by default", func() {
+			Expect(AnalyticsOptedOut("u47284")).To(Equal(false))
+			Expect(AnalyticsOptedOut("u00000")).To(Equal(false))
+		})
+
+		g.It("should opt users out of analytics and back in", func() {
+			Expect(SetAnalyticsOptOut("u47284", true)).To(Succeed())
+			Expect(AnalyticsOptedOut("u47284")).To(Equal(true))
+			Expect(SetAnalyticsOptOut("u47284", false)).To(Succeed())
+			Expect(AnalyticsOptedOut("u47284")).To(Equal(false))
+		})
+
 		g.It("should not get an unexistent address", func() {
 			address, err := GetAddress("u3298", "l23213")
 			Expect(err).To(BeNil())
@@ -52,7 +66,7 @@ DELETE n,r
 			Expect(addr.ListId).To(Equal("l43834"))
 			Expect(addr.InboundAddr).To(Equal("maria@boardthreads.com"))
 			Expect(addr.OutboundAddr).To(Equal("maria@boardthreads.com"))
-			addr.Settings.ReplyTo = "" // GetAddress returns this, GetAddresses don't
+			addr.Settings = AddressSettings{} // GetAddress returns the settings, GetAddresses don't
 			Expect(GetAddresses("maria")).To(BeEquivalentTo([]Address{*addr}))
 		})
 
@@ -66,7 +80,7 @@ DELETE n,r
 			Expect(addr.ListId).To(Equal("l49983"))
 			Expect(addr.InboundAddr).To(Equal("maria@boardthreads.com"))
 			Expect(addr.OutboundAddr).To(Equal("maria@boardthreads.com"))
-			addr.Settings.ReplyTo = "" // GetAddress returns this, GetAddresses don't
+			addr.Settings = AddressSettings{} // GetAddress returns the settings, GetAddresses don't
 			Expect(GetAddresses("maria")).To(BeEquivalentTo([]Address{*addr}))
 		})
 
@@ -83,8 +97,8 @@ DELETE n,r
 			Expect(addr.InboundAddr).To(Equal("maria@boardthreads.com"))
 			Expect(addr.OutboundAddr).To(Equal("help@maria.com"))
 			Expect(addr.DomainName).To(Equal("maria.com"))
-			addr.DomainName = ""       // GetAddress returns this, GetAddresses don't
-			addr.Settings.ReplyTo = "" // GetAddress returns this, GetAddresses don't
+			addr.DomainName = ""              // GetAddress returns this, GetAddresses don't
+			addr.Settings = AddressSettings{} // GetAddress returns the settings, GetAddresses don't
 			Expect(GetAddresses("maria")).To(BeEquivalentTo([]Address{*addr}))
 		})
 
@@ -191,6 +205,75 @@ DELETE n,r
 				Expect(ok).To(Equal(true))
 			})
 
+			g.It("should find the card for a reply", func() {
+				shortLink, previous, err := GetCardForMessage("<mid3739>", "Re: this message", "from@someone.com", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal("csl3739"))
+				Expect(previous).To(Equal(""))
+
+				// same message, different address
+				shortLink, previous, err = GetCardForMessage("<mid3739>", "Re: this message", "from@someone.com", "maria@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal(""))
+				Expect(previous).To(Equal(""))
+			})
+
+			g.It("should still find open cards for replies when the address never reopens", func() {
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: NEW_CARD,
+					ReopenDays:    15,
+				})).To(Succeed())
+
+				shortLink, previous, err := GetCardForMessage("<mid3739>", "Re: this message", "from@someone.com", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal("csl3739"))
+				Expect(previous).To(Equal(""))
+			})
+
+			g.It("should not reopen expired cards when the address says so", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl3740", "cid3740", "7676740")).To(Succeed())
+				Expect(SaveEmailReceived("cid3740", "csl3740", "<mid3740>", "old question", "from@someone.com", "comm3740")).To(Succeed())
+				_, err := DB.Exec(`MATCH (m:Mail {id: "<mid3740>"}) SET m.date = m.date - 1000*60*60*24*30`)
+				Expect(err).ToNot(HaveOccurred())
+
+				shortLink, previous, err := GetCardForMessage("<mid3740>", "Re: old question", "from@someone.com", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal(""))
+				Expect(previous).To(Equal("csl3740"))
+				Expect(RemoveCard("csl3740")).To(Succeed())
+
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: REOPEN,
+					ReopenDays:    90,
+				})).To(Succeed())
+
+				shortLink, previous, err = GetCardForMessage("<mid3739>", "Re: this message", "from@someone.com", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal("csl3739"))
+				Expect(previous).To(Equal(""))
+			})
+
+			g.It("should give the card a ticket number only once", func() {
+				Expect(AssignTicketNumber("csl3739")).To(Equal(1))
+				Expect(AssignTicketNumber("cid3739")).To(Equal(1))
+			})
+
+			g.It("should find the card by its ticket tag", func() {
+				// without a tag on the address, tickets don't mean anything
+				Expect(GetCardForMessage("<unknown>", "Re: [#1] my new question", "other@someone.com", "bob@boardthreads.com")).To(Equal(""))
+
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: REOPEN,
+					ReopenDays:    90,
+					TicketTag:     "Bob",
+				})).To(Succeed())
+
+				// broken headers, different subject and sender
+				Expect(GetCardForMessage("<unknown>", "Re: [Bob #1] my new question", "other@someone.com", "bob@boardthreads.com")).To(Equal("csl3739"))
+				Expect(GetCardForMessage("<unknown>", "Re: [Bob #2] my new question", "other@someone.com", "bob@boardthreads.com")).To(Equal(""))
+				Expect(GetCardForMessage("<unknown>", "Re: [Alice #1] my new question", "other@someone.com", "bob@boardthreads.com")).To(Equal(""))
+			})
+
 			g.It("should send a fake email from a fake comment", func() {
 				Expect(GetEmailParamsForCard("csl3739")).To(BeEquivalentTo(sendingParams{
 					LastMailId:      "<mid3739>",
@@ -200,11 +283,654 @@ DELETE n,r
 					Recipients:      []string{"from@someone.com"},
 					ReplyTo:         "bob@boardthreads.com",
 					AddReplier:      false,
+					Ticket:          1,
+					TicketTag:       "Bob",
 				}))
 
 				Expect(SaveCommentSent("csl3739", "bob", "<repl3739>", "32423432")).To(Succeed())
 			})
 
+			g.It("should list the messages in the thread", func() {
+				messages, err := GetThreadMessages("csl3739")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(messages).To(HaveLen(2))
+				Expect(messages[0].Id).To(Equal("<mid3739>"))
+				Expect(messages[0].Inbound).To(Equal(true))
+				Expect(messages[1].Id).To(Equal("<repl3739>"))
+				Expect(messages[1].Inbound).To(Equal(false))
+			})
+
+			g.It("should claim a breached sla timer only once", func() {
+				Expect(SaveSLATimer("csl3739", "first-response", 1000, 2000)).To(Succeed())
+
+				breached, err := ClaimBreachedSLAs()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(breached).To(HaveLen(1))
+				Expect(breached[0].CardShortLink).To(Equal("csl3739"))
+				Expect(breached[0].Address).To(Equal("bob@boardthreads.com"))
+				Expect(breached[0].Breached).To(Equal(true))
+				Expect(ClaimBreachedSLAs()).To(HaveLen(0))
+
+				Expect(SaveSLATimer("csl3739", "", 0, 0)).To(Succeed())
+				state, err := GetSLAForCard("bob", "csl3739")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Kind).To(Equal(""))
+				Expect(state.Breached).To(Equal(false))
+			})
+
+			g.It("should remind about threads awaiting reply only once", func() {
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: REOPEN,
+					ReopenDays:    90,
+					TicketTag:     "Bob",
+					Reminders:     []Reminder{{Hours: 48, Action: OVERDUE}, {Hours: 24, Action: MENTION}},
+				})).To(Succeed())
+
+				// the last message is our reply
+				Expect(ListThreadsAwaitingReply()).To(HaveLen(0))
+
+				Expect(SaveEmailReceived("cid3739", "csl3739", "<mid3740>", "this message", "from@someone.com", "comm38755")).To(Succeed())
+				threads, err := ListThreadsAwaitingReply()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(threads).To(HaveLen(1))
+				Expect(threads[0].CardShortLink).To(Equal("csl3739"))
+				Expect(threads[0].MailId).To(Equal("<mid3740>"))
+				Expect(threads[0].Level).To(Equal(0))
+				Expect(threads[0].Reminders()).To(BeEquivalentTo([]Reminder{{Hours: 24, Action: MENTION}, {Hours: 48, Action: OVERDUE}}))
+
+				Expect(ClaimReminders("csl3739", "<mid3740>", 0, 1)).To(Equal(true))
+				Expect(ClaimReminders("csl3739", "<mid3740>", 0, 1)).To(Equal(false))
+				threads, _ = ListThreadsAwaitingReply()
+				Expect(threads[0].Level).To(Equal(1))
+
+				// past the largest reminder there's nothing left to do
+				Expect(ClaimReminders("csl3739", "<mid3740>", 1, 2)).To(Equal(true))
+				Expect(ListThreadsAwaitingReply()).To(HaveLen(0))
+
+				// a new message starts again
+				Expect(ClaimReminders("csl3739", "<mid3741>", 0, 2)).To(Equal(true))
+				Expect(ListThreadsAwaitingReply()).To(HaveLen(1))
+
+				// closed threads are never reminded about
+				_, err = SetThreadStatus("csl3739", CLOSED)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ListThreadsAwaitingReply()).To(HaveLen(0))
+				_, err = SetThreadStatus("csl3739", "")
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			g.It("should keep the thread status", func() {
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: REOPEN,
+					ReopenDays:    90,
+					Statuses: map[ThreadStatus]StatusPlacement{
+						WAITING_ON_CUSTOMER: {Label: "Waiting", ListId: "l329848"},
+					},
+				})).To(Succeed())
+
+				change, err := SetThreadStatus("csl3739", NEW)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(change.Previous).To(BeEquivalentTo(""))
+				Expect(change.Current).To(Equal(NEW))
+
+				// still new, we haven't replied
+				change, _ = SetThreadStatus("cid3739", WAITING_ON_US)
+				Expect(change.Current).To(Equal(NEW))
+
+				change, _ = SetThreadStatus("csl3739", WAITING_ON_CUSTOMER)
+				Expect(change.Previous).To(Equal(NEW))
+				Expect(change.Current).To(Equal(WAITING_ON_CUSTOMER))
+				Expect(change.Placements()).To(HaveKeyWithValue(WAITING_ON_CUSTOMER, StatusPlacement{"Waiting", "l329848"}))
+
+				state, err := GetStatusForCard("bob", "csl3739")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Status).To(Equal(WAITING_ON_CUSTOMER))
+				Expect(state.Ticket).To(Equal(1))
+				_, err = GetStatusForCard("maria", "csl3739") // not maria's card
+				Expect(err).To(HaveOccurred())
+
+				Expect(GetStatusesForAddress("bob", "bob@boardthreads.com", "")).To(HaveLen(1))
+				Expect(GetStatusesForAddress("bob", "bob@boardthreads.com", WAITING_ON_CUSTOMER)).To(HaveLen(1))
+				Expect(GetStatusesForAddress("bob", "bob@boardthreads.com", CLOSED)).To(HaveLen(0))
+
+				Expect(GetStatusForList("csl3739", "l329848")).To(Equal(WAITING_ON_CUSTOMER))
+				Expect(GetStatusForList("csl3739", "l329847")).To(BeEquivalentTo(""))
+			})
+
+			g.It("should acknowledge a sender only once in a while", func() {
+				Expect(ClaimAutoAck("bob@boardthreads.com", "from@someone.com", time.Hour)).To(Equal(true))
+				Expect(ClaimAutoAck("bob@boardthreads.com", "FROM@someone.com", time.Hour)).To(Equal(false))
+				Expect(ClaimAutoAck("bob@boardthreads.com", "other@someone.com", time.Hour)).To(Equal(true))
+				Expect(ClaimAutoAck("bob@boardthreads.com", "from@someone.com", 0)).To(Equal(true))
+			})
+
+			g.It("should archive and search mails", func() {
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid3739>", "mails/ab/abc", "this message from@someone.com where is my order?", "From@someone.com", "this message")).To(Succeed())
+
+				Expect(GetArchivedMail("bob", "<mid3739>")).To(Equal("mails/ab/abc"))
+				_, err := GetArchivedMail("maria", "<mid3739>")
+				Expect(err).To(HaveOccurred())
+
+				results, err := SearchMails("bob", SearchParams{Terms: []string{"order", "where"}, Limit: 10})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(results).To(HaveLen(1))
+				Expect(results[0].Id).To(Equal("<mid3739>"))
+				Expect(results[0].Address).To(Equal("bob@boardthreads.com"))
+				Expect(results[0].CardShortLink).To(Equal("csl3739"))
+				Expect(results[0].Sender).To(Equal("from@someone.com"))
+				Expect(results[0].Inbound).To(Equal(true))
+
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"order", "refund"}, Limit: 10})).To(HaveLen(0))
+				Expect(SearchMails("bob", SearchParams{Terms: []string{}, Sender: "SOMEONE", Limit: 10})).To(HaveLen(1))
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"order"}, Address: "maria@boardthreads.com", Limit: 10})).To(HaveLen(0))
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"order"}, Until: 1000, Limit: 10})).To(HaveLen(0))
+				Expect(SearchMails("maria", SearchParams{Terms: []string{"order"}, Limit: 10})).To(HaveLen(0))
+
+				Expect(ListArchivedBodies("bob@boardthreads.com")).To(Equal([]string{"mails/ab/abc"}))
+
+				// someone else sending a mail with the same message id
+				Expect(IsArchived("bob@boardthreads.com", "<mid3739>")).To(Equal(true))
+				Expect(IsArchived("maria@boardthreads.com", "<mid3739>")).To(Equal(false))
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid3739>", "mails/ev/il", "spoofed", "evil@else.com", "spoofed")).To(Succeed())
+				Expect(ArchiveMail("maria@boardthreads.com", "<mid3739>", "mails/ma/ria", "spoofed", "evil@else.com", "spoofed")).To(Succeed())
+				Expect(GetArchivedMail("bob", "<mid3739>")).To(Equal("mails/ab/abc"))
+				Expect(GetArchivedMail("maria", "<mid3739>")).To(Equal("mails/ma/ria"))
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"spoofed"}, Limit: 10})).To(HaveLen(0))
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"order"}, Limit: 10})).To(HaveLen(1))
+				_, err = DB.Exec(`MATCH (:EmailAddress {address: "maria@boardthreads.com"})-[a:ARCHIVED]->(:Mail {id: "<mid3739>"}) DELETE a`)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			g.It("should fetch the messages of a card for exporting", func() {
+				mails, err := GetExportMails("bob", "csl3739")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails).ToNot(BeEmpty())
+				Expect(mails[0].CardId).To(Equal("cid3739"))
+				Expect(mails[0].Outbound).To(Equal("bob@boardthreads.com"))
+
+				var archived *ExportMail
+				for i := range mails {
+					if mails[i].Id == "<mid3739>" {
+						archived = &mails[i]
+					}
+				}
+				Expect(archived).ToNot(BeNil())
+				Expect(archived.Body).To(Equal("mails/ab/abc"))
+				Expect(archived.Inbound).To(Equal(true))
+
+				Expect(GetExportMails("bob", "cid3739")).To(HaveLen(len(mails)))
+				Expect(GetExportMails("maria", "csl3739")).To(BeEmpty())
+			})
+
+			g.It("should fetch the messages for reports", func() {
+				now := time.Now().UnixNano() / int64(time.Millisecond)
+				messages, err := GetReportMessages("bob", "bob@boardthreads.com", now-60*60*1000, now+60*60*1000)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(messages).ToNot(BeEmpty())
+				Expect(messages[0].Thread).To(Equal("csl3739"))
+
+				Expect(GetReportMessages("bob", "bob@boardthreads.com", 0, 1000)).To(BeEmpty())
+				Expect(GetReportMessages("maria", "bob@boardthreads.com", 0, now+60*60*1000)).To(BeEmpty())
+			})
+
+			g.It("should find the address of a card", func() {
+				Expect(GetAddressForCard("cid3739")).To(Equal("bob@boardthreads.com"))
+				Expect(GetAddressForCard("csl3739")).To(Equal("bob@boardthreads.com"))
+			})
+
+			g.It("should register endpoints and queue deliveries for the events they listen to", func() {
+				all, err := CreateEndpoint("bob", "bob@boardthreads.com", "e1", "https://bob.com/all", "s1", []string{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(all.Secret).To(Equal("s1"))
+				_, err = CreateEndpoint("bob", "bob@boardthreads.com", "e2", "https://bob.com/sent", "s2", []string{"mail.sent"})
+				Expect(err).ToNot(HaveOccurred())
+				_, err = CreateEndpoint("maria", "bob@boardthreads.com", "e3", "https://maria.com/", "s3", []string{})
+				Expect(err).To(HaveOccurred()) // not maria's address
+
+				endpoints, err := ListEndpoints("bob", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(endpoints).To(HaveLen(2))
+				Expect(endpoints[0].Secret).To(Equal(""))
+				Expect(ListEndpoints("maria", "bob@boardthreads.com")).To(HaveLen(0))
+
+				Expect(ListEndpointsForEvent("bob@boardthreads.com", "mail.received")).To(HaveLen(1))
+				Expect(ListEndpointsForEvent("bob@boardthreads.com", "mail.sent")).To(HaveLen(2))
+
+				delivery, err := QueueDelivery("e1", "d1", "mail.received", `{}`, time.Hour)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(delivery.Status).To(Equal(PENDING))
+				_, err = QueueDelivery("e2", "d2", "mail.sent", `{}`, 0)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			g.It("should retry only the due deliveries, once", func() {
+				due, err := ClaimDueDeliveries(10, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(due).To(HaveLen(1))
+				Expect(due[0].Id).To(Equal("d2"))
+				Expect(due[0].URL).To(Equal("https://bob.com/sent"))
+				Expect(due[0].Secret).To(Equal("s2"))
+				Expect(ClaimDueDeliveries(10, time.Minute)).To(HaveLen(0))
+
+				Expect(SaveDeliveryAttempt("d2", 500, "500 Internal Server Error", false, time.Now().Add(-time.Second))).To(Succeed())
+				Expect(ClaimDueDeliveries(10, time.Minute)).To(HaveLen(1))
+				Expect(SaveDeliveryAttempt("d2", 200, "", true, time.Time{})).To(Succeed())
+				Expect(SaveDeliveryAttempt("d1", 0, "timeout", false, time.Time{})).To(Succeed())
+
+				deliveries, err := ListDeliveries("bob", "bob@boardthreads.com", "e2", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(deliveries).To(HaveLen(1))
+				Expect(deliveries[0].Status).To(Equal(DELIVERED))
+				Expect(deliveries[0].Attempts).To(Equal(2))
+				Expect(deliveries[0].StatusCode).To(Equal(200))
+
+				deliveries, _ = ListDeliveries("bob", "bob@boardthreads.com", "e1", 10)
+				Expect(deliveries[0].Status).To(Equal(FAILED))
+				Expect(deliveries[0].Error).To(Equal("timeout"))
+				Expect(ListDeliveries("maria", "bob@boardthreads.com", "e1", 10)).To(HaveLen(0))
+			})
+
+			g.It("should prune finished deliveries and delete endpoints", func() {
+				Expect(PruneDeliveries(time.Now().Add(time.Minute))).To(Succeed())
+				Expect(ListDeliveries("bob", "bob@boardthreads.com", "e1", 10)).To(HaveLen(0))
+
+				Expect(DeleteEndpoint("bob", "bob@boardthreads.com", "e2")).To(Succeed())
+				Expect(ListEndpoints("bob", "bob@boardthreads.com")).To(HaveLen(1))
+				_, err := GetEndpoint("bob", "bob@boardthreads.com", "e2")
+				Expect(err).To(HaveOccurred())
+			})
+
+			g.It("should link mails to contacts and find previous conversations", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4040", "cid4040", "7676768")).To(Succeed())
+				Expect(SaveEmailReceived("cid4040", "csl4040", "<mid4040>", "another question", "other@someone.com", "comm4040")).To(Succeed())
+
+				Expect(SaveContact("<mid3739>", "From@someone.com", "Maria", "someone.com", true)).To(Succeed())
+				Expect(SaveContact("<repl3739>", "from@someone.com", "", "someone.com", false)).To(Succeed())
+				Expect(SaveContact("<mid4040>", "other@someone.com", "", "someone.com", true)).To(Succeed())
+
+				previous, err := GetPreviousConversations("csl4040", "other@someone.com", "someone.com", 5)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(previous).To(HaveLen(1))
+				Expect(previous[0].CardShortLink).To(Equal("csl3739"))
+				Expect(previous[0].SameContact).To(Equal(false))
+				Expect(previous[0].Subject).ToNot(BeEmpty())
+				Expect(GetPreviousConversations("csl4040", "other@someone.com", "", 5)).To(BeEmpty())
+
+				Expect(ListContacts("bob", "", 10)).To(HaveLen(2))
+				Expect(ListContacts("bob", "MARIA", 10)).To(HaveLen(1))
+				Expect(ListContacts("maria", "", 10)).To(BeEmpty())
+
+				contact, threads, err := GetContact("bob", "FROM@someone.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(contact.Name).To(Equal("Maria"))
+				Expect(contact.Organisation).To(Equal("someone.com"))
+				Expect(contact.Inbound).To(BeNumerically(">=", 1))
+				Expect(contact.Outbound).To(Equal(1))
+				Expect(threads).To(HaveLen(1))
+				Expect(threads[0].CardShortLink).To(Equal("csl3739"))
+				_, _, err = GetContact("maria", "from@someone.com")
+				Expect(err).To(HaveOccurred())
+
+				// the name someone uses writing to maria isn't what bob sees
+				Expect(SaveCardWithEmail("maria@boardthreads.com", "csl4041", "cid4041", "7676780")).To(Succeed())
+				Expect(SaveEmailReceived("cid4041", "csl4041", "<mid4041>", "hi", "from@someone.com", "comm4041")).To(Succeed())
+				Expect(SaveContact("<mid4041>", "from@someone.com", "Bob's Boss", "someone.com", true)).To(Succeed())
+				Expect(SaveContact("<mid3739>", "from@someone.com", "Bob's Boss", "someone.com", true)).To(Succeed())
+				contact, _, err = GetContact("bob", "from@someone.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(contact.Name).To(Equal("Maria"))
+				Expect(ListContacts("bob", "boss", 10)).To(BeEmpty())
+				contact, _, err = GetContact("maria", "from@someone.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(contact.Name).To(Equal("Bob's Boss"))
+				Expect(ListContacts("maria", "boss", 10)).To(HaveLen(1))
+				Expect(RemoveCard("csl4041")).To(Succeed())
+
+				Expect(RemoveCard("csl4040")).To(Succeed())
+			})
+
+			g.It("should find and erase everything about a data subject", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4141", "cid4141", "7676769")).To(Succeed())
+				Expect(SaveEmailReceived("cid4141", "csl4141", "<mid4141>", "forget me", "Gone@else.com", "comm4141")).To(Succeed())
+				Expect(SaveContact("<mid4141>", "gone@else.com", "Gone", "else.com", true)).To(Succeed())
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid4141>", "mails/41/4141", "forget me gone@else.com", "gone@else.com", "forget me")).To(Succeed())
+				Expect(SaveCommentSent("csl4141", "bob", "<repl4141>", "comm4142")).To(Succeed())
+
+				// a mail that was also sent to maria
+				Expect(SaveEmailReceived("cid4141", "csl4141", "<mid4143>", "forget me too", "gone@else.com", "comm4143")).To(Succeed())
+				Expect(SaveCardWithEmail("maria@boardthreads.com", "csl4143", "cid4143", "7676770")).To(Succeed())
+				Expect(SaveEmailReceived("cid4143", "csl4143", "<mid4143>", "forget me too", "gone@else.com", "comm4144")).To(Succeed())
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid4143>", "mails/41/4143", "forget me too gone@else.com", "gone@else.com", "forget me too")).To(Succeed())
+				Expect(ArchiveMail("maria@boardthreads.com", "<mid4143>", "mails/41/4143m", "forget me too gone@else.com", "gone@else.com", "forget me too")).To(Succeed())
+				Expect(SaveContact("<repl4141>", "gone@else.com", "", "else.com", false)).To(Succeed())
+
+				mails, err := FindSubjectMails("bob", "GONE@else.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails).To(HaveLen(3))
+				Expect(mails[0].Id).To(Equal("<mid4141>"))
+				Expect(mails[0].Inbound).To(Equal(true))
+				Expect(mails[0].Body).To(Equal("mails/41/4141"))
+				Expect(mails[0].CardShortLink).To(Equal("csl4141"))
+				Expect(mails[1].Id).To(Equal("<repl4141>"))
+				Expect(mails[1].Inbound).To(Equal(false))
+				Expect(FindSubjectMails("maria", "gone@else.com")).To(HaveLen(1))
+
+				Expect(EraseSubject("bob", "gone@else.com", []string{"<mid4141>", "<repl4141>", "<mid4143>"})).To(ConsistOf("mails/41/4141", "mails/41/4143"))
+				Expect(FindSubjectMails("bob", "gone@else.com")).To(BeEmpty())
+				Expect(SearchMails("bob", SearchParams{Terms: []string{"forget"}, Limit: 10})).To(BeEmpty())
+				_, _, err = GetContact("bob", "gone@else.com")
+				Expect(err).To(HaveOccurred())
+
+				// maria's copy is still there
+				Expect(GetArchivedMail("maria", "<mid4143>")).To(Equal("mails/41/4143m"))
+				Expect(SearchMails("maria", SearchParams{Terms: []string{"forget"}, Limit: 10})).To(HaveLen(1))
+
+				Expect(SavePrivacyRequest("bob", PrivacyRequest{Id: "pr1", Kind: "erasure", SubjectHash: "abc", Mails: 2, Trello: "keep"})).To(Succeed())
+				Expect(CompletePrivacyRequest("bob", PrivacyRequest{Id: "pr1", Cards: 1, Bodies: 1, Failures: 1})).To(Succeed())
+				Expect(CompletePrivacyRequest("maria", PrivacyRequest{Id: "pr1", Cards: 9})).To(Succeed())
+				requests, err := ListPrivacyRequests("bob")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(requests).To(HaveLen(1))
+				Expect(requests[0].Mails).To(Equal(2))
+				Expect(requests[0].Cards).To(Equal(1))
+				Expect(requests[0].Bodies).To(Equal(1))
+				Expect(requests[0].Failures).To(Equal(1))
+				Expect(requests[0].Date).ToNot(BeZero())
+				Expect(ListPrivacyRequests("maria")).To(BeEmpty())
+
+				Expect(RemoveCard("csl4141")).To(Succeed())
+				Expect(RemoveCard("csl4143")).To(Succeed())
+			})
+
+			g.It("should only find the whole address of a data subject", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4145", "cid4145", "7676771")).To(Succeed())
+				Expect(SaveEmailReceived("cid4145", "csl4145", "<mid4145>", "hi from ann", "ann@else.com", "comm4145")).To(Succeed())
+				Expect(SaveContact("<mid4145>", "ann@else.com", "Ann", "else.com", true)).To(Succeed())
+				Expect(SaveEmailReceived("cid4145", "csl4145", "<mid4146>", "hi from joann", "joann@else.com", "comm4146")).To(Succeed())
+				Expect(SaveContact("<mid4146>", "joann@else.com", "Joann", "else.com", true)).To(Succeed())
+
+				// archived mails whose card is gone, one of them mentions ann
+				Expect(SaveEmailReceived("cid4145", "csl4145", "<mid4147>", "about ann", "joann@else.com", "comm4147")).To(Succeed())
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid4147>", "mails/41/4147", "about ann cc ann@else.com joann@else.com", "Joann <joann@else.com>", "about ann")).To(Succeed())
+				Expect(SaveEmailReceived("cid4145", "csl4145", "<mid4148>", "me again", "ann@else.com", "comm4148")).To(Succeed())
+				Expect(ArchiveMail("bob@boardthreads.com", "<mid4148>", "mails/41/4148", "me again ann@else.com", "Ann <ann@else.com>", "me again")).To(Succeed())
+				_, err := DB.Exec(`MATCH (:Card)-[r:CONTAINS]->(m:Mail) WHERE m.id IN ["<mid4147>", "<mid4148>"] DELETE r`)
+				Expect(err).ToNot(HaveOccurred())
+
+				mails, err := FindSubjectMails("bob", "ann@else.com")
+				Expect(err).ToNot(HaveOccurred())
+				ids := []string{}
+				for _, m := range mails {
+					ids = append(ids, m.Id)
+				}
+				Expect(ids).To(ConsistOf("<mid4145>", "<mid4148>"))
+
+				mails, err = FindSubjectMails("bob", "joann@else.com")
+				Expect(err).ToNot(HaveOccurred())
+				ids = []string{}
+				for _, m := range mails {
+					ids = append(ids, m.Id)
+				}
+				Expect(ids).To(ConsistOf("<mid4146>", "<mid4147>"))
+
+				Expect(EraseSubject("bob", "ann@else.com", []string{"<mid4145>", "<mid4148>"})).To(Equal([]string{"mails/41/4148"}))
+				Expect(GetArchivedMail("bob", "<mid4147>")).To(Equal("mails/41/4147"))
+				Expect(FindSubjectMails("bob", "joann@else.com")).To(HaveLen(2))
+				_, _, err = GetContact("bob", "joann@else.com")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(RemoveCard("csl4145")).To(Succeed())
+				_, err = DB.Exec(`
+MATCH (m:Mail) WHERE m.id IN ["<mid4147>", "<mid4148>"]
+OPTIONAL MATCH (m)-[r]-()
+DELETE m, r
+                `)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			g.It("should merge a card into another", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4242", "cid4242", "7676770")).To(Succeed())
+				Expect(SaveEmailReceived("cid4242", "csl4242", "<mid4242>", "printer broken", "first@someone.com", "comm4242")).To(Succeed())
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4343", "cid4343", "7676771")).To(Succeed())
+				Expect(SaveEmailReceived("cid4343", "csl4343", "<mid4343>", "printer still broken", "second@someone.com", "comm4343")).To(Succeed())
+
+				_, err := MergeCards("cid4343", "cidnothere")
+				Expect(err).To(HaveOccurred())
+
+				mails, err := MergeCards("cid4343", "cid4242")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails).To(HaveLen(1))
+				Expect(mails[0].Id).To(Equal("<mid4343>"))
+				Expect(mails[0].From).To(Equal("second@someone.com"))
+				Expect(mails[0].Inbound).To(Equal(true))
+
+				Expect(GetMergedInto("csl4343")).To(Equal("csl4242"))
+				Expect(GetMergedInto("csl4242")).To(BeEmpty())
+				Expect(GetThreadMessages("csl4343")).To(BeEmpty())
+				Expect(GetThreadMessages("csl4242")).To(HaveLen(2))
+
+				params, err := GetEmailParamsForCard("csl4242")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params.Recipients).To(ConsistOf("first@someone.com", "second@someone.com"))
+
+				shortLink, _, err := GetCardForMessage("<mid4343>", "Re: printer still broken", "second@someone.com", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shortLink).To(Equal("csl4242"))
+
+				// can't merge into a merged card
+				_, err = MergeCards("cid4242", "cid4343")
+				Expect(err).To(HaveOccurred())
+
+				Expect(RemoveCard("csl4242")).To(Succeed())
+				Expect(RemoveCard("csl4343")).To(Succeed())
+			})
+
+			g.It("should split messages from a sender into another card", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4444", "cid4444", "7676772")).To(Succeed())
+				Expect(SaveEmailReceived("cid4444", "csl4444", "<mid4444a>", "my order", "first@someone.com", "comm4444a")).To(Succeed())
+				Expect(SaveEmailReceived("cid4444", "csl4444", "<mid4444b>", "my order", "second@someone.com", "comm4444b")).To(Succeed())
+				Expect(SaveEmailReceived("cid4444", "csl4444", "<mid4444c>", "my order", "second@someone.com", "comm4444c")).To(Succeed())
+				Expect(SaveCommentSent("csl4444", "bob", "<repl4444>", "comm4444r")).To(Succeed())
+				Expect(SaveMailArrival("csl4444", "<mid4444a>", "bob@boardthreads.com", "orders")).To(Succeed())
+				Expect(SaveMailArrival("csl4444", "<mid4444c>", "bob@boardthreads.com", "returns")).To(Succeed())
+
+				point, err := GetSplitPoint("csl4444", "comm4444b")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(point.MailId).To(Equal("<mid4444b>"))
+				Expect(point.From).To(Equal("second@someone.com"))
+				Expect(point.Address).To(Equal("bob@boardthreads.com"))
+				Expect(GetSplitPoint("cid4444", "<mid4444b>")).To(Equal(point))
+				_, err = GetSplitPoint("csl4444", "<repl4444>")
+				Expect(err).To(HaveOccurred())
+
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4545", "cid4545", "7676773")).To(Succeed())
+				mails, err := SplitMails("cid4444", "cid4545", "<mid4444b>")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails).To(HaveLen(2))
+				Expect(mails[0].CommentId).To(Equal("comm4444b"))
+
+				Expect(GetThreadMessages("csl4444")).To(HaveLen(2))
+				Expect(GetThreadMessages("csl4545")).To(HaveLen(2))
+
+				// each card keeps the tag of its own last inbound mail
+				Expect(RefreshLastMail("cid4444")).To(Equal(false))
+				params, err := GetEmailParamsForCard("csl4444")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params.PlusTag).To(Equal("orders"))
+				Expect(RefreshLastMail("csl4545")).To(Equal(true))
+				params, err = GetEmailParamsForCard("csl4545")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params.PlusTag).To(Equal("returns"))
+
+				Expect(RemoveCard("csl4444")).To(Succeed())
+				Expect(RemoveCard("csl4545")).To(Succeed())
+			})
+
+			g.It("should handle a message once per list and link the cards", func() {
+				Expect(InternalAddresses([]string{"bob@boardthreads.com", "emailto@bob.com", "someone@else.com"})).To(ConsistOf(
+					"bob@boardthreads.com", "emailto@bob.com"))
+
+				Expect(ClaimInboundMail("<mid4949>", "l329847", time.Minute)).To(Equal(true))
+				Expect(ClaimInboundMail("<mid4949>", "l329847", time.Minute)).To(Equal(false))
+				Expect(ClaimInboundMail("<mid4949>", "l43834", time.Minute)).To(Equal(true))
+
+				Expect(FinishInboundMail("<mid4949>", "l329847", "bob@boardthreads.com", "csl4949")).To(BeEmpty())
+				others, err := FinishInboundMail("<mid4949>", "l43834", "maria@boardthreads.com", "csl5050")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(others).To(Equal([]Receipt{{Address: "bob@boardthreads.com", CardShortLink: "csl4949"}}))
+
+				// finished, even after the lease
+				Expect(ClaimInboundMail("<mid4949>", "l329847", 0)).To(Equal(false))
+
+				Expect(PruneReceipts(time.Now().Add(time.Hour))).To(Succeed())
+				Expect(ClaimInboundMail("<mid4949>", "l329847", time.Minute)).To(Equal(true))
+				Expect(PruneReceipts(time.Now().Add(time.Hour))).To(Succeed())
+			})
+
+			g.It("should keep the comment of a mail on each of its cards", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4950", "cid4950", "7676778")).To(Succeed())
+				Expect(SaveCardWithEmail("maria@boardthreads.com", "csl5051", "cid5051", "7676779")).To(Succeed())
+				Expect(SaveEmailReceived("cid4950", "csl4950", "<mid4950>", "to both", "someone@else.com", "comm4950")).To(Succeed())
+				Expect(SaveEmailReceived("cid5051", "csl5051", "<mid4950>", "to both", "someone@else.com", "comm5051")).To(Succeed())
+				Expect(SaveMailArrival("csl4950", "<mid4950>", "bob@boardthreads.com", "")).To(Succeed())
+				Expect(SaveMailArrival("csl5051", "<mid4950>", "maria@boardthreads.com", "orders")).To(Succeed())
+
+				point, err := GetSplitPoint("csl5051", "comm5051")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(point.MailId).To(Equal("<mid4950>"))
+				_, err = GetSplitPoint("csl5051", "comm4950")
+				Expect(err).To(HaveOccurred())
+
+				mails, err := GetExportMails("bob", "csl4950")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails[0].CommentId).To(Equal("comm4950"))
+				mails, err = GetExportMails("maria", "csl5051")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mails[0].CommentId).To(Equal("comm5051"))
+
+				subject, err := FindSubjectMails("maria", "someone@else.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(subject).To(HaveLen(1))
+				Expect(subject[0].CommentId).To(Equal("comm5051"))
+
+				Expect(RefreshLastMail("csl4950")).To(Equal(true))
+				params, _ := GetEmailParamsForCard("csl4950")
+				Expect(params.PlusTag).To(Equal(""))
+				Expect(RefreshLastMail("csl5051")).To(Equal(true))
+				params, _ = GetEmailParamsForCard("csl5051")
+				Expect(params.PlusTag).To(Equal("orders"))
+
+				Expect(RemoveCard("csl4950")).To(Succeed())
+				Expect(RemoveCard("csl5051")).To(Succeed())
+			})
+
+			g.It("should not send replies to our own addresses", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl5151", "cid5151", "7676777")).To(Succeed())
+				Expect(SaveEmailReceived("cid5151", "csl5151", "<mid5151>", "hello", "someone@else.com", "comm5151")).To(Succeed())
+				Expect(SaveEmailReceived("cid5151", "csl5151", "<mid5152>", "hello", "Bob+c-abc@boardthreads.com", "comm5152")).To(Succeed())
+				Expect(SaveEmailReceived("cid5151", "csl5151", "<mid5153>", "hello", "emailto@bob.com", "comm5153")).To(Succeed())
+
+				params, err := GetEmailParamsForCard("csl5151")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params.Recipients).To(Equal([]string{"someone@else.com"}))
+
+				Expect(RemoveCard("csl5151")).To(Succeed())
+			})
+
+			g.It("should find the card of a reply address, following merges", func() {
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4747", "cid4747", "7676775")).To(Succeed())
+				Expect(SaveEmailReceived("cid4747", "csl4747", "<mid4747>", "my refund", "someone@else.com", "comm4747")).To(Succeed())
+				Expect(GetCardForReplyTag("csl4747", "bob@boardthreads.com")).To(Equal("csl4747"))
+				Expect(GetCardForReplyTag("csl4747", "maria@boardthreads.com")).To(Equal(""))
+				Expect(GetCardForReplyTag("csl0000", "bob@boardthreads.com")).To(Equal(""))
+
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4848", "cid4848", "7676776")).To(Succeed())
+				_, err := MergeCards("cid4747", "cid4848")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(GetCardForReplyTag("csl4747", "bob@boardthreads.com")).To(Equal("csl4848"))
+
+				Expect(RemoveCard("csl4747")).To(Succeed())
+				Expect(RemoveCard("csl4848")).To(Succeed())
+			})
+
+			g.It("should route plus tags through the address settings", func() {
+				Expect(ChangeAddressSettings("bob", "bob@boardthreads.com", AddressSettings{
+					ThreadingMode: REOPEN,
+					ReopenDays:    90,
+					TicketTag:     "Bob",
+					PlusTags: map[string]PlusTagRoute{
+						"billing": {Label: "Billing", ListId: "l329848"},
+					},
+				})).To(Succeed())
+
+				address, err := GetAddress("bob", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address.Settings.PlusTags).To(HaveKeyWithValue("billing", PlusTagRoute{Label: "Billing", ListId: "l329848"}))
+
+				prefs, err := GetReceivingParams("bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				route, ok := prefs.PlusTag("billing")
+				Expect(ok).To(Equal(true))
+				Expect(route.ListId).To(Equal("l329848"))
+				_, ok = prefs.PlusTag("unknown")
+				Expect(ok).To(Equal(false))
+				_, ok = prefs.PlusTag("")
+				Expect(ok).To(Equal(false))
+			})
+
+			g.It("should resolve aliases and reply from the one a thread arrived on", func() {
+				Expect(AddAlias("bob", "bob@boardthreads.com", "Bob-Billing@boardthreads.com")).To(Succeed())
+				Expect(AddAlias("bob", "bob@boardthreads.com", "bob-help@boardthreads.com")).To(Succeed())
+				Expect(AddAlias("bob", "bob@boardthreads.com", "bob-help@boardthreads.com")).ToNot(Succeed())
+				Expect(AddAlias("bob", "bob@boardthreads.com", "maria@boardthreads.com")).ToNot(Succeed())
+				Expect(AddAlias("maria", "bob@boardthreads.com", "bob-sales@boardthreads.com")).ToNot(Succeed())
+
+				Expect(ResolveAlias("bob-billing@boardthreads.com")).To(Equal("bob@boardthreads.com"))
+				Expect(ResolveAlias("maria@boardthreads.com")).To(Equal("maria@boardthreads.com"))
+
+				Expect(SaveCardWithEmail("bob@boardthreads.com", "csl4646", "cid4646", "7676774")).To(Succeed())
+				Expect(SaveEmailReceived("cid4646", "csl4646", "<mid4646>", "my invoice", "someone@else.com", "comm4646")).To(Succeed())
+
+				// no alias known and no primary, the address itself
+				params, err := GetEmailParamsForCard("csl4646")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params.SendAs).To(Equal(""))
+
+				Expect(SetPrimaryAlias("bob", "bob@boardthreads.com", "bob-help@boardthreads.com")).To(Succeed())
+				Expect(SetPrimaryAlias("bob", "bob@boardthreads.com", "bob-none@boardthreads.com")).ToNot(Succeed())
+				params, _ = GetEmailParamsForCard("csl4646")
+				Expect(params.SendAs).To(Equal("bob-help@boardthreads.com"))
+
+				Expect(SaveMailArrival("csl4646", "<mid4646>", "bob-billing@boardthreads.com", "")).To(Succeed())
+				params, _ = GetEmailParamsForCard("csl4646")
+				Expect(params.SendAs).To(Equal("bob-billing@boardthreads.com"))
+
+				Expect(SaveMailArrival("csl4646", "<mid4646>", "bob@boardthreads.com", "refunds")).To(Succeed())
+				params, _ = GetEmailParamsForCard("csl4646")
+				Expect(params.SendAs).To(Equal(""))
+				Expect(params.PlusTag).To(Equal("refunds"))
+
+				// an untagged follow-up keeps the routing the thread got
+				Expect(SaveMailArrival("csl4646", "<mid4646>", "bob@boardthreads.com", "")).To(Succeed())
+				params, _ = GetEmailParamsForCard("csl4646")
+				Expect(params.PlusTag).To(Equal("refunds"))
+
+				aliases, err := ListAliases("bob", "bob@boardthreads.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(aliases).To(HaveLen(2))
+				Expect(aliases[0].Address).To(Equal("bob-billing@boardthreads.com"))
+				Expect(aliases[0].Primary).To(Equal(false))
+				Expect(aliases[1].Primary).To(Equal(true))
+
+				// removing the primary alias makes the address the primary again
+				Expect(RemoveAlias("bob", "bob@boardthreads.com", "bob-help@boardthreads.com")).To(Succeed())
+				Expect(RemoveAlias("bob", "bob@boardthreads.com", "bob-billing@boardthreads.com")).To(Succeed())
+				Expect(ListAliases("bob", "bob@boardthreads.com")).To(BeEmpty())
+				Expect(ResolveAlias("bob-billing@boardthreads.com")).To(Equal("bob-billing@boardthreads.com"))
+
+				Expect(RemoveCard("csl4646")).To(Succeed())
+			})
+
 			g.It("should delete the card", func() {
 				Expect(RemoveCard("cid3739")).To(Succeed())
 				var found bool
@@ -394,6 +1120,118 @@ DELETE n,r
 			})
 		})
 
+		g.Describe("sessions", func() {
+			future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+
+			g.It("should create and get sessions", func() {
+				EnsureUser("sam")
+				Expect(CreateSession(Session{"s1", "sam", "h1", "kid:sealed", future})).To(Succeed())
+				Expect(CreateSession(Session{"s2", "sam", "h2", "kid:sealed", future})).To(Succeed())
+
+				Expect(GetSession("s1")).To(BeEquivalentTo(&Session{"s1", "sam", "h1", "kid:sealed", future}))
+				Expect(GetSession("nothing")).To(BeNil())
+			})
+
+			g.It("should refresh only with the current hash", func() {
+				Expect(RefreshSession("s1", "h0", "h3", "kid:other", future)).To(BeFalse())
+				Expect(RefreshSession("s1", "h1", "h3", "kid:other", future)).To(BeTrue())
+				Expect(RefreshSession("s1", "h1", "h4", "kid:other", future)).To(BeFalse())
+
+				session, _ := GetSession("s1")
+				Expect(session.RefreshHash).To(Equal("h3"))
+				Expect(session.TrelloToken).To(Equal("kid:other"))
+			})
+
+			g.It("should log out of one session or all", func() {
+				Expect(SessionsRevokedAt("sam")).To(BeEquivalentTo(0))
+
+				Expect(DeleteSession("someone-else", "s1")).To(Succeed())
+				Expect(GetSession("s1")).ToNot(BeNil())
+				Expect(DeleteSession("sam", "s1")).To(Succeed())
+				Expect(GetSession("s1")).To(BeNil())
+				Expect(GetSession("s2")).ToNot(BeNil())
+
+				Expect(DeleteSessions("sam")).To(Succeed())
+				Expect(GetSession("s2")).To(BeNil())
+				Expect(SessionsRevokedAt("sam")).To(BeNumerically(">", 0))
+			})
+
+			g.It("should not get or keep expired sessions", func() {
+				past := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+				Expect(CreateSession(Session{"s5", "sam", "h5", "kid:sealed", past})).To(Succeed())
+				Expect(GetSession("s5")).To(BeNil())
+				Expect(RefreshSession("s5", "h5", "h6", "kid:sealed", future)).To(BeFalse())
+
+				Expect(PruneSessions(time.Now())).To(Succeed())
+				var count int
+				DB.Get(&count, `MATCH (s:Session {id: "s5"}) RETURN count(s)`)
+				Expect(count).To(Equal(0))
+			})
+		})
+
+		g.Describe("roles", func() {
+			g.Before(func() {
+				SetAddress("rolf", "b77001", "l77001", "rolf@boardthreads.com", "rolf@boardthreads.com")
+				EnsureUser("ana")
+				EnsureUser("bia")
+				EnsureUser("caio")
+			})
+
+			g.It("should give the owner the owner role and nobody else any", func() {
+				Expect(GetRole("rolf", "rolf@boardthreads.com")).To(Equal(OWNER))
+				Expect(GetRole("ana", "rolf@boardthreads.com")).To(Equal(NO_ROLE))
+				Expect(GetRole("ana", "nothing@boardthreads.com")).To(Equal(NO_ROLE))
+
+				addr, err := GetAddress("ana", "rolf@boardthreads.com")
+				Expect(err).To(BeNil())
+				Expect(addr).To(BeNil())
+			})
+
+			g.It("should derive roles from board membership", func() {
+				Expect(SaveBoardMembers("b77001",
+					[]string{"rolf", "ana", "bia", "caio", "unknown"},
+					[]string{"admin", "admin", "normal", "observer", "normal"},
+				)).To(Succeed())
+
+				Expect(GetRole("ana", "rolf@boardthreads.com")).To(Equal(ADMIN))
+				Expect(GetRole("bia", "rolf@boardthreads.com")).To(Equal(AGENT))
+				Expect(GetRole("caio", "rolf@boardthreads.com")).To(Equal(VIEWER))
+				Expect(GetRole("unknown", "rolf@boardthreads.com")).To(Equal(NO_ROLE))
+
+				addr, _ := GetAddress("bia", "rolf@boardthreads.com")
+				Expect(addr.UserId).To(Equal("rolf"))
+				Expect(addr.Role).To(Equal(AGENT))
+				Expect(GetAddresses("caio")).To(HaveLen(1))
+			})
+
+			g.It("should let invites and revocations win over the board", func() {
+				Expect(SetRole("rolf@boardthreads.com", "caio", ADMIN, "rolf")).To(Succeed())
+				Expect(SetRole("rolf@boardthreads.com", "ana", NO_ROLE, "rolf")).To(Succeed())
+				Expect(SetRole("rolf@boardthreads.com", "rolf", VIEWER, "rolf")).To(Succeed())
+
+				Expect(GetRole("caio", "rolf@boardthreads.com")).To(Equal(ADMIN))
+				Expect(GetRole("ana", "rolf@boardthreads.com")).To(Equal(NO_ROLE))
+				Expect(GetRole("rolf", "rolf@boardthreads.com")).To(Equal(OWNER))
+				Expect(GetAddresses("ana")).To(BeEmpty())
+
+				Expect(ListMembers("rolf@boardthreads.com")).To(ConsistOf(
+					Member{UserId: "rolf", Role: OWNER, Source: "owner"},
+					Member{UserId: "caio", Role: ADMIN, Source: "invite"},
+					Member{UserId: "ana", Role: NO_ROLE, Source: "invite"},
+					Member{UserId: "bia", Role: AGENT, Source: "board"},
+				))
+			})
+
+			g.It("should go back to the board role when the invite is removed", func() {
+				Expect(RemoveRole("rolf@boardthreads.com", "ana")).To(Succeed())
+				Expect(GetRole("ana", "rolf@boardthreads.com")).To(Equal(ADMIN))
+
+				Expect(SaveBoardMembers("b77001", []string{"rolf"}, []string{"admin"})).To(Succeed())
+				Expect(GetRole("ana", "rolf@boardthreads.com")).To(Equal(NO_ROLE))
+				Expect(GetRole("caio", "rolf@boardthreads.com")).To(Equal(ADMIN))
+			})
+		})
+
 		g.Describe("custom params", func() {
 
 			g.It("fetch default params for a card", func() {
@@ -412,12 +1250,28 @@ DELETE n,r
 
 			g.It("should set some params then fetch again", func() {
 				Expect(ChangeAddressSettings("maria", "maria@boardthreads.com", AddressSettings{
-					ReplyTo:           "cuisine@maria.com",
-					SenderName:        "Marie",
-					AddReplier:        true,
-					MessageInDesc:     false,
-					SignatureTemplate: "---\n\nThanks!\n{NAME}",
-					MoveToTop:         true,
+					ReplyTo:            "cuisine@maria.com",
+					SenderName:         "Marie",
+					AddReplier:         true,
+					MessageInDesc:      false,
+					SignatureTemplate:  "---\n\nThanks!\n{NAME}",
+					MoveToTop:          true,
+					ThreadingMode:      LINK,
+					ReopenDays:         90,
+					FirstResponseHours: 4,
+					NextResponseHours:  8,
+					TimeZone:           "Europe/Paris",
+					BusinessHours: map[string][]calendar.Span{
+						"monday": {{Start: "09:00", End: "12:00"}, {Start: "14:00", End: "18:00"}},
+						"friday": {{Start: "09:00", End: "12:00"}},
+					},
+					Holidays:          []string{"2016-07-14"},
+					AutoAck:           true,
+					AutoAckTemplate:   "got it: {SUBJECT}",
+					TicketTag:         "Cuisine",
+					Reminders:         []Reminder{{Hours: 24, Action: MENTION}},
+					CustomerReplyList: "l49983",
+					AgentReplyList:    "l49984",
 				})).To(Succeed())
 
 				Expect(GetEmailParamsForCard("csl9797")).To(BeEquivalentTo(sendingParams{
@@ -430,15 +1284,48 @@ DELETE n,r
 					SenderName:        "Marie",
 					SignatureTemplate: "---\n\nThanks!\n{NAME}",
 					AddReplier:        true,
+					TicketTag:         "Cuisine",
+					AgentReplyList:    "l49984",
 				}))
 
 				Expect(GetReceivingParams("maria@boardthreads.com")).To(BeEquivalentTo(
-					receivingParams{false, true},
+					receivingParams{
+						MessageInDesc:      false,
+						MoveToTop:          true,
+						ThreadingMode:      LINK,
+						AutoAck:            true,
+						AutoAckTemplate:    "got it: {SUBJECT}",
+						FirstResponseHours: 4,
+						CustomerReplyList:  "l49983",
+					},
 				))
 
 				addr, _ := GetAddress("maria", "maria@boardthreads.com")
 				Expect(addr.Settings).To(BeEquivalentTo(
-					AddressSettings{"Marie", "cuisine@maria.com", true, false, "---\n\nThanks!\n{NAME}", true}),
+					AddressSettings{
+						SenderName:         "Marie",
+						ReplyTo:            "cuisine@maria.com",
+						AddReplier:         true,
+						MessageInDesc:      false,
+						SignatureTemplate:  "---\n\nThanks!\n{NAME}",
+						MoveToTop:          true,
+						ThreadingMode:      LINK,
+						ReopenDays:         90,
+						FirstResponseHours: 4,
+						NextResponseHours:  8,
+						TimeZone:           "Europe/Paris",
+						BusinessHours: map[string][]calendar.Span{
+							"monday": {{Start: "09:00", End: "12:00"}, {Start: "14:00", End: "18:00"}},
+							"friday": {{Start: "09:00", End: "12:00"}},
+						},
+						Holidays:          []string{"2016-07-14"},
+						AutoAck:           true,
+						AutoAckTemplate:   "got it: {SUBJECT}",
+						TicketTag:         "Cuisine",
+						Reminders:         []Reminder{{Hours: 24, Action: MENTION}},
+						CustomerReplyList: "l49983",
+						AgentReplyList:    "l49984",
+					}),
 				)
 			})
 
@@ -450,7 +1337,9 @@ DELETE n,r
 					ReplyTo:       "cuisine@maria.com", // all params must be set again everytime,
 					// otherwise they are replaced with default values
 					// it will happen with SignatureTemplate right now
-					MoveToTop: false,
+					MoveToTop:     false,
+					ThreadingMode: REOPEN,
+					ReopenDays:    15,
 				})).To(Succeed())
 
 				Expect(GetEmailParamsForCard("csl9797")).To(BeEquivalentTo(sendingParams{
@@ -466,12 +1355,25 @@ DELETE n,r
 				}))
 
 				Expect(GetReceivingParams("maria@boardthreads.com")).To(BeEquivalentTo(
-					receivingParams{true, false},
+					receivingParams{
+						MessageInDesc: true,
+						MoveToTop:     false,
+						ThreadingMode: REOPEN,
+					},
 				))
 
 				addr, _ := GetAddress("maria", "maria@boardthreads.com")
 				Expect(addr.Settings).To(BeEquivalentTo(
-					AddressSettings{"Mariah", "cuisine@maria.com", false, true, "", false}),
+					AddressSettings{
+						SenderName:    "Mariah",
+						ReplyTo:       "cuisine@maria.com",
+						AddReplier:    false,
+						MessageInDesc: true,
+						MoveToTop:     false,
+						ThreadingMode: REOPEN,
+						ReopenDays:    15,
+						Holidays:      []string{},
+					}),
 				)
 			})
 
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// endpoints are https urls our users register to hear about what happens on an address,
+// every request we make to them is kept as a Delivery until it succeeds or we give up.
+
+type Endpoint struct {
+	Id      string   `json:"id"                db:"id"`
+	URL     string   `json:"url"               db:"url"`
+	Secret  string   `json:"secret,omitempty"  db:"secret"` // sealed, see sessions.Keyring
+	Events  []string `json:"events"            db:"events"`
+	Created int64    `json:"created"           db:"created"`
+}
+
+type deliveryStatus string
+
+const (
+	PENDING   deliveryStatus = "pending"
+	DELIVERED deliveryStatus = "delivered"
+	FAILED    deliveryStatus = "failed"
+)
+
+type Delivery struct {
+	Id          string         `json:"id"          db:"id"`
+	Event       string         `json:"event"       db:"event"`
+	Payload     string         `json:"payload"     db:"payload"`
+	Status      deliveryStatus `json:"status"      db:"status"`
+	Attempts    int            `json:"attempts"    db:"attempts"`
+	StatusCode  int            `json:"statusCode"  db:"statusCode"`
+	Error       string         `json:"error"       db:"error"`
+	Created     int64          `json:"created"     db:"created"`
+	LastAttempt int64          `json:"lastAttempt" db:"lastAttempt"`
+	NextAttempt int64          `json:"nextAttempt" db:"nextAttempt"`
+}
+
+// PendingDelivery is a delivery with what is needed to attempt it.
+type PendingDelivery struct {
+	Delivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+const deliveryFields = `
+  d.id AS id,
+  d.event AS event,
+  d.payload AS payload,
+  d.status AS status,
+  d.attempts AS attempts,
+  CASE WHEN d.statusCode IS NOT NULL THEN d.statusCode ELSE 0 END AS statusCode,
+  CASE WHEN d.error IS NOT NULL THEN d.error ELSE "" END AS error,
+  d.created AS created,
+  CASE WHEN d.lastAttempt IS NOT NULL THEN d.lastAttempt ELSE 0 END AS lastAttempt,
+  CASE WHEN d.nextAttempt IS NOT NULL THEN d.nextAttempt ELSE 0 END AS nextAttempt
+`
+
+func CreateEndpoint(userId, address, id, url, secret string, events []string) (endpoint Endpoint, err error) {
+	err = DB.Get(&endpoint, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+CREATE (addr)-[:NOTIFIES]->(e:Endpoint {
+  id: {2},
+  url: {3},
+  secret: {4},
+  events: {5},
+  created: TIMESTAMP()
+})
+RETURN e.id AS id, e.url AS url, e.secret AS secret, e.events AS events, e.created AS created
+    `, userId, strings.ToLower(address), id, url, secret, events)
+	return
+}
+
+// ListEndpoints doesn't return the secrets, they are only shown when created.
+func ListEndpoints(userId, address string) (endpoints []Endpoint, err error) {
+	err = DB.Select(&endpoints, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)-[:NOTIFIES]->(e:Endpoint)
+RETURN e.id AS id, e.url AS url, "" AS secret, e.events AS events, e.created AS created
+ORDER BY e.created
+    `, userId, strings.ToLower(address))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return endpoints, nil
+	}
+	return
+}
+
+func GetEndpoint(userId, address, endpointId string) (*Endpoint, error) {
+	endpoint := &Endpoint{}
+	err := DB.Get(endpoint, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)-[:NOTIFIES]->(e:Endpoint {id: {2}})
+RETURN e.id AS id, e.url AS url, e.secret AS secret, e.events AS events, e.created AS created
+    `, userId, strings.ToLower(address), endpointId)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func DeleteEndpoint(userId, address, endpointId string) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)-[n:NOTIFIES]->(e:Endpoint {id: {2}})
+OPTIONAL MATCH (e)-[a:ATTEMPTED]->(d:Delivery)
+DELETE n, e, a, d
+    `, userId, strings.ToLower(address), endpointId)
+	return
+}
+
+// ListEndpointsForEvent returns, with their secrets, the endpoints of the address
+// that listen to the event. endpoints without events listen to everything.
+func ListEndpointsForEvent(address, event string) (endpoints []Endpoint, err error) {
+	err = DB.Select(&endpoints, `
+MATCH (addr:EmailAddress {address: {0}})-[:NOTIFIES]->(e:Endpoint)
+WHERE size(e.events) = 0 OR {1} IN e.events
+RETURN e.id AS id, e.url AS url, e.secret AS secret, e.events AS events, e.created AS created
+    `, strings.ToLower(address), event)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return endpoints, nil
+	}
+	return
+}
+
+// SetEndpointSecret replaces a sealed secret with the same one sealed again. sealed values
+// are never the same twice, so they find their endpoint.
+func SetEndpointSecret(oldSecret, newSecret string) (err error) {
+	_, err = DB.Exec(`
+MATCH (e:Endpoint {secret: {0}})
+SET e.secret = {1}
+    `, oldSecret, newSecret)
+	return
+}
+
+// QueueDelivery creates a pending delivery. the first attempt is expected to happen
+// right away, so nextAttempt is a lease that keeps the retry job away from it for a while.
+func QueueDelivery(endpointId, deliveryId, event, payload string, lease time.Duration) (delivery Delivery, err error) {
+	err = DB.Get(&delivery, `
+MATCH (e:Endpoint {id: {0}})
+CREATE (e)-[:ATTEMPTED]->(d:Delivery {
+  id: {1},
+  event: {2},
+  payload: {3},
+  status: "pending",
+  attempts: 0,
+  created: TIMESTAMP(),
+  nextAttempt: TIMESTAMP() + {4}
+})
+RETURN `+deliveryFields, endpointId, deliveryId, event, payload, int64(lease/time.Millisecond))
+	return
+}
+
+// ClaimDueDeliveries takes pending deliveries whose time has come and pushes their
+// nextAttempt forward by the lease, so other instances won't take them too.
+func ClaimDueDeliveries(limit int, lease time.Duration) (deliveries []PendingDelivery, err error) {
+	err = DB.Select(&deliveries, `
+MATCH (e:Endpoint)-[:ATTEMPTED]->(d:Delivery {status: "pending"})
+WHERE d.nextAttempt <= TIMESTAMP()
+WITH e, d ORDER BY d.nextAttempt LIMIT {0}
+SET d._lock = true
+WITH e, d WHERE d.status = "pending" AND d.nextAttempt <= TIMESTAMP()
+SET d.nextAttempt = TIMESTAMP() + {1}
+REMOVE d._lock
+RETURN e.url AS url, e.secret AS secret, `+deliveryFields, limit, int64(lease/time.Millisecond))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return deliveries, nil
+	}
+	return
+}
+
+// SaveDeliveryAttempt records the outcome of one attempt. a zero nextAttempt for a
+// pending delivery means we gave up on it.
+func SaveDeliveryAttempt(deliveryId string, statusCode int, errorMessage string, delivered bool, nextAttempt time.Time) (err error) {
+	status := PENDING
+	var next int64
+	if delivered {
+		status = DELIVERED
+	} else if nextAttempt.IsZero() {
+		status = FAILED
+	} else {
+		next = nextAttempt.UnixNano() / int64(time.Millisecond)
+	}
+
+	_, err = DB.Exec(`
+MATCH (d:Delivery {id: {0}})
+SET d.attempts = d.attempts + 1
+SET d.lastAttempt = TIMESTAMP()
+SET d.statusCode = {1}
+SET d.error = {2}
+SET d.status = {3}
+SET d.nextAttempt = {4}
+    `, deliveryId, statusCode, errorMessage, status, next)
+	return
+}
+
+func ListDeliveries(userId, address, endpointId string, limit int) (deliveries []Delivery, err error) {
+	err = DB.Select(&deliveries, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress {address: {1}})
+MATCH (addr)-[:NOTIFIES]->(e:Endpoint {id: {2}})-[:ATTEMPTED]->(d:Delivery)
+RETURN `+deliveryFields+`
+ORDER BY d.created DESC
+LIMIT {3}
+    `, userId, strings.ToLower(address), endpointId, limit)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return deliveries, nil
+	}
+	return
+}
+
+// PruneDeliveries forgets finished deliveries older than the given time.
+func PruneDeliveries(before time.Time) (err error) {
+	_, err = DB.Exec(`
+MATCH (:Endpoint)-[a:ATTEMPTED]->(d:Delivery)
+WHERE d.status <> "pending" AND d.created < {0}
+DELETE a, d
+    `, before.UnixNano()/int64(time.Millisecond))
+	return
+}
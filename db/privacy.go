@@ -0,0 +1,204 @@
+package db
+
+import (
+	"bt/helpers"
+	"sort"
+	"strings"
+)
+
+// SubjectMail is a mail involving a data subject, on one of the user's addresses.
+type SubjectMail struct {
+	ExportMail
+	Address       string `db:"address"`
+	CardShortLink string `db:"cardShortLink"`
+}
+
+const subjectMailFields = `
+  CASE WHEN c IS NOT NULL THEN c.id ELSE "" END AS cardId,
+  CASE WHEN c IS NOT NULL THEN c.shortLink ELSE "" END AS cardShortLink,
+  addr.address AS address,
+  m.id AS id,
+  m.date AS date,
+  CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE "" END AS subject,
+  CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
+  CASE WHEN r.commentId IS NOT NULL THEN r.commentId WHEN m.commentId IS NOT NULL THEN m.commentId ELSE "" END AS commentId,
+  CASE WHEN a IS NOT NULL THEN a.body ELSE "" END AS body,
+  inbound,
+  LOWER(outbound.address) AS outbound
+`
+
+// FindSubjectMails returns the mails sent by or to an external address on any of the
+// user's addresses, in order: the mails they sent, all the replies on their threads and
+// archived mails whose card is gone. only the whole address counts, never mentions of
+// it in the text, which could be part of someone else's.
+func FindSubjectMails(userId, address string) (mails []SubjectMail, err error) {
+	address = strings.ToLower(address)
+
+	var onCards []SubjectMail
+	err = DB.Select(&onCards, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)<-[:LINKED_TO]-(c:Card)-[:CONTAINS]->(m:Mail)
+WHERE m.from = {1} OR (:Contact {address: {1}})-[:SENT|RECEIVED]->(m)
+WITH DISTINCT addr, c
+MATCH (addr)-[:SENDS_THROUGH]->(outbound:EmailAddress)
+MATCH (c)-[r:CONTAINS]->(m:Mail)
+OPTIONAL MATCH (addr)-[a:ARCHIVED]->(m)
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH addr, outbound, c, r, m, a, count(cm) = 0 AS inbound
+WHERE NOT inbound OR m.from = {1} OR (:Contact {address: {1}})-[:SENT]->(m)
+RETURN `+subjectMailFields, userId, address)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+
+	var archived []SubjectMail
+	err = DB.Select(&archived, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)-[a:ARCHIVED]->(m:Mail)
+WHERE NOT (m)<-[:CONTAINS]-(:Card)
+  AND (a.sender = {1} OR a.sender ENDS WITH {2} OR (:Contact {address: {1}})-[:SENT|RECEIVED]->(m))
+MATCH (addr)-[:SENDS_THROUGH]->(outbound:EmailAddress)
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH addr, outbound, null AS c, null AS r, m, a, count(cm) = 0 AS inbound
+RETURN `+subjectMailFields, userId, address, "<"+address+">")
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+	err = nil
+
+	// a mail on more than one card appears more than once
+	mails = make([]SubjectMail, 0, len(onCards)+len(archived))
+	seen := make(map[string]bool)
+	for _, m := range append(onCards, archived...) {
+		if seen[m.CardId+m.Id] {
+			continue
+		}
+		seen[m.CardId+m.Id] = true
+		mails = append(mails, m)
+	}
+	sort.Stable(byDate(mails))
+	return
+}
+
+type byDate []SubjectMail
+
+func (s byDate) Len() int           { return len(s) }
+func (s byDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDate) Less(i, j int) bool { return s[i].Date < s[j].Date }
+
+// EraseSubject anonymizes the given mails and removes the traces of the external
+// address from the user's addresses. the contact itself is only deleted when no other
+// user talks to them. returns the keys of the bodies the user's addresses had archived,
+// which are theirs alone and should be deleted.
+func EraseSubject(userId, address string, mailIds []string) (bodyKeys []string, err error) {
+	address = strings.ToLower(address)
+
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)
+MATCH (m:Mail) WHERE m.id IN {2} AND (
+  (addr)<-[:LINKED_TO]-(:Card)-[:CONTAINS]->(m) OR (addr)-[:ARCHIVED]->(m)
+)
+WITH DISTINCT m
+OPTIONAL MATCH (:Contact {address: {1}})-[r:SENT|RECEIVED]->(m)
+DELETE r
+REMOVE m.from, m.subject
+SET m.erased = TIMESTAMP()
+    `, userId, address, mailIds)
+	if err != nil {
+		return
+	}
+
+	bodyKeys = make([]string, 0)
+	err = DB.Select(&bodyKeys, `
+MATCH (:User {id: {0}})-[:CONTROLS]->(:EmailAddress)-[a:ARCHIVED]->(m:Mail)
+WHERE m.id IN {1}
+WITH a, a.body AS body
+DELETE a
+RETURN body
+    `, userId, mailIds)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return
+	}
+	err = nil
+
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[:CONTROLS]->(addr:EmailAddress)
+OPTIONAL MATCH (addr)-[ack:ACKNOWLEDGED]->(:Sender {address: {1}})
+OPTIONAL MATCH (addr)-[:NOTIFIES]->(:Endpoint)-[:ATTEMPTED]->(d:Delivery) WHERE d.payload =~ {2}
+DELETE ack
+SET d.payload = '{"erased":true}'
+    `, userId, address, "(?s).*"+helpers.MentionsAddress(address).String()+".*")
+	if err != nil {
+		return
+	}
+
+	_, err = DB.Exec(`
+OPTIONAL MATCH (s:Sender {address: {0}}) WHERE NOT (s)--()
+OPTIONAL MATCH (ct:Contact {address: {0}}) WHERE NOT (ct)--()
+DELETE s, ct
+    `, address)
+	return
+}
+
+type PrivacyRequest struct {
+	Id          string `json:"id"          db:"id"`
+	Kind        string `json:"kind"        db:"kind"` // "export" or "erasure"
+	SubjectHash string `json:"subjectHash" db:"subjectHash"`
+	Date        int64  `json:"date"        db:"date"`
+	Mails       int    `json:"mails"       db:"mails"`
+	Cards       int    `json:"cards"       db:"cards"`
+	Bodies      int    `json:"bodies"      db:"bodies"`
+	Trello      string `json:"trello"      db:"trello"` // what was done to the comments
+	Failures    int    `json:"failures"    db:"failures"`
+}
+
+// SavePrivacyRequest keeps the audit record of an export or erasure. the subject is
+// only identified by a hash, so the record doesn't undo the erasure.
+func SavePrivacyRequest(userId string, r PrivacyRequest) (err error) {
+	_, err = DB.Exec(`
+MATCH (u:User {id: {0}})
+CREATE (u)-[:REQUESTED]->(:PrivacyRequest {
+  id: {1},
+  kind: {2},
+  subjectHash: {3},
+  date: TIMESTAMP(),
+  mails: {4},
+  cards: {5},
+  bodies: {6},
+  trello: {7},
+  failures: {8}
+})
+    `, userId, r.Id, r.Kind, r.SubjectHash, r.Mails, r.Cards, r.Bodies, r.Trello, r.Failures)
+	return
+}
+
+// CompletePrivacyRequest records the outcome of a request saved before it was carried out.
+func CompletePrivacyRequest(userId string, r PrivacyRequest) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[:REQUESTED]->(r:PrivacyRequest {id: {1}})
+SET r.cards = {2}
+SET r.bodies = {3}
+SET r.failures = {4}
+    `, userId, r.Id, r.Cards, r.Bodies, r.Failures)
+	return
+}
+
+func ListPrivacyRequests(userId string) (requests []PrivacyRequest, err error) {
+	requests = make([]PrivacyRequest, 0)
+	err = DB.Select(&requests, `
+MATCH (:User {id: {0}})-[:REQUESTED]->(r:PrivacyRequest)
+RETURN
+  r.id AS id,
+  r.kind AS kind,
+  r.subjectHash AS subjectHash,
+  r.date AS date,
+  r.mails AS mails,
+  r.cards AS cards,
+  r.bodies AS bodies,
+  r.trello AS trello,
+  r.failures AS failures
+ORDER BY r.date DESC
+    `, userId)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return requests, nil
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bt/helpers"
+	"strings"
+	"time"
+)
+
+// mailgun posts a mail once for each of our addresses it was sent to, a receipt makes
+// each message go to each list only once, and lets the cards on different lists know
+// about each other.
+
+type Receipt struct {
+	Address       string `db:"address"`
+	CardShortLink string `db:"cardShortLink"`
+}
+
+// ClaimInboundMail tells if this post of the message should be handled for the list.
+// a claim that wasn't finished in the lease is given to the next post, so mailgun's
+// retries still work after a failure.
+func ClaimInboundMail(messageId, listId string, lease time.Duration) (claimed bool, err error) {
+	err = DB.Get(&claimed, `
+MERGE (r:Receipt {key: {0}})
+  ON CREATE SET
+    r.messageId = {1},
+    r.listId = {2},
+    r.date = 0,
+    r.done = false
+WITH r, NOT r.done AND r.date < TIMESTAMP() - {3} AS claimed
+SET r.date = CASE WHEN claimed THEN TIMESTAMP() ELSE r.date END
+RETURN claimed
+    `, messageId+" "+listId, messageId, listId, int64(lease/time.Millisecond))
+	return
+}
+
+// FinishInboundMail records the card a message went to on a list, and returns the
+// cards it went to on other lists that weren't told about this one yet.
+func FinishInboundMail(messageId, listId, address, cardShortLink string) (others []Receipt, err error) {
+	others = make([]Receipt, 0)
+	err = DB.Select(&others, `
+MATCH (r:Receipt {key: {0}})
+SET r.done = true,
+    r.address = {1},
+    r.card = {2}
+WITH r
+MATCH (o:Receipt {messageId: r.messageId})
+WHERE o <> r AND o.done AND o.card <> r.card AND NOT (o)-[:LINKED]-(r)
+MERGE (r)-[:LINKED]->(o)
+RETURN o.address AS address, o.card AS cardShortLink
+    `, messageId+" "+listId, strings.ToLower(address), cardShortLink)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return others, nil
+	}
+	return
+}
+
+// PruneReceipts forgets receipts older than the given time, mailgun doesn't post them
+// again after that.
+func PruneReceipts(before time.Time) (err error) {
+	_, err = DB.Exec(`
+MATCH (r:Receipt)
+WHERE r.date < {0}
+OPTIONAL MATCH (r)-[l:LINKED]-()
+DELETE l, r
+    `, before.UnixNano()/int64(time.Millisecond))
+	return
+}
+
+// InternalAddresses returns which of the addresses are ours, inbound, external
+// outbound addresses or aliases.
+func InternalAddresses(addresses []string) (internal []string, err error) {
+	internal = make([]string, 0)
+	if len(addresses) == 0 {
+		return
+	}
+	err = DB.Select(&internal, `
+UNWIND {0} AS address
+OPTIONAL MATCH (addr:EmailAddress {address: address})
+OPTIONAL MATCH (alias:Alias {address: address})
+WITH address, addr, alias WHERE addr IS NOT NULL OR alias IS NOT NULL
+RETURN address
+    `, addresses)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return internal, nil
+	}
+	return
+}
+
+// ExternalAddresses leaves out of a list of addresses the ones that belong to the owner
+// of the card, with or without plus tags, so we don't mail ourselves.
+func ExternalAddresses(cardShortLink string, addresses []string) (external []string, err error) {
+	if len(addresses) == 0 {
+		return addresses, nil
+	}
+
+	var ours []string
+	err = DB.Select(&ours, `
+MATCH (c:Card)-[:LINKED_TO]->(:EmailAddress)<-[:CONTROLS]-(u:User) WHERE c.shortLink = {0} OR c.id = {0}
+MATCH (u)-[:CONTROLS]->(addr:EmailAddress)
+OPTIONAL MATCH (addr)-[:SENDS_THROUGH]->(out:EmailAddress)
+OPTIONAL MATCH (addr)<-[:ALIAS_OF]-(alias:Alias)
+WITH collect(DISTINCT addr.address) + collect(DISTINCT LOWER(out.address)) + collect(DISTINCT alias.address) AS ours
+UNWIND ours AS address
+RETURN DISTINCT address
+    `, cardShortLink)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+	err = nil
+
+	isOurs := make(map[string]bool, len(ours))
+	for _, address := range ours {
+		isOurs[address] = true
+	}
+	external = make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		base, _ := helpers.SplitPlusTag(address)
+		if isOurs[base] {
+			continue
+		}
+		external = append(external, address)
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"strings"
+)
+
+// the user who created an address owns it, the members of the board where its list is
+// get a role according to their trello membership, and the owner may override that for
+// anyone by inviting or revoking them.
+
+type Role string
+
+const (
+	OWNER   Role = "owner"  // billing, deleting the address and managing members
+	ADMIN   Role = "admin"  // changing settings
+	AGENT   Role = "agent"  // working on the threads
+	VIEWER  Role = "viewer" // seeing the address
+	NO_ROLE Role = "none"   // also what revoked users get
+)
+
+var roleRanks = map[Role]int{NO_ROLE: 0, VIEWER: 1, AGENT: 2, ADMIN: 3, OWNER: 4}
+
+func (r Role) Can(needed Role) bool {
+	return roleRanks[r] >= roleRanks[needed]
+}
+
+// ValidGrant tells if a role can be given through an invite.
+func (r Role) ValidGrant() bool {
+	return r == ADMIN || r == AGENT || r == VIEWER
+}
+
+type Member struct {
+	UserId string `json:"userId" db:"userId"`
+	Role   Role   `json:"role"   db:"role"`
+	Source string `json:"source" db:"source"` // "owner", "board" or "invite"
+}
+
+// roleOf expects addr and owner to be bound and binds the role of the given user,
+// keeping only addr and owner. when a user is a member of the board more than once the
+// highest role counts.
+func roleOf(user string) string {
+	return `
+OPTIONAL MATCH (addr)<-[grant:HAS_ROLE]-(:User {id: ` + user + `})
+OPTIONAL MATCH (addr)-[:TARGETS]->(:List)<-[:CONTAINS]-(:Board)-[member:MEMBER]->(:User {id: ` + user + `})
+WITH addr, owner, grant,
+  max(CASE
+    WHEN member IS NULL THEN 0
+    WHEN member.admin THEN 3
+    WHEN member.observer THEN 1
+    ELSE 2
+  END) AS membership
+WITH addr, owner, CASE
+  WHEN owner.id = ` + user + ` THEN "owner"
+  WHEN grant IS NOT NULL THEN grant.role
+  WHEN membership = 3 THEN "admin"
+  WHEN membership = 2 THEN "agent"
+  WHEN membership = 1 THEN "viewer"
+  ELSE "none"
+END AS role
+`
+}
+
+func GetRole(userId, address string) (role Role, err error) {
+	err = DB.Get(&role, `
+MATCH (owner:User)-[:CONTROLS]->(addr:EmailAddress {address: {0}})
+`+roleOf("{1}")+`
+RETURN role
+    `, strings.ToLower(address), userId)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return NO_ROLE, nil
+	}
+	return
+}
+
+// ListMembers returns everybody with a role on the address, including revoked users.
+func ListMembers(address string) (members []Member, err error) {
+	members = make([]Member, 0)
+	err = DB.Select(&members, `
+MATCH (owner:User)-[:CONTROLS]->(addr:EmailAddress {address: {0}})
+OPTIONAL MATCH (addr)<-[grant:HAS_ROLE]-(invited:User)
+OPTIONAL MATCH (addr)-[:TARGETS]->(:List)<-[:CONTAINS]-(:Board)-[member:MEMBER]->(boardUser:User)
+WITH
+  [{userId: owner.id, role: "owner", source: "owner"}] +
+  collect(DISTINCT CASE WHEN invited IS NOT NULL THEN {userId: invited.id, role: grant.role, source: "invite"} END) +
+  collect(DISTINCT CASE WHEN boardUser IS NOT NULL THEN {
+    userId: boardUser.id,
+    role: CASE WHEN member.admin THEN "admin" WHEN member.observer THEN "viewer" ELSE "agent" END,
+    source: "board"
+  } END) AS everyone
+UNWIND everyone AS m
+RETURN m.userId AS userId, m.role AS role, m.source AS source
+    `, strings.ToLower(address))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return members, nil
+	}
+	if err != nil {
+		return
+	}
+
+	// the owner and invites win over board membership
+	seen := make(map[string]bool)
+	unique := make([]Member, 0, len(members))
+	for _, source := range []string{"owner", "invite", "board"} {
+		for _, m := range members {
+			if m.Source == source && !seen[m.UserId] {
+				seen[m.UserId] = true
+				unique = append(unique, m)
+			}
+		}
+	}
+	return unique, nil
+}
+
+// SetRole invites a user to the address with a role, or revokes them with NO_ROLE.
+// the owner's role can't be changed.
+func SetRole(address, userId string, role Role, grantedBy string) (err error) {
+	_, err = DB.Exec(`
+MATCH (owner:User)-[:CONTROLS]->(addr:EmailAddress {address: {0}})
+WHERE owner.id <> {1}
+MERGE (u:User {id: {1}})
+MERGE (u)-[grant:HAS_ROLE]->(addr)
+SET grant.role = {2},
+    grant.grantedBy = {3},
+    grant.date = TIMESTAMP()
+    `, strings.ToLower(address), userId, role, grantedBy)
+	return
+}
+
+// RemoveRole forgets an invite or revocation, the user is back to their board role.
+func RemoveRole(address, userId string) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User {id: {1}})-[grant:HAS_ROLE]->(:EmailAddress {address: {0}})
+DELETE grant
+    `, strings.ToLower(address), userId)
+	return
+}
+
+// ListBoardsWithAddresses returns the boards whose memberships matter to us.
+func ListBoardsWithAddresses() (boards []string, err error) {
+	boards = make([]string, 0)
+	err = DB.Select(&boards, `
+MATCH (b:Board)-[:CONTAINS]->(:List)<-[:TARGETS]-(:EmailAddress)
+RETURN DISTINCT b.shortLink
+    `)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return boards, nil
+	}
+	return
+}
+
+// SaveBoardMembers replaces the memberships of a board with the ones on trello, types
+// are trello's "admin", "normal" or "observer". only users we know are linked.
+func SaveBoardMembers(boardShortLink string, userIds, memberTypes []string) (err error) {
+	_, err = DB.Exec(`
+MATCH (b:Board {shortLink: {0}})
+OPTIONAL MATCH (b)-[old:MEMBER]->(u:User) WHERE NOT u.id IN {1}
+DELETE old
+WITH DISTINCT b
+UNWIND range(0, size({1}) - 1) AS i
+MATCH (u:User {id: {1}[i]})
+MERGE (b)-[m:MEMBER]->(u)
+SET m.admin = ({2}[i] = "admin"),
+    m.observer = ({2}[i] = "observer")
+    `, boardShortLink, userIds, memberTypes)
+	return
+}
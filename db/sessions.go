@@ -0,0 +1,112 @@
+package db
+
+import (
+	"time"
+)
+
+// a session is one login of a user, see sessions/sessions.go.
+
+type Session struct {
+	Id          string `db:"id"`
+	UserId      string `db:"userId"`
+	RefreshHash string `db:"refreshHash"`
+	TrelloToken string `db:"trelloToken"` // sealed
+	Expires     int64  `db:"expires"`
+}
+
+func CreateSession(s Session) (err error) {
+	_, err = DB.Exec(`
+MATCH (u:User {id: {0}})
+CREATE (u)-[:HAS_SESSION]->(:Session {
+  id: {1},
+  refreshHash: {2},
+  trelloToken: {3},
+  expires: {4},
+  date: TIMESTAMP(),
+  refreshed: TIMESTAMP()
+})
+    `, s.UserId, s.Id, s.RefreshHash, s.TrelloToken, s.Expires)
+	return
+}
+
+// GetSession returns nil for sessions that don't exist or have expired.
+func GetSession(id string) (*Session, error) {
+	session := Session{}
+	err := DB.Get(&session, `
+MATCH (u:User)-[:HAS_SESSION]->(s:Session {id: {0}})
+WHERE s.expires > TIMESTAMP()
+RETURN
+  s.id AS id,
+  u.id AS userId,
+  s.refreshHash AS refreshHash,
+  s.trelloToken AS trelloToken,
+  s.expires AS expires
+    `, id)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RefreshSession replaces the refresh token of a session, only if it is still the one
+// the client had, so each refresh token works once.
+func RefreshSession(id, oldHash, newHash, trelloToken string, expires int64) (refreshed bool, err error) {
+	err = DB.Get(&refreshed, `
+MATCH (s:Session {id: {0}, refreshHash: {1}})
+WHERE s.expires > TIMESTAMP()
+SET s.refreshHash = {2},
+    s.trelloToken = {3},
+    s.expires = {4},
+    s.refreshed = TIMESTAMP()
+RETURN true
+    `, id, oldHash, newHash, trelloToken, expires)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	}
+	return
+}
+
+func DeleteSession(userId, id string) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User {id: {0}})-[r:HAS_SESSION]->(s:Session {id: {1}})
+DELETE r, s
+    `, userId, id)
+	return
+}
+
+// DeleteSessions logs the user out everywhere, including from the jwts we used to give
+// before sessions, which can't be found but were issued before now.
+func DeleteSessions(userId string) (err error) {
+	_, err = DB.Exec(`
+MATCH (u:User {id: {0}})
+SET u.sessionsRevokedAt = TIMESTAMP()
+WITH u
+OPTIONAL MATCH (u)-[r:HAS_SESSION]->(s:Session)
+DELETE r, s
+    `, userId)
+	return
+}
+
+// SessionsRevokedAt is when the user last logged out everywhere, or 0.
+func SessionsRevokedAt(userId string) (revokedAt int64, err error) {
+	err = DB.Get(&revokedAt, `
+MATCH (u:User {id: {0}})
+RETURN CASE WHEN u.sessionsRevokedAt IS NOT NULL THEN u.sessionsRevokedAt ELSE 0 END
+    `, userId)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return 0, nil
+	}
+	return
+}
+
+func PruneSessions(before time.Time) (err error) {
+	_, err = DB.Exec(`
+MATCH (:User)-[r:HAS_SESSION]->(s:Session)
+WHERE s.expires < {0}
+DELETE r, s
+    `, before.UnixNano()/int64(time.Millisecond))
+	return
+}
@@ -0,0 +1,124 @@
+package db
+
+// MovedMail is a mail that went to another card when merging or splitting threads.
+type MovedMail struct {
+	Id        string `db:"id"`
+	Date      int64  `db:"date"`
+	Subject   string `db:"subject"`
+	From      string `db:"from"`
+	CommentId string `db:"commentId"`
+	Body      string `db:"body"`
+	Inbound   bool   `db:"inbound"`
+}
+
+const movedMailFields = `
+  m.id AS id,
+  m.date AS date,
+  CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE "" END AS subject,
+  CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
+  CASE WHEN r.commentId IS NOT NULL THEN r.commentId WHEN m.commentId IS NOT NULL THEN m.commentId ELSE "" END AS commentId,
+  CASE WHEN archived IS NOT NULL THEN archived.body ELSE "" END AS body,
+  inbound
+`
+
+// MergeCards moves all the mails of source under target, so replies to either thread
+// land on target, and returns them in order. both cards must be on the same address and
+// target can't have been merged itself.
+func MergeCards(source, target string) (mails []MovedMail, err error) {
+	mails = make([]MovedMail, 0)
+	err = DB.Select(&mails, `
+MATCH (addr:EmailAddress)<-[:LINKED_TO]-(b:Card) WHERE b.shortLink = {0} OR b.id = {0}
+MATCH (addr)<-[:LINKED_TO]-(a:Card) WHERE (a.shortLink = {1} OR a.id = {1}) AND a <> b AND a.mergedInto IS NULL
+SET b.mergedInto = a.shortLink
+WITH addr, a, b
+MATCH (b)-[old:CONTAINS]->(m:Mail)
+MERGE (a)-[r:CONTAINS]->(m)
+SET r.commentId = old.commentId, r.arrivedOn = old.arrivedOn, r.plusTag = old.plusTag
+DELETE old
+WITH addr, m, r
+OPTIONAL MATCH (addr)-[archived:ARCHIVED]->(m)
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH m, r, archived, count(cm) = 0 AS inbound
+RETURN `+movedMailFields+`
+ORDER BY m.date
+    `, source, target)
+	return
+}
+
+// GetMergedInto returns the shortLink of the card this one was merged into, if any.
+func GetMergedInto(card string) (target string, err error) {
+	err = DB.Get(&target, `
+MATCH (c:Card) WHERE c.shortLink = {0} OR c.id = {0}
+RETURN CASE WHEN c.mergedInto IS NOT NULL THEN c.mergedInto ELSE "" END
+    `, card)
+	return
+}
+
+type SplitPoint struct {
+	Address string `db:"address"`
+	MailId  string `db:"mailId"`
+	Subject string `db:"subject"`
+	From    string `db:"from"`
+	Date    int64  `db:"date"`
+}
+
+// GetSplitPoint finds an inbound message of a card by its id or the id of its comment.
+func GetSplitPoint(card, message string) (point SplitPoint, err error) {
+	err = DB.Get(&point, `
+MATCH (addr:EmailAddress)<-[:LINKED_TO]-(c:Card)-[r:CONTAINS]->(m:Mail)
+WHERE (c.shortLink = {0} OR c.id = {0})
+  AND (m.id = {1} OR r.commentId = {1} OR m.commentId = {1})
+  AND NOT m.id =~ "fake-.*"
+  AND NOT (m)<-[:COMMENTED]-(:User)
+RETURN
+  addr.address AS address,
+  m.id AS mailId,
+  CASE WHEN m.subject IS NOT NULL THEN m.subject ELSE "" END AS subject,
+  CASE WHEN m.from IS NOT NULL THEN m.from ELSE "" END AS from,
+  m.date AS date
+LIMIT 1
+    `, card, message)
+	return
+}
+
+// RefreshLastMail sets again what a card keeps about its last inbound mail, after mails
+// were moved in or out of it, and tells if the last mail of the thread is inbound.
+func RefreshLastMail(card string) (lastInbound bool, err error) {
+	err = DB.Get(&lastInbound, `
+MATCH (c:Card)-[r:CONTAINS]->(m:Mail) WHERE c.shortLink = {0} OR c.id = {0}
+OPTIONAL MATCH (m)<-[cm:COMMENTED]-(:User)
+WITH c, r, m, count(cm) = 0 AS inbound ORDER BY m.date DESC
+WITH c, collect({arrival: r, inbound: inbound}) AS mails
+WITH c, head(mails).inbound AS lastInbound,
+  head(filter(x IN mails WHERE x.inbound)) AS lastIn,
+  head(filter(x IN mails WHERE x.inbound AND x.arrival.plusTag IS NOT NULL AND x.arrival.plusTag <> "")) AS tagged
+SET c.arrivedOn = lastIn.arrival.arrivedOn
+SET c.plusTag = tagged.arrival.plusTag
+RETURN lastInbound
+    `, card)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	}
+	return
+}
+
+// SplitMails moves a message and the later ones from the same sender to another card.
+func SplitMails(source, target, mailId string) (mails []MovedMail, err error) {
+	mails = make([]MovedMail, 0)
+	err = DB.Select(&mails, `
+MATCH (addr:EmailAddress)<-[:LINKED_TO]-(src:Card)-[:CONTAINS]->(first:Mail {id: {2}})
+WHERE src.shortLink = {0} OR src.id = {0}
+MATCH (dst:Card) WHERE dst.shortLink = {1} OR dst.id = {1}
+MATCH (src)-[old:CONTAINS]->(m:Mail)
+WHERE m.date >= first.date AND m.from = first.from AND NOT (m)<-[:COMMENTED]-(:User)
+MERGE (dst)-[r:CONTAINS]->(m)
+SET r.commentId = old.commentId, r.arrivedOn = old.arrivedOn, r.plusTag = old.plusTag
+DELETE old
+WITH addr, m, r
+OPTIONAL MATCH (addr)-[archived:ARCHIVED]->(m)
+WITH m, r, archived, true AS inbound
+RETURN `+movedMailFields+`
+ORDER BY m.date
+    `, source, target, mailId)
+	return
+}
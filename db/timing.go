@@ -0,0 +1,41 @@
+package db
+
+import (
+	"bt/metrics"
+	"database/sql"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// timedDB is sqlx.DB with the queries timed by the name of the function
+// making them, which is a good enough operation name.
+type timedDB struct {
+	*sqlx.DB
+}
+
+func (db timedDB) Get(dest interface{}, query string, args ...interface{}) error {
+	defer metrics.ExternalCallDuration.Since(time.Now(), "neo4j", caller())
+	return db.DB.Get(dest, query, args...)
+}
+
+func (db timedDB) Select(dest interface{}, query string, args ...interface{}) error {
+	defer metrics.ExternalCallDuration.Since(time.Now(), "neo4j", caller())
+	return db.DB.Select(dest, query, args...)
+}
+
+func (db timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer metrics.ExternalCallDuration.Since(time.Now(), "neo4j", caller())
+	return db.DB.Exec(query, args...)
+}
+
+func caller() string {
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	name := runtime.FuncForPC(pc).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
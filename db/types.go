@@ -1,13 +1,17 @@
 package db
 
 import (
+	"bt/calendar"
 	"bt/mailgun"
+	"encoding/json"
+	"sort"
 	"time"
 )
 
 type Account struct {
-	LastMessages []Email   `json:"lastMessages"`
-	Addresses    []Address `json:"addresses"`
+	LastMessages    []Email   `json:"lastMessages"`
+	Addresses       []Address `json:"addresses"`
+	AnalyticsOptOut bool      `json:"analyticsOptOut"`
 }
 
 type addressStatus string
@@ -18,25 +22,51 @@ const (
 	DISABLED addressStatus = "DISABLED"
 )
 
+type threadingMode string
+
+const (
+	NEW_CARD threadingMode = "new"    // never reopen, replies to archived or expired threads get a new card
+	REOPEN   threadingMode = "reopen" // reopen (and unarchive) the card if the thread is recent enough
+	LINK     threadingMode = "link"   // like REOPEN, but archived cards get a new card linked to them
+)
+
+const DEFAULT_REOPEN_DAYS = 15
+
 type Address struct {
-	Start              int64           `json:"-"                db:"date"`
-	UserId             string          `json:"-"                db:"userId"`
-	BoardShortLink     string          `json:"boardShortLink"   db:"boardShortLink"`
-	ListId             string          `json:"listId"           db:"listId"`
-	InboundAddr        string          `json:"inboundaddr"      db:"inboundaddr"`
-	OutboundAddr       string          `json:"outboundaddr"     db:"outboundaddr"`
-	RouteId            string          `json:"-"                db:"routeId"`
-	DomainName         string          `json:"-"                db:"domain"`
-	DomainStatus       *mailgun.Domain `json:"domain,omitempty"`
-	PaypalProfileId    string          `json:"-"                db:"paypalProfileId"`
-	Status             addressStatus   `json:"status"`
-	SenderNameSetting  string          `json:"-"                db:"senderName"`
-	ReplyToSetting     string          `json:"-"                db:"replyTo"`
-	AddReplierSetting  bool            `json:"-"                db:"addReplier"`
-	SignatureSetting   string          `json:"-"                db:"signatureTemplate"`
-	MessageDescSetting bool            `json:"-"                db:"messageInDesc"`
-	MoveToTopSetting   bool            `json:"-"                db:"moveToTop"`
-	Settings           AddressSettings `json:"settings"`
+	Start                  int64           `json:"-"                db:"date"`
+	UserId                 string          `json:"-"                db:"userId"`
+	Role                   Role            `json:"role"             db:"role"` // of the user who asked for it
+	BoardShortLink         string          `json:"boardShortLink"   db:"boardShortLink"`
+	ListId                 string          `json:"listId"           db:"listId"`
+	InboundAddr            string          `json:"inboundaddr"      db:"inboundaddr"`
+	OutboundAddr           string          `json:"outboundaddr"     db:"outboundaddr"`
+	RouteId                string          `json:"-"                db:"routeId"`
+	DomainName             string          `json:"-"                db:"domain"`
+	DomainStatus           *mailgun.Domain `json:"domain,omitempty"`
+	PaypalProfileId        string          `json:"-"                db:"paypalProfileId"`
+	Status                 addressStatus   `json:"status"`
+	SenderNameSetting      string          `json:"-"                db:"senderName"`
+	ReplyToSetting         string          `json:"-"                db:"replyTo"`
+	AddReplierSetting      bool            `json:"-"                db:"addReplier"`
+	SignatureSetting       string          `json:"-"                db:"signatureTemplate"`
+	MessageDescSetting     bool            `json:"-"                db:"messageInDesc"`
+	MoveToTopSetting       bool            `json:"-"                db:"moveToTop"`
+	ThreadingSetting       threadingMode   `json:"-"                db:"threadingMode"`
+	ReopenDaysSetting      int             `json:"-"                db:"reopenDays"`
+	FirstResponseSetting   int             `json:"-"                db:"firstResponseHours"`
+	NextResponseSetting    int             `json:"-"                db:"nextResponseHours"`
+	TimeZoneSetting        string          `json:"-"                db:"timezone"`
+	BusinessHoursSetting   string          `json:"-"                db:"businessHours"`
+	HolidaysSetting        []string        `json:"-"                db:"holidays"`
+	AutoAckSetting         bool            `json:"-"                db:"autoAck"`
+	AutoAckTemplateSetting string          `json:"-"                db:"autoAckTemplate"`
+	TicketTagSetting       string          `json:"-"                db:"ticketTag"`
+	RemindersSetting       string          `json:"-"                db:"reminders"`
+	StatusesSetting        string          `json:"-"                db:"statuses"`
+	CustomerReplySetting   string          `json:"-"                db:"customerReplyList"`
+	AgentReplySetting      string          `json:"-"                db:"agentReplyList"`
+	PlusTagsSetting        string          `json:"-"                db:"plusTags"`
+	Settings               AddressSettings `json:"settings"`
 }
 
 func (addr *Address) StartTime() time.Time {
@@ -51,12 +81,50 @@ func (addr *Address) PostProcess() {
 	addr.Settings.MessageInDesc = addr.MessageDescSetting
 	addr.Settings.SignatureTemplate = addr.SignatureSetting
 	addr.Settings.MoveToTop = addr.MoveToTopSetting
+	addr.Settings.ThreadingMode = addr.ThreadingSetting
+	addr.Settings.ReopenDays = addr.ReopenDaysSetting
+	addr.Settings.FirstResponseHours = addr.FirstResponseSetting
+	addr.Settings.NextResponseHours = addr.NextResponseSetting
+	addr.Settings.TimeZone = addr.TimeZoneSetting
+	if addr.BusinessHoursSetting != "" {
+		json.Unmarshal([]byte(addr.BusinessHoursSetting), &addr.Settings.BusinessHours)
+	}
+	addr.Settings.Holidays = addr.HolidaysSetting
+	addr.Settings.AutoAck = addr.AutoAckSetting
+	addr.Settings.AutoAckTemplate = addr.AutoAckTemplateSetting
+	addr.Settings.TicketTag = addr.TicketTagSetting
+	if addr.RemindersSetting != "" {
+		json.Unmarshal([]byte(addr.RemindersSetting), &addr.Settings.Reminders)
+	}
+	addr.Settings.CustomerReplyList = addr.CustomerReplySetting
+	addr.Settings.AgentReplyList = addr.AgentReplySetting
+	if addr.StatusesSetting != "" {
+		json.Unmarshal([]byte(addr.StatusesSetting), &addr.Settings.Statuses)
+	}
+	if addr.PlusTagsSetting != "" {
+		json.Unmarshal([]byte(addr.PlusTagsSetting), &addr.Settings.PlusTags)
+	}
 	addr.SenderNameSetting = ""
 	addr.ReplyToSetting = ""
 	addr.AddReplierSetting = false
 	addr.MessageDescSetting = false
 	addr.SignatureSetting = ""
 	addr.MoveToTopSetting = false
+	addr.ThreadingSetting = ""
+	addr.ReopenDaysSetting = 0
+	addr.FirstResponseSetting = 0
+	addr.NextResponseSetting = 0
+	addr.TimeZoneSetting = ""
+	addr.BusinessHoursSetting = ""
+	addr.HolidaysSetting = nil
+	addr.AutoAckSetting = false
+	addr.AutoAckTemplateSetting = ""
+	addr.TicketTagSetting = ""
+	addr.RemindersSetting = ""
+	addr.StatusesSetting = ""
+	addr.CustomerReplySetting = ""
+	addr.AgentReplySetting = ""
+	addr.PlusTagsSetting = ""
 
 	// status
 	if addr.PaypalProfileId != "" {
@@ -69,12 +137,66 @@ func (addr *Address) PostProcess() {
 }
 
 type AddressSettings struct {
-	SenderName        string `json:"senderName"`
-	ReplyTo           string `json:"replyTo"`
-	AddReplier        bool   `json:"addReplier"`
-	MessageInDesc     bool   `json:"messageInDesc"`
-	SignatureTemplate string `json:"signatureTemplate"`
-	MoveToTop         bool   `json:"moveToTop"`
+	SenderName         string                           `json:"senderName"`
+	ReplyTo            string                           `json:"replyTo"`
+	AddReplier         bool                             `json:"addReplier"`
+	MessageInDesc      bool                             `json:"messageInDesc"`
+	SignatureTemplate  string                           `json:"signatureTemplate"`
+	MoveToTop          bool                             `json:"moveToTop"`
+	ThreadingMode      threadingMode                    `json:"threadingMode"`
+	ReopenDays         int                              `json:"reopenDays"`
+	FirstResponseHours int                              `json:"firstResponseHours"` // 0 means no SLA
+	NextResponseHours  int                              `json:"nextResponseHours"`  // 0 means no SLA
+	TimeZone           string                           `json:"timezone"`
+	BusinessHours      map[string][]calendar.Span       `json:"businessHours"` // empty means always open
+	Holidays           []string                         `json:"holidays"`
+	AutoAck            bool                             `json:"autoAck"`         // acknowledge new threads automatically
+	AutoAckTemplate    string                           `json:"autoAckTemplate"` // may take variables, empty means the default
+	TicketTag          string                           `json:"ticketTag"`       // outbound subjects get "[TicketTag #1234]", empty for none
+	Reminders          []Reminder                       `json:"reminders"`
+	Statuses           map[ThreadStatus]StatusPlacement `json:"statuses"`          // how each status shows on the board
+	CustomerReplyList  string                           `json:"customerReplyList"` // where cards go when the customer replies, empty to stay
+	AgentReplyList     string                           `json:"agentReplyList"`    // where cards go when we reply, empty to stay
+	PlusTags           map[string]PlusTagRoute          `json:"plusTags"`          // what to do with mail to address+tag@
+}
+
+type ThreadStatus string
+
+const (
+	NEW                 ThreadStatus = "new"                 // no reply from us yet
+	WAITING_ON_US       ThreadStatus = "waiting-on-us"       // the customer wrote last
+	WAITING_ON_CUSTOMER ThreadStatus = "waiting-on-customer" // we wrote last
+	CLOSED              ThreadStatus = "closed"              // the card was archived
+)
+
+// StatusPlacement is a label to apply and/or a list to move the card to
+// when a thread gets some status.
+type StatusPlacement struct {
+	Label  string `json:"label"`
+	ListId string `json:"listId"`
+}
+
+// PlusTagRoute is what happens to a thread that arrives on address+tag@: a label to
+// apply, a member to add and/or a list where the card is created instead.
+type PlusTagRoute struct {
+	Label    string `json:"label"`
+	MemberId string `json:"memberId"`
+	ListId   string `json:"listId"`
+}
+
+type reminderAction string
+
+const (
+	MENTION     reminderAction = "mention" // mention the card members in a comment
+	OVERDUE     reminderAction = "label"   // apply the "overdue" label
+	MOVE_TO_TOP reminderAction = "top"     // move the card to the top of the list
+)
+
+// Reminder is an action taken when a thread has been waiting for our reply
+// for some (business) hours.
+type Reminder struct {
+	Hours  int            `json:"hours"`
+	Action reminderAction `json:"action"`
 }
 
 type Email struct {
@@ -101,14 +223,150 @@ type sendingParams struct {
 	SenderName        string   `db:"senderName"`
 	AddReplier        bool     `db:"addReplier"` // it is used in the mailgun success callback
 	SignatureTemplate string   `db:"signatureTemplate"`
+	Ticket            int      `db:"ticket"`
+	TicketTag         string   `db:"ticketTag"`
+	AgentReplyList    string   `db:"agentReplyList"`
+	SendAs            string   `db:"sendAs"` // the alias replies go out from, if not the address itself
+	PlusTag           string   `db:"plusTag"`
 }
 
 type receivingParams struct {
-	MessageInDesc bool `db:"messageInDesc"`
-	MoveToTop     bool `db:"moveToTop"`
+	MessageInDesc      bool          `db:"messageInDesc"`
+	MoveToTop          bool          `db:"moveToTop"`
+	ThreadingMode      threadingMode `db:"threadingMode"`
+	AutoAck            bool          `db:"autoAck"`
+	AutoAckTemplate    string        `db:"autoAckTemplate"`
+	FirstResponseHours int           `db:"firstResponseHours"` // for telling the expected response time
+	CustomerReplyList  string        `db:"customerReplyList"`
+	PlusTagsJSON       string        `db:"plusTags"`
+}
+
+// PlusTag returns the route for a tag, unknown tags have none.
+func (p receivingParams) PlusTag(tag string) (route PlusTagRoute, ok bool) {
+	if tag == "" || p.PlusTagsJSON == "" {
+		return
+	}
+	var routes map[string]PlusTagRoute
+	if err := json.Unmarshal([]byte(p.PlusTagsJSON), &routes); err != nil {
+		return
+	}
+	route, ok = routes[tag]
+	return
 }
 
 type ThreadParams struct {
 	ReplyTo string `yaml:"reply-to"`
 	Subject string `yaml:"subject"`
 }
+
+type slaParams struct {
+	Address            string `db:"address"`
+	FirstResponseHours int    `db:"firstResponseHours"`
+	NextResponseHours  int    `db:"nextResponseHours"`
+}
+
+type calendarParams struct {
+	TimeZone      string   `db:"timezone"`
+	BusinessHours string   `db:"businessHours"`
+	Holidays      []string `db:"holidays"`
+}
+
+func (p calendarParams) Calendar() (*calendar.Calendar, error) {
+	var hours map[string][]calendar.Span
+	if p.BusinessHours != "" {
+		err := json.Unmarshal([]byte(p.BusinessHours), &hours)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return calendar.New(p.TimeZone, hours, p.Holidays)
+}
+
+type ThreadMessage struct {
+	Id      string `db:"id"`
+	Date    int64  `db:"date"`
+	Inbound bool   `db:"inbound"`
+}
+
+func (m *ThreadMessage) Time() time.Time {
+	return time.Unix(m.Date/1000, 0)
+}
+
+type reportMessage struct {
+	Thread  string `db:"thread"`
+	Date    int64  `db:"date"`
+	Inbound bool   `db:"inbound"`
+	From    string `db:"from"`
+	Member  string `db:"member"`
+}
+
+type ThreadSLA struct {
+	CardShortLink string `json:"cardShortLink" db:"cardShortLink"`
+	CardId        string `json:"-"             db:"cardId"`
+	Address       string `json:"address"       db:"address"`
+	Kind          string `json:"kind"          db:"kind"`
+	WaitingSince  int64  `json:"waitingSince"  db:"waitingSince"`
+	Due           int64  `json:"due"           db:"due"`
+	BreachedAt    int64  `json:"breachedAt"    db:"breachedAt"`
+	Breached      bool   `json:"breached"`
+}
+
+func (t *ThreadSLA) DueTime() time.Time {
+	return time.Unix(t.Due/1000, 0)
+}
+
+func (t *ThreadSLA) PostProcess() {
+	t.Breached = t.Due != 0 && time.Now().Unix()*1000 > t.Due
+}
+
+type AwaitingThread struct {
+	CardShortLink string `db:"cardShortLink"`
+	CardId        string `db:"cardId"`
+	Address       string `db:"address"`
+	RemindersJSON string `db:"reminders"`
+	MailId        string `db:"mailId"`
+	MailDate      int64  `db:"mailDate"`
+	Level         int    `db:"level"` // how many reminders were already acted upon for this mail
+}
+
+func (t AwaitingThread) Since() time.Time {
+	return time.Unix(t.MailDate/1000, 0)
+}
+
+// Reminders returns the reminders for the thread's address, sorted by hours.
+func (t AwaitingThread) Reminders() ([]Reminder, error) {
+	var reminders []Reminder
+	err := json.Unmarshal([]byte(t.RemindersJSON), &reminders)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(byHours(reminders))
+	return reminders, nil
+}
+
+type byHours []Reminder
+
+func (r byHours) Len() int           { return len(r) }
+func (r byHours) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byHours) Less(i, j int) bool { return r[i].Hours < r[j].Hours }
+
+type ThreadState struct {
+	CardShortLink string       `json:"cardShortLink" db:"cardShortLink"`
+	Address       string       `json:"address"       db:"address"`
+	Ticket        int          `json:"ticket"        db:"ticket"`
+	Status        ThreadStatus `json:"status"        db:"status"`
+	Since         int64        `json:"since"         db:"since"`
+}
+
+type statusChange struct {
+	Previous     ThreadStatus `db:"previous"`
+	Current      ThreadStatus `db:"current"`
+	StatusesJSON string       `db:"statuses"`
+}
+
+func (c statusChange) Placements() (placements map[ThreadStatus]StatusPlacement, err error) {
+	if c.StatusesJSON != "" {
+		err = json.Unmarshal([]byte(c.StatusesJSON), &placements)
+	}
+	return
+}
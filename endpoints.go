@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bt/db"
+	"bt/hooks"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// endpoints are the urls our users want to hear from us at, see hooks/ and flows.go.
+
+const MAX_ENDPOINTS = 10
+
+func GetEndpoints(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	endpoints, err := db.ListEndpoints(userId, vars["address"]+"@"+settings.BaseDomain)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if endpoints == nil {
+		endpoints = make([]db.Endpoint, 0)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
+
+func CreateEndpoint(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   registers an https url to receive the given events, all of them when none are given.
+	   the secret used to sign the payloads is only shown here.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	data := struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	// validation
+	if err := hooks.CheckURL(data.URL); err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	if data.Events == nil {
+		data.Events = make([]string, 0)
+	}
+	for _, event := range data.Events {
+		if !hooks.ValidEvent(event) {
+			sendJSONError(w, fmt.Errorf("unknown event %s", event), 400, logger)
+			return
+		}
+	}
+
+	existing, err := db.ListEndpoints(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if len(existing) >= MAX_ENDPOINTS {
+		sendJSONError(w, errors.New("too many endpoints for this address"), 400, logger)
+		return
+	}
+
+	secret := hooks.NewSecret()
+	sealed, err := keyring.Seal(secret)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	endpoint, err := db.CreateEndpoint(userId, address, hooks.NewId(), data.URL, sealed, data.Events)
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+	endpoint.Secret = secret
+
+	logger.WithFields(log.Fields{
+		"user":     userId,
+		"address":  address,
+		"endpoint": endpoint.Id,
+		"url":      endpoint.URL,
+	}).Info("created endpoint")
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func DeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	err := db.DeleteEndpoint(userId, vars["address"]+"@"+settings.BaseDomain, vars["endpoint"])
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func GetEndpointDeliveries(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   the most recent deliveries to this endpoint, ?limit= of them (50 by default)
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 500 {
+			sendJSONError(w, errors.New("limit must be a number between 1 and 500"), 400, logger)
+			return
+		}
+	}
+
+	if _, err := db.GetEndpoint(userId, address, vars["endpoint"]); err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	deliveries, err := db.ListDeliveries(userId, address, vars["endpoint"], limit)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if deliveries == nil {
+		deliveries = make([]db.Delivery, 0)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func PingEndpoint(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   sends a "ping" event right now and tells how it went. it is not retried.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	endpoint, err := db.GetEndpoint(userId, address, vars["endpoint"])
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	delivery, err := queueDelivery(*endpoint, address, hooks.PING, struct {
+		Message string `json:"message"`
+	}{"this is a test sent from boardthreads."})
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	result := attemptDelivery(delivery, false)
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Id         string `json:"id"`
+		Ok         bool   `json:"ok"`
+		StatusCode int    `json:"statusCode"`
+		Error      string `json:"error"`
+	}{delivery.Id, result.Ok(), result.StatusCode, result.Error})
+}
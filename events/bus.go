@@ -0,0 +1,83 @@
+package events
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const QUEUE_SIZE = 1000
+
+// Bus takes events from handlers and delivers them to the sinks in the
+// background, so a slow sink never holds a request.
+type Bus struct {
+	sinks    []Sink
+	optedOut func(userId string) (bool, error)
+	queue    chan Event
+	done     sync.WaitGroup
+}
+
+// NewBus starts delivering to sinks. optedOut, if not nil, is asked about the
+// user of each event before it goes anywhere.
+func NewBus(optedOut func(userId string) (bool, error), sinks ...Sink) *Bus {
+	b := &Bus{
+		sinks:    sinks,
+		optedOut: optedOut,
+		queue:    make(chan Event, QUEUE_SIZE),
+	}
+	b.done.Add(1)
+	go b.loop()
+	return b
+}
+
+func (b *Bus) Publish(e Event) {
+	if b == nil || len(b.sinks) == 0 {
+		return
+	}
+
+	select {
+	case b.queue <- e:
+	default:
+		log.WithField("event", e.Name()).Warn("analytics queue is full, dropping event")
+	}
+}
+
+// Close delivers what is still queued and closes the sinks.
+func (b *Bus) Close() {
+	close(b.queue)
+	b.done.Wait()
+	for _, sink := range b.sinks {
+		sink.Close()
+	}
+}
+
+func (b *Bus) loop() {
+	defer b.done.Done()
+
+	for e := range b.queue {
+		if b.optedOut != nil && e.User() != "" {
+			out, err := b.optedOut(e.User())
+			if err != nil {
+				// when in doubt, don't track
+				log.WithFields(log.Fields{
+					"err":  err.Error(),
+					"user": e.User(),
+				}).Warn("couldn't check if user opted out of analytics")
+				continue
+			}
+			if out {
+				continue
+			}
+		}
+
+		for _, sink := range b.sinks {
+			if err := sink.Send(e); err != nil {
+				log.WithFields(log.Fields{
+					"err":   err.Error(),
+					"event": e.Name(),
+					"sink":  sink.Name(),
+				}).Warn("couldn't deliver analytics event")
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package events
+
+import "encoding/json"
+
+// Event is something that happened and may be of interest to analytics.
+// names are the same ones we always sent to segment, so old dashboards keep working.
+type Event interface {
+	Name() string
+	User() string
+}
+
+type UserSignedUp struct {
+	UserId   string `json:"-"`
+	Username string `json:"username"`
+	FullName string `json:"name"`
+	Avatar   string `json:"avatar"`
+}
+
+type AddressCreated struct {
+	UserId  string `json:"-"`
+	Address string `json:"address"`
+	ListId  string `json:"listId"`
+	BoardId string `json:"boardId"`
+}
+
+type SettingsChanged struct {
+	UserId   string      `json:"-"`
+	Address  string      `json:"address"`
+	Settings interface{} `json:"settings"`
+}
+
+type AddressDeleted struct {
+	UserId  string `json:"-"`
+	Address string `json:"address"`
+}
+
+type SubscriptionStarted struct {
+	UserId   string `json:"-"`
+	Address  string `json:"address"`
+	Provider string `json:"provider"`
+}
+
+type SubscriptionCreated struct {
+	UserId   string `json:"-"`
+	Address  string `json:"address"`
+	Provider string `json:"provider"`
+	Value    int    `json:"value"`
+}
+
+type SubscriptionCancelled struct {
+	UserId   string `json:"-"`
+	Address  string `json:"address"`
+	Provider string `json:"provider"`
+}
+
+type MailReceived struct {
+	UserId  string `json:"-"`
+	Address string `json:"address"`
+	Card    string `json:"card"`
+	From    string `json:"from"`
+}
+
+type MailSent struct {
+	UserId  string   `json:"-"`
+	Address string   `json:"address"`
+	Card    string   `json:"card"`
+	To      []string `json:"to"`
+}
+
+type OutboundThreadCreated struct {
+	UserId  string `json:"-"`
+	Address string `json:"address"`
+	Card    string `json:"card"`
+	To      string `json:"to"`
+}
+
+func (e UserSignedUp) Name() string          { return "Signed up" }
+func (e AddressCreated) Name() string        { return "Created address" }
+func (e SettingsChanged) Name() string       { return "Changed settings" }
+func (e AddressDeleted) Name() string        { return "Deleted address" }
+func (e SubscriptionStarted) Name() string   { return "Started subscription creation" }
+func (e SubscriptionCreated) Name() string   { return "Created subscription" }
+func (e SubscriptionCancelled) Name() string { return "Cancelled subscription" }
+func (e MailReceived) Name() string          { return "Received mail" }
+func (e MailSent) Name() string              { return "Sent mail" }
+func (e OutboundThreadCreated) Name() string { return "Created outbound email thread" }
+
+func (e UserSignedUp) User() string          { return e.UserId }
+func (e AddressCreated) User() string        { return e.UserId }
+func (e SettingsChanged) User() string       { return e.UserId }
+func (e AddressDeleted) User() string        { return e.UserId }
+func (e SubscriptionStarted) User() string   { return e.UserId }
+func (e SubscriptionCreated) User() string   { return e.UserId }
+func (e SubscriptionCancelled) User() string { return e.UserId }
+func (e MailReceived) User() string          { return e.UserId }
+func (e MailSent) User() string              { return e.UserId }
+func (e OutboundThreadCreated) User() string { return e.UserId }
+
+// Properties are the fields of the event as a plain map, which is what most sinks want.
+func Properties(e Event) map[string]interface{} {
+	props := make(map[string]interface{})
+	b, err := json.Marshal(e)
+	if err != nil {
+		return props
+	}
+	json.Unmarshal(b, &props)
+	return props
+}
@@ -0,0 +1,151 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+type memorySink struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+}
+
+func (s *memorySink) Name() string { return "memory" }
+func (s *memorySink) Send(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestEvents(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("events", func() {
+
+		g.It("should turn events into properties", func() {
+			props := Properties(MailSent{
+				UserId:  "u1",
+				Address: "help@example.com",
+				Card:    "c1",
+				To:      []string{"someone@example.com"},
+			})
+			Expect(props).To(HaveLen(3))
+			Expect(props["address"]).To(Equal("help@example.com"))
+			Expect(props["card"]).To(Equal("c1"))
+			Expect(props["to"]).To(ConsistOf("someone@example.com"))
+		})
+
+		g.It("should deliver events to all sinks", func() {
+			a, b := &memorySink{}, &memorySink{}
+			bus := NewBus(nil, a, b)
+			bus.Publish(AddressDeleted{UserId: "u1", Address: "x@example.com"})
+			bus.Publish(AddressDeleted{UserId: "u2", Address: "y@example.com"})
+			bus.Close()
+
+			Expect(a.events).To(HaveLen(2))
+			Expect(b.events).To(Equal(a.events))
+			Expect(a.closed).To(BeTrue())
+		})
+
+		g.It("should skip users that opted out, or that we can't tell", func() {
+			sink := &memorySink{}
+			bus := NewBus(func(userId string) (bool, error) {
+				switch userId {
+				case "out":
+					return true, nil
+				case "broken":
+					return false, errors.New("db is down")
+				}
+				return false, nil
+			}, sink)
+			bus.Publish(MailReceived{UserId: "out"})
+			bus.Publish(MailReceived{UserId: "broken"})
+			bus.Publish(MailReceived{UserId: "in"})
+			bus.Close()
+
+			Expect(sink.events).To(HaveLen(1))
+			Expect(sink.events[0].User()).To(Equal("in"))
+		})
+
+		g.It("should not mind a bus without sinks", func() {
+			var nobus *Bus
+			nobus.Publish(AddressDeleted{UserId: "u1"})
+
+			bus := NewBus(nil)
+			bus.Publish(AddressDeleted{UserId: "u1"})
+			bus.Close()
+		})
+
+		g.It("should write json lines to a file", func() {
+			dir, _ := ioutil.TempDir("", "events")
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "events.jsonl")
+
+			sink, err := NewFileSink(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sink.Send(AddressCreated{UserId: "u1", Address: "x@example.com"})).To(Succeed())
+			Expect(sink.Send(AddressDeleted{UserId: "u1", Address: "x@example.com"})).To(Succeed())
+			Expect(sink.Close()).To(Succeed())
+
+			file, _ := os.Open(path)
+			defer file.Close()
+			var records []record
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var rec record
+				Expect(json.Unmarshal(scanner.Bytes(), &rec)).To(Succeed())
+				records = append(records, rec)
+			}
+			Expect(records).To(HaveLen(2))
+			Expect(records[0].Event).To(Equal("Created address"))
+			Expect(records[0].UserId).To(Equal("u1"))
+			Expect(records[1].Event).To(Equal("Deleted address"))
+			Expect(records[1].Properties["address"]).To(Equal("x@example.com"))
+		})
+
+		g.It("should post events to a webhook", func() {
+			var received record
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&received)
+			}))
+			defer server.Close()
+
+			Expect(NewWebhookSink(server.URL).Send(SubscriptionCreated{
+				UserId:   "u1",
+				Address:  "x@example.com",
+				Provider: "Paypal",
+				Value:    18,
+			})).To(Succeed())
+			Expect(received.Event).To(Equal("Created subscription"))
+			Expect(received.Properties["value"]).To(Equal(18.0))
+		})
+
+		g.It("should fail when the webhook fails", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(500)
+			}))
+			defer server.Close()
+
+			Expect(NewWebhookSink(server.URL).Send(AddressDeleted{UserId: "u1"})).ToNot(Succeed())
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/segmentio/analytics-go"
+)
+
+type Sink interface {
+	Name() string
+	Send(e Event) error
+	Close() error
+}
+
+// record is how events are written by the sinks that don't have a format of their own.
+type record struct {
+	Event      string                 `json:"event"`
+	UserId     string                 `json:"userId"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func newRecord(e Event) record {
+	return record{
+		Event:      e.Name(),
+		UserId:     e.User(),
+		Timestamp:  time.Now().UTC(),
+		Properties: Properties(e),
+	}
+}
+
+type SegmentSink struct {
+	client *analytics.Client
+}
+
+func NewSegmentSink(key string) *SegmentSink {
+	return &SegmentSink{analytics.New(key)}
+}
+
+func (s *SegmentSink) Name() string { return "segment" }
+
+func (s *SegmentSink) Send(e Event) error {
+	if signup, ok := e.(UserSignedUp); ok {
+		return s.client.Identify(&analytics.Identify{
+			UserId: signup.UserId,
+			Traits: Properties(signup),
+		})
+	}
+	return s.client.Track(&analytics.Track{
+		Event:      e.Name(),
+		UserId:     e.User(),
+		Properties: Properties(e),
+	})
+}
+
+func (s *SegmentSink) Close() error { return s.client.Close() }
+
+// FileSink appends one JSON object per line to a file.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Send(e Event) error {
+	line, err := json.Marshal(newRecord(e))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileSink) Close() error { return s.file.Close() }
+
+// WebhookSink POSTs each event as JSON to an URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Send(e Event) error {
+	body, err := json.Marshal(newRecord(e))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error { return nil }
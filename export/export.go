@@ -0,0 +1,273 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is a mail of the thread being exported, either as archived or as rebuilt
+// from the trello comment when we don't have it.
+type Message struct {
+	Id          string
+	Inbound     bool
+	From        string
+	To          []string
+	Subject     string
+	Date        time.Time
+	Text        string
+	HTML        string
+	Headers     [][2]string // the original ones, if we have them
+	Attachments []Attachment
+	Rebuilt     bool
+}
+
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+var Formats = []string{"mbox", "eml-zip", "pdf-ready-html"}
+
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// headers we write ourselves, because the body is encoded again.
+var mimeHeaders = map[string]bool{
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Mime-Version":              true,
+	"Content-Length":            true,
+}
+
+// Render writes the message in the internet message format, with the original headers
+// when there are some.
+func Render(m Message) []byte {
+	var buf bytes.Buffer
+
+	headers := m.Headers
+	if len(headers) == 0 {
+		headers = [][2]string{
+			{"Message-Id", m.Id},
+			{"Date", m.Date.Format(time.RFC1123Z)},
+			{"From", m.From},
+			{"To", strings.Join(m.To, ", ")},
+			{"Subject", m.Subject},
+		}
+	}
+	for _, h := range headers {
+		key := textproto.CanonicalMIMEHeaderKey(h[0])
+		if mimeHeaders[key] || h[1] == "" {
+			continue
+		}
+		writeHeader(&buf, h[0], h[1])
+	}
+	if m.Rebuilt {
+		writeHeader(&buf, "X-BoardThreads-Rebuilt", "from a trello comment, the original is not available")
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	contentType, encoding, body := bodyPart(m)
+	if len(m.Attachments) == 0 {
+		writeHeader(&buf, "Content-Type", contentType)
+		if encoding != "" {
+			writeHeader(&buf, "Content-Transfer-Encoding", encoding)
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes()
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+	header := textproto.MIMEHeader{"Content-Type": {contentType}}
+	if encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	part, _ := mixed.CreatePart(header)
+	part.Write(body)
+	for _, a := range m.Attachments {
+		writeAttachment(mixed, a)
+	}
+	mixed.Close()
+
+	return buf.Bytes()
+}
+
+// bodyPart encodes the text, html or both.
+func bodyPart(m Message) (contentType, encoding string, body []byte) {
+	var buf bytes.Buffer
+
+	if m.HTML == "" {
+		writeQuotedPrintable(&buf, m.Text)
+		return "text/plain; charset=utf-8", "quoted-printable", buf.Bytes()
+	}
+
+	alternative := multipart.NewWriter(&buf)
+	for _, b := range []struct{ kind, content string }{{"plain", m.Text}, {"html", m.HTML}} {
+		part, _ := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/" + b.kind + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(part, b.content)
+	}
+	alternative.Close()
+	return "multipart/alternative; boundary=" + alternative.Boundary(), "", buf.Bytes()
+}
+
+func writeAttachment(mixed *multipart.Writer, a Attachment) {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part, _ := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": a.Name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	for len(encoded) > 76 {
+		io.WriteString(part, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(part, encoded+"\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, text string) {
+	qp := quotedprintable.NewWriter(w)
+	io.WriteString(qp, strings.Replace(text, "\n", "\r\n", -1))
+	qp.Close()
+	io.WriteString(w, "\r\n")
+}
+
+func writeHeader(w io.Writer, key, value string) {
+	// no newlines in headers, and non-ascii encoded
+	value = strings.Join(strings.Fields(value), " ")
+	if needsEncoding(value) {
+		value = mime.QEncoding.Encode("utf-8", value)
+	}
+	fmt.Fprintf(w, "%s: %s\r\n", key, value)
+}
+
+func needsEncoding(s string) bool {
+	for _, r := range s {
+		if r >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+var fromLine = regexp.MustCompile(`^>*From `)
+
+// WriteMbox writes all messages in the mboxrd format.
+func WriteMbox(w io.Writer, messages []Message) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range messages {
+		sender := addressOnly(m.From)
+		if sender == "" {
+			sender = "MAILER-DAEMON"
+		}
+		fmt.Fprintf(bw, "From %s %s\n", sender, m.Date.UTC().Format(time.ANSIC))
+
+		scanner := bufio.NewScanner(bytes.NewReader(Render(m)))
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if fromLine.MatchString(line) {
+				line = ">" + line
+			}
+			bw.WriteString(line + "\n")
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// WriteEMLZip writes a zip with one .eml file for each message, in order.
+func WriteEMLZip(w io.Writer, messages []Message) error {
+	return WriteEMLZipWith(w, nil, "", messages)
+}
+
+// WriteEMLZipWith also puts other files in the zip, before the messages, which go
+// in dir.
+func WriteEMLZipWith(w io.Writer, files map[string][]byte, dir string, messages []Message) error {
+	archive := zip.NewWriter(w)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+
+	for i, m := range messages {
+		header := &zip.FileHeader{
+			Name:   path.Join(dir, fmt.Sprintf("%03d-%s.eml", i+1, slug(m.Subject))),
+			Method: zip.Deflate,
+		}
+		header.Modified = m.Date
+		f, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(Render(m)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+var notSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slug(s string) string {
+	s = strings.Trim(notSlug.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(s) > 40 {
+		s = strings.TrimRight(s[:40], "-")
+	}
+	if s == "" {
+		s = "message"
+	}
+	return s
+}
+
+var angleAddress = regexp.MustCompile(`<([^>]+)>`)
+
+func addressOnly(from string) string {
+	if match := angleAddress.FindStringSubmatch(from); match != nil {
+		return match[1]
+	}
+	return strings.TrimSpace(from)
+}
@@ -0,0 +1,142 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestExport(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	date := time.Date(2016, 7, 12, 14, 30, 0, 0, time.UTC)
+
+	inbound := Message{
+		Id:      "<abc@example.com>",
+		Inbound: true,
+		From:    "Maria <maria@example.com>",
+		To:      []string{"help@boardthreads.com"},
+		Subject: "Meu pedido não chegou",
+		Date:    date,
+		Text:    "hello\nFrom now on I'll wait.",
+		HTML:    "<p>hello</p>",
+		Headers: [][2]string{
+			{"Message-Id", "<abc@example.com>"},
+			{"From", "Maria <maria@example.com>"},
+			{"Subject", "Meu pedido não chegou"},
+			{"X-Mailer", "Thunderbird"},
+			{"Content-Type", "text/plain"},
+		},
+		Attachments: []Attachment{{"invoice.pdf", "application/pdf", []byte("%PDF-1.4 fake")}},
+	}
+	reply := Message{
+		Id:      "<def@boardthreads.com>",
+		From:    "help@boardthreads.com",
+		To:      []string{"maria@example.com"},
+		Subject: "Re: Meu pedido não chegou",
+		Date:    date.Add(time.Hour),
+		Text:    "<b>we're on it</b>",
+		Rebuilt: true,
+	}
+
+	g.Describe("export", func() {
+		g.It("should keep the original headers and attachments", func() {
+			parsed, err := mail.ReadMessage(bytes.NewReader(Render(inbound)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.Header.Get("X-Mailer")).To(Equal("Thunderbird"))
+			Expect(parsed.Header.Get("Message-Id")).To(Equal("<abc@example.com>"))
+			Expect(parsed.Header.Get("Content-Type")).To(HavePrefix("multipart/mixed; boundary="))
+			Expect(parsed.Header["Content-Type"]).To(HaveLen(1))
+
+			subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(subject).To(Equal("Meu pedido não chegou"))
+
+			body, _ := ioutil.ReadAll(parsed.Body)
+			Expect(string(body)).To(ContainSubstring("multipart/alternative"))
+			Expect(string(body)).To(ContainSubstring(`filename=invoice.pdf`))
+			Expect(string(body)).To(ContainSubstring("JVBERi0xLjQgZmFrZQ=="))
+		})
+
+		g.It("should mark and address rebuilt messages", func() {
+			parsed, err := mail.ReadMessage(bytes.NewReader(Render(reply)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.Header.Get("X-BoardThreads-Rebuilt")).ToNot(BeEmpty())
+			Expect(parsed.Header.Get("To")).To(Equal("maria@example.com"))
+			Expect(parsed.Header.Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+			date, err := parsed.Header.Date()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(date.Equal(reply.Date)).To(BeTrue())
+		})
+
+		g.It("should escape From lines in an mbox", func() {
+			var buf bytes.Buffer
+			Expect(WriteMbox(&buf, []Message{inbound, reply})).To(Succeed())
+
+			lines := strings.Split(buf.String(), "\n")
+			var separators []string
+			for _, line := range lines {
+				if strings.HasPrefix(line, "From ") {
+					separators = append(separators, line)
+				}
+				Expect(line).ToNot(HaveSuffix("\r"))
+			}
+			Expect(separators).To(Equal([]string{
+				"From maria@example.com Tue Jul 12 14:30:00 2016",
+				"From help@boardthreads.com Tue Jul 12 15:30:00 2016",
+			}))
+			Expect(buf.String()).To(ContainSubstring("\n>From now on"))
+		})
+
+		g.It("should write one eml for each message in a zip", func() {
+			var buf bytes.Buffer
+			Expect(WriteEMLZip(&buf, []Message{inbound, reply})).To(Succeed())
+
+			archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(archive.File).To(HaveLen(2))
+			Expect(archive.File[0].Name).To(Equal("001-meu-pedido-n-o-chegou.eml"))
+			Expect(archive.File[1].Name).To(Equal("002-re-meu-pedido-n-o-chegou.eml"))
+
+			f, _ := archive.File[1].Open()
+			content, _ := ioutil.ReadAll(f)
+			Expect(content).To(Equal(Render(reply)))
+		})
+
+		g.It("should put other files in the zip before the messages", func() {
+			var buf bytes.Buffer
+			files := map[string][]byte{"record.json": []byte(`{"mails": []}`), "a.txt": []byte("a")}
+			Expect(WriteEMLZipWith(&buf, files, "mails", []Message{reply})).To(Succeed())
+
+			archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, f := range archive.File {
+				names = append(names, f.Name)
+			}
+			Expect(names).To(Equal([]string{"a.txt", "record.json", "mails/001-re-meu-pedido-n-o-chegou.eml"}))
+		})
+
+		g.It("should escape the html transcript", func() {
+			var buf bytes.Buffer
+			Expect(WriteHTML(&buf, "Meu pedido", []Message{inbound, reply})).To(Succeed())
+
+			html := buf.String()
+			Expect(html).To(ContainSubstring("<title>Meu pedido</title>"))
+			Expect(html).To(ContainSubstring("&lt;b&gt;we&#39;re on it&lt;/b&gt;"))
+			Expect(html).ToNot(ContainSubstring("<p>hello</p>"))
+			Expect(html).To(ContainSubstring("invoice.pdf"))
+			Expect(strings.Count(html, `class="rebuilt"`)).To(Equal(1))
+		})
+	})
+}
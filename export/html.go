@@ -0,0 +1,58 @@
+package export
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+// the html only shows the text of each message, the html bodies come from strangers
+// and are not safe to embed. it is meant to be printed or turned into a pdf.
+var transcript = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+  @page { size: A4; margin: 2cm; }
+  body { font-family: Helvetica, Arial, sans-serif; font-size: 11pt; color: #222; }
+  h1 { font-size: 16pt; }
+  .message { border-top: 1px solid #999; padding: 1em 0; page-break-inside: avoid; }
+  .outbound { background: #f4f7fb; }
+  .headers { font-size: 9pt; color: #555; margin-bottom: 1em; }
+  .headers dt { float: left; clear: left; width: 5em; font-weight: bold; }
+  .headers dd { margin-left: 5em; }
+  .text { white-space: pre-wrap; word-wrap: break-word; }
+  .rebuilt { font-size: 9pt; font-style: italic; color: #855; }
+  .attachments { font-size: 9pt; margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Messages}}
+<div class="message {{if .Inbound}}inbound{{else}}outbound{{end}}">
+  <dl class="headers">
+    <dt>From</dt><dd>{{.From}}</dd>
+    <dt>To</dt><dd>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</dd>
+    <dt>Date</dt><dd>{{date .Date}}</dd>
+    <dt>Subject</dt><dd>{{.Subject}}</dd>
+  </dl>
+  {{if .Rebuilt}}<p class="rebuilt">rebuilt from a trello comment, the original message is not available.</p>{{end}}
+  <div class="text">{{.Text}}</div>
+  {{if .Attachments}}
+  <div class="attachments">attachments: {{range $i, $a := .Attachments}}{{if $i}}, {{end}}{{$a.Name}}{{end}}</div>
+  {{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+func WriteHTML(w io.Writer, title string, messages []Message) error {
+	return transcript.Execute(w, struct {
+		Title    string
+		Messages []Message
+	}{title, messages})
+}
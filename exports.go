@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bt/db"
+	"bt/export"
+	"bt/trello"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+var exportContentTypes = map[string]string{
+	"mbox":           "application/mbox",
+	"eml-zip":        "application/zip",
+	"pdf-ready-html": "text/html; charset=utf-8",
+}
+
+var exportExtensions = map[string]string{
+	"mbox":           "mbox",
+	"eml-zip":        "zip",
+	"pdf-ready-html": "html",
+}
+
+func ExportThread(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   the whole thread of a card, ?format=mbox|eml-zip|pdf-ready-html
+	   archived messages are exported as they were, the others are
+	   rebuilt from the trello comments.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "mbox"
+	}
+	if !export.ValidFormat(format) {
+		sendJSONError(w, fmt.Errorf("format should be one of %s", strings.Join(export.Formats, ", ")), 400, logger)
+		return
+	}
+
+	mails, err := db.GetExportMails(userId, vars["card"])
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if len(mails) == 0 {
+		// either there's no such card or the user doesn't control its address
+		sendJSONError(w, errors.New("card not found"), 404, logger)
+		return
+	}
+
+	card, err := trello.Client.Card(mails[0].CardId)
+	if err != nil {
+		sendJSONError(w, err, 503, logger)
+		return
+	}
+
+	messages := ThreadExportFlow(card, mails)
+
+	var buf bytes.Buffer
+	switch format {
+	case "mbox":
+		err = export.WriteMbox(&buf, messages)
+	case "eml-zip":
+		err = export.WriteEMLZip(&buf, messages)
+	case "pdf-ready-html":
+		err = export.WriteHTML(&buf, card.Name, messages)
+	}
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	disposition := "attachment"
+	if format == "pdf-ready-html" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`%s; filename="thread-%s.%s"`, disposition, card.ShortLink, exportExtensions[format]))
+	w.Write(buf.Bytes())
+}
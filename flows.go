@@ -1,14 +1,34 @@
 package main
 
 import (
+	"bt/blobs"
+	"bt/calendar"
 	"bt/db"
+	"bt/events"
+	"bt/export"
+	"bt/helpers"
+	"bt/hooks"
 	"bt/mailgun"
+	"bt/metrics"
 	"bt/paypal"
+	"bt/sla"
 	"bt/trello"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/segmentio/analytics-go"
+	gfm "github.com/shurcooL/github_flavored_markdown"
+	goTrello "github.com/websitesfortrello/go-trello"
+	goMailgun "github.com/websitesfortrello/mailgun-go"
 )
 
 func MaybeDeleteDomainAndRouteFlow(oldAddress *db.Address, newOutboundAddr string) {
@@ -98,18 +118,219 @@ func MaybeDowngradeAddress(address *db.Address) error {
 	}
 
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Cancelled subscription",
-		UserId: address.UserId,
-		Properties: map[string]interface{}{
-			"address":  address.InboundAddr,
-			"provider": "Paypal",
-		},
+	tracking.Publish(events.SubscriptionCancelled{
+		UserId:   address.UserId,
+		Address:  address.InboundAddr,
+		Provider: "Paypal",
 	})
 
 	return nil
 }
 
+// sendingAddresses decides from where emails for a card will be sent and where
+// replies should go, falling back to the inbound address when the outbound
+// domain is not ready.
+func sendingAddresses(inboundAddr, outboundAddr, replyTo string) (from string, replyToAddr string) {
+	from = outboundAddr
+	replyToAddr = replyTo
+	if outboundAddr == "" {
+		from = inboundAddr
+	} else {
+		domain := strings.Split(outboundAddr, "@")[1]
+		log.Debug("trying to send from " + outboundAddr)
+		if domain != settings.BaseDomain {
+			canSend, canReceive := mailgun.DomainCanSendReceive(domain)
+			if !canSend {
+				from = inboundAddr
+			}
+			if canReceive {
+				replyToAddr = outboundAddr
+			}
+		}
+	}
+
+	// the default, safe replyTo address
+	if replyToAddr == "" || !isEmail(replyToAddr) {
+		replyToAddr = inboundAddr
+	}
+	return
+}
+
+// sendingIdentity puts the alias a thread uses in place of the address wherever the
+// address itself would be shown to the customer.
+func sendingIdentity(inboundAddr, outboundAddr, replyTo, sendAs string) (string, string, string) {
+	if sendAs == "" {
+		return inboundAddr, outboundAddr, replyTo
+	}
+	if outboundAddr == inboundAddr {
+		outboundAddr = sendAs
+	}
+	if strings.ToLower(replyTo) == inboundAddr {
+		replyTo = sendAs
+	}
+	return sendAs, outboundAddr, replyTo
+}
+
+// cardReplyTo makes the customer's replies come back straight to the card, with a signed
+// reply address, or at least keeps the plus tag of the thread so they are routed like
+// the first mail. only our own addresses are known to accept tags.
+func cardReplyTo(replyTo, cardShortLink, tag string) string {
+	if !strings.HasSuffix(strings.ToLower(replyTo), "@"+settings.BaseDomain) {
+		return replyTo
+	}
+	if settings.ReplyAddressSecret != "" && cardShortLink != "" {
+		return helpers.WithPlusTag(replyTo, helpers.CardReplyTag(cardShortLink, settings.ReplyAddressSecret))
+	}
+	return helpers.WithPlusTag(replyTo, tag)
+}
+
+// PlusTagRouteFlow applies the label and member of a plus tag to the card, the list
+// is only used when the card is created.
+func PlusTagRouteFlow(card *goTrello.Card, route db.PlusTagRoute) {
+	logger := log.WithField("card", card.ShortLink)
+
+	if route.Label != "" {
+		err := trello.AddLabel(card, route.Label, "sky")
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"err":   err,
+				"label": route.Label,
+			}).Warn("couldn't apply the plus tag label")
+		}
+	}
+
+	if route.MemberId != "" {
+		for _, id := range card.IdMembers {
+			if id == route.MemberId {
+				return
+			}
+		}
+		err := card.AddMemberId(route.MemberId)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"err":    err,
+				"member": route.MemberId,
+			}).Warn("couldn't add the plus tag member")
+		}
+	}
+}
+
+// how long a post of a mail to several of our addresses has to reach trello before the
+// next post for the same list may take it, mailgun waits longer than this to retry.
+const INBOUND_CLAIM_LEASE = 5 * time.Minute
+
+// keep the receipts of messages for this long, mailgun stops retrying well before.
+const RECEIPT_DAYS = 7
+
+// LinkCardsFlow tells each of two cards that got the same mail on different addresses
+// about the other.
+func LinkCardsFlow(shortLink, address, otherShortLink, otherAddress string) {
+	for _, pair := range [][2]string{
+		{shortLink, fmt.Sprintf("This mail was also sent to %s, see https://trello.com/c/%s", otherAddress, otherShortLink)},
+		{otherShortLink, fmt.Sprintf("This mail was also sent to %s, see https://trello.com/c/%s", address, shortLink)},
+	} {
+		card, err := trello.Client.Card(pair[0])
+		if err == nil {
+			_, err = card.AddComment(pair[1])
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"card": pair[0],
+				"err":  err,
+			}).Warn("couldn't comment about the card that got the same mail")
+		}
+	}
+}
+
+// PruneReceiptsFlow forgets which lists got which messages after some days.
+func PruneReceiptsFlow() {
+	err := db.PruneReceipts(time.Now().AddDate(0, 0, -RECEIPT_DAYS))
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't prune the inbound receipts")
+	}
+}
+
+// PruneSessionsFlow forgets sessions that weren't refreshed in time.
+func PruneSessionsFlow() {
+	err := db.PruneSessions(time.Now())
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't prune expired sessions")
+	}
+}
+
+// SyncBoardMembersFlow brings the memberships of the boards we have addresses on from
+// trello, they give roles on the addresses.
+func SyncBoardMembersFlow() {
+	boards, err := db.ListBoardsWithAddresses()
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't list the boards to sync members")
+		return
+	}
+	for _, board := range boards {
+		SyncBoardFlow(board)
+	}
+}
+
+func SyncBoardFlow(boardShortLink string) {
+	logger := log.WithField("board", boardShortLink)
+
+	memberships, err := trello.BoardMemberships(boardShortLink)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch board memberships")
+		return
+	}
+
+	userIds := make([]string, len(memberships))
+	memberTypes := make([]string, len(memberships))
+	for i, m := range memberships {
+		userIds[i] = m.IdMember
+		memberTypes[i] = m.MemberType
+	}
+	err = db.SaveBoardMembers(boardShortLink, userIds, memberTypes)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't save board members")
+	}
+}
+
+func NumberCardFlow(card *goTrello.Card) {
+	logger := log.WithField("card", card.ShortLink)
+
+	ticket, err := db.AssignTicketNumber(card.ShortLink)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't assign a ticket number to the card")
+		return
+	}
+
+	err = trello.SetName(card, helpers.NumberCardName(card.Name, ticket))
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"err":    err,
+			"ticket": ticket,
+		}).Warn("couldn't put the ticket number on the card name")
+	}
+}
+
+func MoveCardToListFlow(cardId, listId string) {
+	logger := log.WithFields(log.Fields{
+		"card": cardId,
+		"list": listId,
+	})
+
+	card, err := trello.Client.Card(cardId)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't find the card on trello")
+		return
+	}
+	if card.IdList == listId {
+		return
+	}
+
+	_, err = card.MoveToList(listId)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't move the card to the list")
+	}
+}
+
 func CommentWithNewSendingParams(cardId string) {
 	logger := log.WithField("card", cardId)
 
@@ -139,3 +360,1267 @@ func CommentWithNewSendingParams(cardId string) {
 		logger.WithField("err", err).Warn("couldn't post comment with new card params.")
 	}
 }
+
+func CommentWithPreviousCard(card *goTrello.Card, previousShortLink string) {
+	logger := log.WithFields(log.Fields{
+		"card":     card.ShortLink,
+		"previous": previousShortLink,
+	})
+
+	_, err := card.AddComment(
+		fmt.Sprintf(
+			`This conversation continues a thread that was previously handled at https://trello.com/c/%s`,
+			previousShortLink,
+		),
+	)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't post comment linking to the previous card.")
+	}
+}
+
+func SaveContactFlow(mailId, raw string, inbound bool) (saved bool) {
+	address, name := helpers.ParseContact(raw)
+	if address == "" {
+		return false
+	}
+
+	err := db.SaveContact(mailId, address, name, helpers.Organisation(address), inbound)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mail":    mailId,
+			"contact": address,
+			"err":     err,
+		}).Warn("couldn't save the contact")
+		return false
+	}
+	return true
+}
+
+// how many earlier cards we link to on a new card.
+const PREVIOUS_CONVERSATIONS = 5
+
+func CommentWithPreviousConversationsFlow(card *goTrello.Card, raw string) {
+	address, _ := helpers.ParseContact(raw)
+	organisation := helpers.Organisation(address)
+	logger := log.WithFields(log.Fields{
+		"card":    card.ShortLink,
+		"contact": address,
+	})
+
+	previous, err := db.GetPreviousConversations(card.ShortLink, address, organisation, PREVIOUS_CONVERSATIONS)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch previous conversations")
+		return
+	}
+	if len(previous) == 0 {
+		return
+	}
+
+	about := address
+	if organisation != "" {
+		about = fmt.Sprintf("%s or anyone else from %s", address, organisation)
+	}
+	lines := []string{fmt.Sprintf("Previous conversations with %s:\n", about)}
+	for _, p := range previous {
+		subject := p.Subject
+		if subject == "" {
+			subject = p.CardShortLink
+		}
+		line := fmt.Sprintf("- [%s](https://trello.com/c/%s), %s",
+			subject, p.CardShortLink, time.Unix(0, p.LastMail*int64(time.Millisecond)).UTC().Format("2006-01-02"))
+		if !p.SameContact {
+			line += " (someone else from " + organisation + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	_, err = card.AddComment(strings.Join(lines, "\n"))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't post comment with previous conversations.")
+	}
+}
+
+// contacts for mails received before they existed, a batch at a time.
+const CONTACTS_BACKFILL_BATCH = 500
+
+// set once a pass links nothing, new mails get their contacts as they arrive. senders that
+// can't be parsed stay unlinked, so an empty list isn't the only way to be done.
+var contactsBackfilled bool
+
+func BackfillContactsFlow() {
+	if contactsBackfilled {
+		return
+	}
+
+	senders, err := db.ListUnlinkedSenders(CONTACTS_BACKFILL_BATCH)
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't list mails without contacts")
+		return
+	}
+	linked := 0
+	for _, sender := range senders {
+		if SaveContactFlow(sender.MailId, sender.From, true) {
+			linked++
+		}
+	}
+	if linked == 0 {
+		contactsBackfilled = true
+		return
+	}
+	log.WithField("quantity", linked).Info("linked old mails to their contacts")
+}
+
+func UpdateSLAFlow(cardShortLink string) {
+	logger := log.WithField("card", cardShortLink)
+
+	params, err := db.GetSLAParamsForCard(cardShortLink)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch the sla params for the card")
+		return
+	}
+
+	messages, err := db.GetThreadMessages(cardShortLink)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch the messages for the card")
+		return
+	}
+
+	hours, err := db.GetCalendarForAddress(params.Address)
+	if err != nil {
+		// count in plain hours then
+		logger.WithField("err", err).Warn("couldn't build the business calendar for the card")
+	}
+
+	thread := make([]sla.Message, len(messages))
+	for i, m := range messages {
+		thread[i] = sla.Message{Date: m.Time(), Inbound: m.Inbound}
+	}
+
+	timer := sla.Compute(sla.Policy{
+		FirstResponse: time.Duration(params.FirstResponseHours) * time.Hour,
+		NextResponse:  time.Duration(params.NextResponseHours) * time.Hour,
+		Calendar:      hours,
+	}, thread)
+
+	if timer.Running() {
+		err = db.SaveSLATimer(cardShortLink, string(timer.Kind),
+			timer.WaitingSince.Unix()*1000, timer.Due.Unix()*1000)
+	} else {
+		err = db.SaveSLATimer(cardShortLink, "", 0, 0)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"err":   err,
+			"kind":  timer.Kind,
+			"due":   timer.Due,
+			"since": timer.WaitingSince,
+		}).Warn("couldn't save the sla timer for the card")
+	}
+}
+
+func UpdateSLAsForAddressFlow(address string) {
+	cards, err := db.ListCardsForAddress(address)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"address": address,
+			"err":     err,
+		}).Warn("couldn't list cards to update their sla timers")
+		return
+	}
+
+	for _, shortLink := range cards {
+		UpdateSLAFlow(shortLink)
+	}
+}
+
+const SLA_BREACHED_LABEL = "SLA breached"
+
+func CheckSLABreachesFlow() {
+	breached, err := db.ClaimBreachedSLAs()
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't fetch breached sla timers")
+		return
+	}
+
+	for _, state := range breached {
+		logger := log.WithFields(log.Fields{
+			"card":    state.CardShortLink,
+			"address": state.Address,
+			"kind":    state.Kind,
+		})
+		logger.Info("sla breached")
+
+		card, err := trello.Client.Card(state.CardId)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't find the card with a breached sla on trello")
+			continue
+		}
+
+		err = trello.SetDue(card, state.DueTime())
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't set the due date for the card")
+		}
+
+		err = trello.AddLabel(card, SLA_BREACHED_LABEL, "red")
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't add the sla label to the card")
+		}
+
+		_, err = card.AddComment(
+			fmt.Sprintf(
+				`**SLA breached**: the %s to this thread was due at %s.`,
+				strings.Replace(state.Kind, "-", " ", -1),
+				state.DueTime().UTC().Format("Jan 2, 15:04 MST"),
+			),
+		)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't post comment about the sla breach.")
+		}
+	}
+}
+
+// don't acknowledge the same sender more than once in this period
+const AUTO_ACK_INTERVAL = 12 * time.Hour
+
+const DEFAULT_AUTO_ACK_TEMPLATE = `Hello,
+
+We have received your message "{SUBJECT}" and it is now registered as {TICKET}.
+{if RESPONSE_TIME}You can expect an answer by {RESPONSE_TIME}.{end}
+
+This is an automatic message, but you can reply to it if you have anything to add.`
+
+func parseAcknowledgementTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DEFAULT_AUTO_ACK_TEMPLATE
+	}
+	return template.New("acknowledgement").Delims("{", "}").Funcs(template.FuncMap{
+		"TICKET":        func() string { return "" },
+		"SUBJECT":       func() string { return "" },
+		"RESPONSE_TIME": func() string { return "" },
+	}).Parse(text)
+}
+
+func SendAcknowledgementFlow(card *goTrello.Card, inboundAddr string, message goMailgun.StoredMessage) {
+	logger := log.WithFields(log.Fields{
+		"card":    card.ShortLink,
+		"address": inboundAddr,
+	})
+
+	if helpers.IsAutomated(message) {
+		logger.Debug("not acknowledging an automated message")
+		return
+	}
+
+	recipient := strings.ToLower(helpers.ParseAddress(helpers.ReplyToOrFrom(message)))
+	if !isEmail(recipient) || strings.HasSuffix(recipient, "@"+settings.BaseDomain) {
+		// never talk to ourselves
+		return
+	}
+	logger = logger.WithField("recipient", recipient)
+
+	prefs, err := db.GetReceivingParams(inboundAddr)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch the acknowledgement settings")
+		return
+	}
+	if !prefs.AutoAck {
+		return
+	}
+
+	claimed, err := db.ClaimAutoAck(inboundAddr, recipient, AUTO_ACK_INTERVAL)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check when the sender was last acknowledged")
+		return
+	}
+	if !claimed {
+		logger.Debug("sender was acknowledged recently")
+		return
+	}
+
+	params, err := db.GetEmailParamsForCard(card.ShortLink)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't get sending params for the card")
+		return
+	}
+	from, replyTo := sendingAddresses(sendingIdentity(params.InboundAddr, params.OutboundAddr, params.ReplyTo, params.SendAs))
+	replyTo = cardReplyTo(replyTo, card.ShortLink, params.PlusTag)
+
+	// the expected response time, according to the sla and business hours
+	var responseTime string
+	if prefs.FirstResponseHours > 0 {
+		hours, err := db.GetCalendarForAddress(inboundAddr)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't build the business calendar for the address")
+			hours = calendar.Always
+		}
+		due := hours.Add(time.Now(), time.Duration(prefs.FirstResponseHours)*time.Hour)
+		if !due.IsZero() {
+			responseTime = due.In(hours.Location()).Format("Monday, January 2, 15:04 MST")
+		}
+	}
+
+	ticket := card.ShortLink
+	if params.Ticket != 0 {
+		ticket = fmt.Sprintf("#%d", params.Ticket)
+	}
+	subject := mailgun.TrimSubject(params.LastMailSubject)
+	tmpl, err := parseAcknowledgementTemplate(prefs.AutoAckTemplate)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't parse the acknowledgement template")
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Funcs(template.FuncMap{
+		"TICKET":        func() string { return ticket },
+		"SUBJECT":       func() string { return subject },
+		"RESPONSE_TIME": func() string { return responseTime },
+	}).Execute(&buf, nil)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't render the acknowledgement")
+		return
+	}
+	text := strings.TrimSpace(buf.String())
+
+	_, err = mailgun.Send(mailgun.NewMessage{
+		ApplyMetadata: true,
+		AutoReply:     true,
+		HTML:          string(gfm.Markdown([]byte(text))),
+		Text:          text,
+		Recipients:    []string{recipient},
+		FromName:      params.SenderName,
+		From:          from,
+		Domain:        strings.Split(from, "@")[1],
+		Subject:       "Re: " + mailgun.TagSubject(subject, params.TicketTag, params.Ticket),
+		InReplyTo:     helpers.MessageHeader(message, "Message-Id"),
+		ReplyTo:       replyTo,
+		CardId:        card.Id,
+	})
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't send the acknowledgement")
+		metrics.OutboundMails.Inc("acknowledgement", "error")
+		return
+	}
+	metrics.OutboundMails.Inc("acknowledgement", "ok")
+
+	logger.Info("sent acknowledgement")
+}
+
+const OVERDUE_LABEL = "overdue"
+
+func RemindAwaitingThreadsFlow() {
+	threads, err := db.ListThreadsAwaitingReply()
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't fetch threads awaiting reply")
+		return
+	}
+
+	calendars := make(map[string]*calendar.Calendar)
+	for _, thread := range threads {
+		logger := log.WithFields(log.Fields{
+			"card":    thread.CardShortLink,
+			"address": thread.Address,
+		})
+
+		reminders, err := thread.Reminders()
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't parse the reminders for the address")
+			continue
+		}
+
+		// waiting time is counted in business hours
+		hours, ok := calendars[thread.Address]
+		if !ok {
+			hours, err = db.GetCalendarForAddress(thread.Address)
+			if err != nil {
+				logger.WithField("err", err).Warn("couldn't build the business calendar for the address")
+				hours = calendar.Always
+			}
+			calendars[thread.Address] = hours
+		}
+		waiting := hours.Between(thread.Since(), time.Now())
+
+		level := 0
+		for _, reminder := range reminders {
+			if time.Duration(reminder.Hours)*time.Hour <= waiting {
+				level++
+			}
+		}
+		if level <= thread.Level {
+			continue
+		}
+
+		// other instances may be doing the same
+		claimed, err := db.ClaimReminders(thread.CardShortLink, thread.MailId, thread.Level, level)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't claim the reminders for the card")
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		card, err := trello.Client.Card(thread.CardId)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't find the card awaiting reply on trello")
+			continue
+		}
+		if card.Closed {
+			continue
+		}
+
+		for _, reminder := range reminders[thread.Level:level] {
+			logger.WithFields(log.Fields{
+				"hours":  reminder.Hours,
+				"action": reminder.Action,
+			}).Info("reminding about thread awaiting reply")
+
+			switch reminder.Action {
+			case db.MENTION:
+				err = commentWithReminder(card, waiting)
+			case db.OVERDUE:
+				err = trello.AddLabel(card, OVERDUE_LABEL, "orange")
+			case db.MOVE_TO_TOP:
+				_, err = card.MoveToPos(0)
+			}
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"err":    err,
+					"action": reminder.Action,
+				}).Warn("couldn't act on the reminder")
+			}
+		}
+	}
+}
+
+func commentWithReminder(card *goTrello.Card, waiting time.Duration) error {
+	members, err := card.Members()
+	if err != nil {
+		return err
+	}
+
+	var mentions []string
+	for _, member := range members {
+		if member.Id != settings.TrelloBotId {
+			mentions = append(mentions, "@"+member.Username)
+		}
+	}
+
+	text := fmt.Sprintf("This thread has been waiting for a reply for %d business hours.", int(waiting.Hours()))
+	if len(mentions) > 0 {
+		text = strings.Join(mentions, " ") + " " + text
+	}
+	_, err = card.AddComment(text)
+	return err
+}
+
+var statusColors = map[db.ThreadStatus]string{
+	db.NEW:                 "green",
+	db.WAITING_ON_US:       "yellow",
+	db.WAITING_ON_CUSTOMER: "sky",
+	db.CLOSED:              "black",
+}
+
+func notifyCardClosed(cardId string) {
+	address, err := db.GetAddressForCard(cardId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"card": cardId,
+			"err":  err,
+		}).Warn("couldn't find the address of the closed card")
+		return
+	}
+	card, err := trello.Client.Card(cardId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"card": cardId,
+			"err":  err,
+		}).Warn("couldn't find the closed card on trello")
+		return
+	}
+	NotifyEndpointsFlow(address, hooks.CARD_CLOSED, struct {
+		Card hookCard `json:"card"`
+	}{newHookCard(card.Id, card.ShortLink)})
+}
+
+// UpdateStatusFlow saves the new status of a thread and reflects it on the board.
+// movedToList is set when the status change comes from the card being moved.
+func UpdateStatusFlow(cardId string, status db.ThreadStatus, movedToList bool) {
+	logger := log.WithFields(log.Fields{
+		"card":   cardId,
+		"status": status,
+	})
+
+	change, err := db.SetThreadStatus(cardId, status)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't save the thread status")
+		return
+	}
+	if change.Previous == change.Current {
+		return
+	}
+	logger.WithField("previous", change.Previous).Debug("thread status changed")
+
+	if change.Current == db.CLOSED {
+		notifyCardClosed(cardId)
+	}
+
+	placements, err := change.Placements()
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't parse the status placements for the address")
+		return
+	}
+	previous := placements[change.Previous]
+	current, ok := placements[change.Current]
+	if !ok && previous.Label == "" {
+		return
+	}
+
+	card, err := trello.Client.Card(cardId)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't find the card on trello")
+		return
+	}
+
+	if previous.Label != "" && previous.Label != current.Label {
+		err = trello.RemoveLabel(card, previous.Label)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't remove the previous status label")
+		}
+	}
+	if current.Label != "" {
+		err = trello.AddLabel(card, current.Label, statusColors[change.Current])
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't add the status label")
+		}
+	}
+	if current.ListId != "" && current.ListId != card.IdList && !movedToList {
+		_, err = card.MoveToList(current.ListId)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't move the card to the status list")
+		}
+	}
+}
+
+// how long the first, immediate, attempt of a delivery has before the retry job may take it.
+const DELIVERY_LEASE = 2 * time.Minute
+
+// keep the log of finished deliveries for this long.
+const DELIVERY_LOG_DAYS = 30
+
+// hookCard is how cards are described in the payloads sent to our users' endpoints.
+type hookCard struct {
+	Id        string `json:"id"`
+	ShortLink string `json:"shortLink"`
+	URL       string `json:"url"`
+}
+
+func newHookCard(id, shortLink string) hookCard {
+	return hookCard{id, shortLink, "https://trello.com/c/" + shortLink}
+}
+
+// NotifyEndpointsFlow queues the event for every endpoint of the address listening to it
+// and makes the first attempt at delivering each in the background.
+func NotifyEndpointsFlow(address, event string, data interface{}) {
+	logger := log.WithFields(log.Fields{
+		"address": address,
+		"event":   event,
+	})
+
+	endpoints, err := db.ListEndpointsForEvent(address, event)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch the endpoints for the address")
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		delivery, err := queueDelivery(endpoint, address, event, data)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"err":      err,
+				"endpoint": endpoint.Id,
+			}).Warn("couldn't queue the delivery")
+			continue
+		}
+		go attemptDelivery(delivery, true)
+	}
+}
+
+func queueDelivery(endpoint db.Endpoint, address, event string, data interface{}) (delivery db.PendingDelivery, err error) {
+	id := hooks.NewId()
+	payload, err := json.Marshal(hooks.Payload{
+		Id:      id,
+		Event:   event,
+		Address: address,
+		Date:    time.Now().UTC(),
+		Data:    data,
+	})
+	if err != nil {
+		return
+	}
+
+	delivery.Delivery, err = db.QueueDelivery(endpoint.Id, id, event, string(payload), DELIVERY_LEASE)
+	delivery.URL = endpoint.URL
+	delivery.Secret = endpoint.Secret
+	return
+}
+
+// attemptDelivery makes one request and records it, scheduling the next one if it failed
+// and retry is set.
+func attemptDelivery(delivery db.PendingDelivery, retry bool) hooks.Result {
+	logger := log.WithFields(log.Fields{
+		"delivery": delivery.Id,
+		"event":    delivery.Event,
+		"attempt":  delivery.Attempts + 1,
+	})
+
+	var result hooks.Result
+	secret, err := openEndpointSecret(delivery.Secret)
+	if err != nil {
+		// without the key it was sealed with it will never work
+		result = hooks.Result{Error: "couldn't open the endpoint secret: " + err.Error()}
+		retry = false
+	} else {
+		result = hooks.Deliver(delivery.URL, secret, delivery.Id, delivery.Event, []byte(delivery.Payload))
+	}
+
+	var next time.Time
+	if result.Ok() {
+		metrics.WebhookDeliveries.Inc("ok")
+	} else {
+		metrics.WebhookDeliveries.Inc("error")
+		logger.WithFields(log.Fields{
+			"status": result.StatusCode,
+			"err":    result.Error,
+		}).Info("webhook delivery failed")
+
+		if wait, ok := hooks.Backoff(delivery.Attempts + 1); ok && retry {
+			next = time.Now().Add(wait)
+		}
+	}
+
+	err = db.SaveDeliveryAttempt(delivery.Id, result.StatusCode, result.Error, result.Ok(), next)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't save the delivery attempt")
+	}
+	return result
+}
+
+// openEndpointSecret moves secrets sealed with a previous key to the current one as they
+// are used, like sessions do on refresh.
+func openEndpointSecret(sealed string) (string, error) {
+	secret, err := keyring.Open(sealed)
+	if err != nil || !keyring.Stale(sealed) {
+		return secret, err
+	}
+
+	resealed, err := keyring.Seal(secret)
+	if err == nil {
+		err = db.SetEndpointSecret(sealed, resealed)
+	}
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't seal the endpoint secret with the current key")
+	}
+	return secret, nil
+}
+
+func RetryWebhookDeliveriesFlow() {
+	deliveries, err := db.ClaimDueDeliveries(50, DELIVERY_LEASE)
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't fetch the webhook deliveries to retry")
+		return
+	}
+
+	for _, delivery := range deliveries {
+		attemptDelivery(delivery, true)
+	}
+}
+
+func PruneWebhookDeliveriesFlow() {
+	err := db.PruneDeliveries(time.Now().AddDate(0, 0, -DELIVERY_LOG_DAYS))
+	if err != nil {
+		log.WithField("err", err).Warn("couldn't prune the webhook delivery log")
+	}
+}
+
+// ArchiveMailFlow keeps the body of a mail in the blob store and makes it searchable.
+// a mail the address already archived keeps its body, whoever reuses its message id.
+func ArchiveMailFlow(address string, message blobs.Message) {
+	logger := log.WithFields(log.Fields{
+		"address": address,
+		"mail":    message.Id,
+	})
+
+	archived, err := db.IsArchived(address, message.Id)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check if the mail was archived")
+		return
+	}
+	if archived {
+		return
+	}
+
+	key, err := blobs.PutMessage(archive, address, message)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't store the mail body")
+		return
+	}
+
+	err = db.ArchiveMail(address, message.Id, key, blobs.SearchText(message), message.From, message.Subject)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't save the mail body reference")
+	}
+}
+
+func ArchiveAttachmentFlow(address, messageId string, index int, path string, attachment goMailgun.StoredAttachment) (ref blobs.AttachmentRef, err error) {
+	logger := log.WithFields(log.Fields{
+		"address":    address,
+		"mail":       messageId,
+		"attachment": attachment.Name,
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't read the downloaded attachment")
+		return
+	}
+	ref, err = blobs.PutAttachment(archive, address, messageId, index, attachment.Name, attachment.ContentType, data)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't store the attachment")
+	}
+	return
+}
+
+func DeleteArchivedBodiesFlow(address string) {
+	logger := log.WithField("address", address)
+
+	keys, err := db.ListArchivedBodies(address)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't list the archived mail bodies")
+		return
+	}
+	for _, key := range keys {
+		err = deleteBlobs(key)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+				"key": key,
+			}).Warn("couldn't delete the archived mail body")
+		}
+	}
+}
+
+// deleteBlobs deletes a mail body and its attachments from the blob store.
+func deleteBlobs(key string) error {
+	if message, err := blobs.GetMessage(archive, key); err == nil {
+		for _, attachment := range message.Attachments {
+			archive.Delete(attachment.Key)
+		}
+	}
+	return archive.Delete(key)
+}
+
+// ThreadExportFlow assembles the messages of a card for exporting. Messages
+// we have archived are used as they were, the others are rebuilt from the
+// trello comments, which are only fetched if needed.
+func ThreadExportFlow(card *goTrello.Card, mails []db.ExportMail) []export.Message {
+	logger := log.WithField("card", card.Id)
+
+	var comments map[string]string
+	commentText := func(id string) string {
+		if comments == nil {
+			var err error
+			comments, err = trello.Comments(card)
+			if err != nil {
+				logger.WithField("err", err).Warn("couldn't fetch the card comments for exporting")
+			}
+		}
+		return comments[id]
+	}
+
+	// the people on the other side, used to address the rebuilt replies
+	var customers []string
+	seen := make(map[string]bool)
+	for _, mail := range mails {
+		if mail.Inbound && mail.From != "" && !seen[mail.From] {
+			seen[mail.From] = true
+			customers = append(customers, mail.From)
+		}
+	}
+
+	messages := make([]export.Message, 0, len(mails))
+	for _, mail := range mails {
+		if mail.Body != "" {
+			message, err := loadArchivedMessage(mail.Body)
+			if err == nil {
+				messages = append(messages, message)
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"err":  err,
+				"mail": mail.Id,
+			}).Warn("couldn't read an archived mail body, rebuilding it")
+		}
+
+		message := export.Message{
+			Id:      mail.Id,
+			Inbound: mail.Inbound,
+			From:    mail.From,
+			Subject: mail.Subject,
+			Date:    time.Unix(0, mail.Date*int64(time.Millisecond)),
+			Text:    commentText(mail.CommentId),
+			Rebuilt: true,
+		}
+		if message.Subject == "" {
+			message.Subject = card.Name
+		}
+		if mail.Inbound {
+			message.To = []string{mail.Outbound}
+		} else {
+			message.From = mail.Outbound
+			message.To = customers
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// loadArchivedMessage reads an archived mail with its attachments for exporting.
+func loadArchivedMessage(key string) (message export.Message, err error) {
+	archived, err := blobs.GetMessage(archive, key)
+	if err != nil {
+		return
+	}
+
+	message = export.Message{
+		Id:      archived.Id,
+		Inbound: archived.Inbound,
+		From:    archived.From,
+		To:      archived.To,
+		Subject: archived.Subject,
+		Date:    time.Unix(0, archived.Date*int64(time.Millisecond)),
+		Text:    archived.Text,
+		HTML:    archived.HTML,
+		Headers: archived.Headers,
+	}
+	for _, ref := range archived.Attachments {
+		data, err := archive.Get(ref.Key)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"mail":       archived.Id,
+				"attachment": ref.Name,
+			}).Warn("couldn't read an archived attachment")
+			continue
+		}
+		message.Attachments = append(message.Attachments, export.Attachment{
+			Name:        ref.Name,
+			ContentType: ref.ContentType,
+			Data:        data,
+		})
+	}
+	return message, nil
+}
+
+// SubjectAccessFlow assembles every mail involving a data subject, thread by thread.
+// mails whose card is gone only have what was archived.
+func SubjectAccessFlow(mails []db.SubjectMail) []export.Message {
+	var order []string
+	threads := make(map[string][]db.ExportMail)
+	for _, mail := range mails {
+		if _, ok := threads[mail.CardId]; !ok {
+			order = append(order, mail.CardId)
+		}
+		threads[mail.CardId] = append(threads[mail.CardId], mail.ExportMail)
+	}
+
+	messages := make([]export.Message, 0, len(mails))
+	for _, cardId := range order {
+		if cardId != "" {
+			card, err := trello.Client.Card(cardId)
+			if err == nil {
+				messages = append(messages, ThreadExportFlow(card, threads[cardId])...)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"card": cardId,
+				"err":  err,
+			}).Warn("couldn't fetch card for a subject access export, using only the archived mails")
+		}
+		for _, mail := range threads[cardId] {
+			if mail.Body == "" {
+				continue
+			}
+			if message, err := loadArchivedMessage(mail.Body); err == nil {
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	sort.Stable(byMessageDate(messages))
+	return messages
+}
+
+type byMessageDate []export.Message
+
+func (s byMessageDate) Len() int           { return len(s) }
+func (s byMessageDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMessageDate) Less(i, j int) bool { return s[i].Date.Before(s[j].Date) }
+
+// what is done to the trello comments of the mails of an erased data subject.
+const (
+	TRELLO_KEEP   = "keep"
+	TRELLO_REDACT = "redact"
+	TRELLO_DELETE = "delete"
+)
+
+const REDACTED_COMMENT = ":no_entry_sign: this message was erased at the request of the person it concerned."
+
+// EraseSubjectFlow deals with the trello comments of the mails as asked, anonymizes the
+// graph and deletes the bodies the user's addresses archived. failures are counted for
+// the audit record, the rest goes on.
+func EraseSubjectFlow(userId, address string, mails []db.SubjectMail, trelloMode string) db.PrivacyRequest {
+	logger := log.WithField("user", userId)
+	request := db.PrivacyRequest{Kind: "erasure", Mails: len(mails), Trello: trelloMode}
+
+	ids := make([]string, 0, len(mails))
+	var cards []string
+	comments := make(map[string][]string)
+	for _, mail := range mails {
+		ids = append(ids, mail.Id)
+
+		if mail.CardId != "" {
+			if _, ok := comments[mail.CardId]; !ok {
+				cards = append(cards, mail.CardId)
+				comments[mail.CardId] = nil
+			}
+			if mail.CommentId != "" {
+				comments[mail.CardId] = append(comments[mail.CardId], mail.CommentId)
+			}
+		}
+	}
+	request.Cards = len(cards)
+
+	if trelloMode != TRELLO_KEEP {
+		mentions := helpers.MentionsAddress(address)
+		for _, cardId := range cards {
+			request.Failures += eraseFromCard(cardId, comments[cardId], mentions, trelloMode)
+		}
+	}
+
+	keys, err := db.EraseSubject(userId, address, ids)
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't erase a data subject from the database")
+		request.Failures++
+	}
+	for _, key := range keys {
+		if err := deleteBlobs(key); err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+				"key": key,
+			}).Warn("couldn't delete an archived mail body")
+			request.Failures++
+			continue
+		}
+		request.Bodies++
+	}
+	return request
+}
+
+// eraseFromCard handles the comments of the mails and the other places the address
+// shows up on the card: its name, its description and the uploaded message bodies,
+// which are named after the sender. the rest of the card is left alone. returns how
+// many of these failed.
+func eraseFromCard(cardId string, commentIds []string, mentions *regexp.Regexp, mode string) (failures int) {
+	logger := log.WithFields(log.Fields{"card": cardId, "mode": mode})
+
+	card, err := trello.Client.Card(cardId)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch a card to erase a data subject from")
+		return 1
+	}
+
+	for _, commentId := range commentIds {
+		if mode == TRELLO_DELETE {
+			err = trello.DeleteComment(card, commentId)
+		} else {
+			err = trello.EditComment(card, commentId, REDACTED_COMMENT)
+		}
+		if err != nil {
+			// the bot can't edit the comments of other people
+			logger.WithFields(log.Fields{
+				"err":     err,
+				"comment": commentId,
+			}).Warn("couldn't erase a comment")
+			failures++
+		}
+	}
+
+	if mentions.MatchString(card.Name) {
+		if err = trello.SetName(card, helpers.EraseMentions(card.Name, mentions)); err != nil {
+			logger.WithField("err", err).Warn("couldn't erase the address from the card name")
+			failures++
+		}
+	}
+	if mentions.MatchString(card.Desc) {
+		if err = card.SetDesc(helpers.RedactCardDesc(card.Desc, mentions, REDACTED_COMMENT)); err != nil {
+			logger.WithField("err", err).Warn("couldn't erase the address from the card description")
+			failures++
+		}
+	}
+
+	attachments, err := card.Attachments()
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't list the card attachments")
+		return failures + 1
+	}
+	for _, attachment := range attachments {
+		// bodies are uploaded as "<sender>.html"
+		name := strings.TrimRight(strings.TrimSuffix(attachment.Name, path.Ext(attachment.Name)), ".")
+		if !mentions.MatchString(name) {
+			continue
+		}
+		if err = trello.DeleteAttachment(card, attachment.Id); err != nil {
+			logger.WithFields(log.Fields{
+				"err":        err,
+				"attachment": attachment.Name,
+			}).Warn("couldn't delete an attachment")
+			failures++
+		}
+	}
+	return
+}
+
+// how many messages are listed on the comments about merged or split cards.
+const MOVED_MAILS_LISTED = 30
+
+// MergeCardsFlow moves the thread of source into target, posts a summary of it on
+// target and archives source with a link. the cards must be on the same address.
+func MergeCardsFlow(source, target string) error {
+	logger := log.WithFields(log.Fields{
+		"card":   source,
+		"target": target,
+	})
+
+	sourceAddr, err := db.GetAddressForCard(source)
+	if err != nil {
+		return errors.New("this card isn't a thread we know of")
+	}
+	targetAddr, err := db.GetAddressForCard(target)
+	if err != nil || targetAddr != sourceAddr {
+		return errors.New("only threads of the same address can be merged")
+	}
+	if merged, _ := db.GetMergedInto(source); merged != "" {
+		return fmt.Errorf("this card was already merged into https://trello.com/c/%s", merged)
+	}
+	if merged, _ := db.GetMergedInto(target); merged != "" {
+		return fmt.Errorf("that card was merged into https://trello.com/c/%s, merge into it instead", merged)
+	}
+
+	sourceCard, err := trello.Client.Card(source)
+	if err != nil {
+		return err
+	}
+	targetCard, err := trello.Client.Card(target)
+	if err != nil {
+		return err
+	}
+	if sourceCard.Id == targetCard.Id {
+		return errors.New("can't merge a card into itself")
+	}
+
+	mails, err := db.MergeCards(sourceCard.Id, targetCard.Id)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return err
+	}
+	logger.WithField("mails", len(mails)).Info("merged cards")
+
+	_, err = targetCard.AddComment(mergeSummary(sourceCard, mails))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't post the summary of the merged card")
+	}
+	_, err = sourceCard.AddComment(
+		fmt.Sprintf("This thread was merged into https://trello.com/c/%s, replies from now on will land there.", targetCard.ShortLink),
+	)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't comment on the merged card")
+	}
+	UpdateStatusFlow(sourceCard.Id, db.CLOSED, false)
+	_, err = sourceCard.Archive()
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't archive the merged card")
+	}
+
+	// the merged messages may be newer than the ones on target
+	if n := len(mails); n > 0 {
+		if mails[n-1].Inbound {
+			UpdateStatusFlow(targetCard.Id, db.WAITING_ON_US, false)
+		} else {
+			UpdateStatusFlow(targetCard.Id, db.WAITING_ON_CUSTOMER, false)
+		}
+	}
+	UpdateSLAFlow(targetCard.ShortLink)
+	return nil
+}
+
+func mergeSummary(source *goTrello.Card, mails []db.MovedMail) string {
+	lines := movedMailLines(source.ShortLink, mails)
+	summary := fmt.Sprintf(":twisted_rightwards_arrows: Merged [%s](https://trello.com/c/%s) into this card",
+		source.Name, source.ShortLink)
+	if len(lines) == 0 {
+		return summary + "."
+	}
+	return summary + ", its messages are now part of this thread:\n\n" + strings.Join(lines, "\n")
+}
+
+// movedMailLines lists the moved messages, with links to their comments, which stay
+// where they were.
+func movedMailLines(sourceShortLink string, mails []db.MovedMail) []string {
+	lines := []string{}
+	for _, m := range mails {
+		if strings.HasPrefix(m.Id, "fake-") {
+			continue
+		}
+		who := "reply"
+		if m.Inbound {
+			who = m.From
+		}
+		line := fmt.Sprintf("- %s, **%s**",
+			time.Unix(0, m.Date*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04"), who)
+		if m.Subject != "" {
+			line += fmt.Sprintf(` "%s"`, m.Subject)
+		}
+		if m.Body != "" {
+			if archived, err := blobs.GetMessage(archive, m.Body); err == nil {
+				if snippet := blobs.Snippet(strings.Join(strings.Fields(archived.Text), " "), nil, 120); snippet != "" {
+					line += ": " + snippet
+				}
+			}
+		}
+		if m.CommentId != "" {
+			line += fmt.Sprintf(" ([comment](https://trello.com/c/%s#comment-%s))", sourceShortLink, m.CommentId)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) > MOVED_MAILS_LISTED {
+		more := len(lines) - MOVED_MAILS_LISTED
+		lines = append(lines[:MOVED_MAILS_LISTED], fmt.Sprintf("- and %d more.", more))
+	}
+	return lines
+}
+
+// SplitThreadFlow moves an inbound message of a card, and the later ones from the same
+// sender, to a new card on the same list. returns the new card.
+func SplitThreadFlow(cardId, message string) (*goTrello.Card, error) {
+	logger := log.WithFields(log.Fields{
+		"card":    cardId,
+		"message": message,
+	})
+
+	point, err := db.GetSplitPoint(cardId, message)
+	if err != nil {
+		return nil, errors.New("that isn't a message we received on this card")
+	}
+	if merged, _ := db.GetMergedInto(cardId); merged != "" {
+		return nil, fmt.Errorf("this card was merged into https://trello.com/c/%s", merged)
+	}
+	messages, err := db.GetThreadMessages(cardId)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 && messages[0].Id == point.MailId {
+		return nil, errors.New("that is the first message of the thread, there would be nothing left")
+	}
+
+	source, err := trello.Client.Card(cardId)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same as a new card for an incoming mail
+	card, err := trello.CreateCardFromMessage(source.IdList, goMailgun.StoredMessage{
+		Subject:    point.Subject,
+		From:       point.From,
+		Recipients: point.Address,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// until the mails are moved the new card can go away without leaving anything behind
+	saved := false
+	abandon := func(err error) (*goTrello.Card, error) {
+		if saved {
+			if rmErr := db.RemoveCard(card.Id); rmErr != nil {
+				logger.WithField("err", rmErr).Warn("couldn't remove the card of a failed split")
+			}
+		}
+		if delErr := card.Delete(); delErr != nil {
+			logger.WithFields(log.Fields{
+				"err": delErr,
+				"new": card.Id,
+			}).Warn("couldn't delete the card of a failed split")
+		}
+		return nil, err
+	}
+
+	fetched, err := trello.Client.Card(card.Id)
+	if err != nil {
+		return abandon(err)
+	}
+	card = fetched
+	webhookId, err := trello.CreateWebhook(card.Id, settings.WebhookHandler+"/webhooks/trello/card")
+	if err != nil {
+		return abandon(err)
+	}
+	err = db.SaveCardWithEmail(point.Address, card.ShortLink, card.Id, webhookId)
+	if err != nil {
+		return abandon(err)
+	}
+	saved = true
+
+	mails, err := db.SplitMails(source.Id, card.Id, point.MailId)
+	if err != nil {
+		return abandon(err)
+	}
+	metrics.CardsCreated.Inc("split")
+	NumberCardFlow(card)
+	logger.WithFields(log.Fields{
+		"new":   card.ShortLink,
+		"mails": len(mails),
+	}).Info("split thread")
+
+	_, err = card.AddComment(fmt.Sprintf(
+		":scissors: Split from [%s](https://trello.com/c/%s), these messages were moved here:\n\n%s",
+		source.Name, source.ShortLink, strings.Join(movedMailLines(source.ShortLink, mails), "\n"),
+	))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't comment on the new card")
+	}
+	_, err = source.AddComment(fmt.Sprintf(
+		":scissors: %d messages from %s were moved to https://trello.com/c/%s, replies to them will land there.",
+		len(mails), point.From, card.ShortLink,
+	))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't comment on the split card")
+	}
+
+	// both cards now have a different last mail
+	if _, err := db.RefreshLastMail(card.Id); err != nil {
+		logger.WithField("err", err).Warn("couldn't update the last mail of the new card")
+	}
+	UpdateStatusFlow(card.Id, db.NEW, false)
+	inbound, err := db.RefreshLastMail(source.Id)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't update the last mail of the split card")
+	} else if !source.Closed {
+		if inbound {
+			UpdateStatusFlow(source.Id, db.WAITING_ON_US, false)
+		} else {
+			UpdateStatusFlow(source.Id, db.WAITING_ON_CUSTOMER, false)
+		}
+	}
+	UpdateSLAFlow(card.ShortLink)
+	UpdateSLAFlow(source.ShortLink)
+	return card, nil
+}
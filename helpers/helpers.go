@@ -4,6 +4,9 @@ import (
 	"bt/mailgun"
 	"regexp"
 
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
 	"errors"
 	"fmt"
 	"io"
@@ -129,6 +132,30 @@ func MessageHeader(message mailgunGo.StoredMessage, header string) string {
 	return ""
 }
 
+// MessageRecipients returns the addresses in the To and Cc headers, lowercased and
+// without plus tags.
+func MessageRecipients(message mailgunGo.StoredMessage) []string {
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, pair := range message.MessageHeaders {
+		if len(pair) != 2 || !(strings.EqualFold(pair[0], "To") || strings.EqualFold(pair[0], "Cc")) {
+			continue
+		}
+		addresses, err := ParseMultipleAddresses(pair[1])
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			base, _ := SplitPlusTag(address)
+			if !seen[base] {
+				seen[base] = true
+				recipients = append(recipients, base)
+			}
+		}
+	}
+	return recipients
+}
+
 func CommentEnvelopePrefix(text string) (len int) {
 	lower := strings.ToLower(text)
 	if strings.HasPrefix(lower, ":email:") {
@@ -145,6 +172,13 @@ func MakeCardName(message mailgunGo.StoredMessage) string {
 	return fmt.Sprintf("%s {%s}", mailgun.TrimSubject(message.Subject), ReplyToOrFrom(message))
 }
 
+var ticketPrefix = regexp.MustCompile(`^#\d+\s+`)
+
+// NumberCardName puts the ticket number in front of a card name.
+func NumberCardName(name string, ticket int) string {
+	return fmt.Sprintf("#%d %s", ticket, ticketPrefix.ReplaceAllString(strings.TrimSpace(name), ""))
+}
+
 func ParseCardName(name string) (subject string, addr string, err error) {
 	splitted := strings.Split(name, "{")
 	if len(splitted) != 2 {
@@ -162,7 +196,7 @@ func ParseCardName(name string) (subject string, addr string, err error) {
 		return
 	}
 
-	subject = strings.TrimSpace(splitted[0])
+	subject = ticketPrefix.ReplaceAllString(strings.TrimSpace(splitted[0]), "")
 	addr = address.Address
 
 	return
@@ -187,3 +221,236 @@ subject: %s
 		message.Subject,
 	)
 }
+
+var descSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+var descSenderLine = regexp.MustCompile(`(?m)^(from|reply-to): .*$`)
+var descSubjectLine = regexp.MustCompile(`(?m)^subject: .*$`)
+
+// RedactCardDesc takes the mentions out of a description made by MakeCardDesc. when
+// the message on it was sent by who is mentioned its subject and body are replaced too.
+// descriptions written by people only lose the mentions.
+func RedactCardDesc(desc string, mentions *regexp.Regexp, redacted string) string {
+	separators := descSeparator.FindAllStringIndex(desc, 2)
+	if len(separators) == 2 {
+		header := desc[separators[0][1]:separators[1][0]]
+		theirs := false
+		for _, line := range descSenderLine.FindAllString(header, -1) {
+			if mentions.MatchString(line) {
+				theirs = true
+			}
+		}
+		if theirs {
+			header = descSubjectLine.ReplaceAllString(header, "subject: [erased]")
+			desc = desc[:separators[0][1]] + header + desc[separators[1][0]:separators[1][1]] +
+				"\n\n" + redacted
+		}
+	}
+	return EraseMentions(desc, mentions)
+}
+
+// MentionsAddress matches an address only where it is whole, so "ann@x.com" isn't found
+// in "joann@x.com" or "ann@x.com.br". the characters around it are part of the match.
+func MentionsAddress(address string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(^|[^\w.+-])` + regexp.QuoteMeta(address) + `($|[^\w.-])`)
+}
+
+// EraseMentions replaces what MentionsAddress matched, keeping the characters around it.
+func EraseMentions(s string, mentions *regexp.Regexp) string {
+	// mentions next to each other share a character, so they don't all match at once
+	for mentions.MatchString(s) {
+		s = mentions.ReplaceAllString(s, "${1}[erased]${2}")
+	}
+	return s
+}
+
+var automatedSenders = regexp.MustCompile(`(?i)^(mailer-daemon|postmaster|no-?reply|do-?not-?reply|bounces?)([+-].*)?@`)
+
+// IsAutomated tells if a message was sent by a robot (auto-replies, bounces,
+// mailing lists, newsletters), so we shouldn't reply to it automatically.
+func IsAutomated(message mailgunGo.StoredMessage) bool {
+	for _, pair := range message.MessageHeaders {
+		name := strings.ToLower(pair[0])
+		value := strings.ToLower(strings.TrimSpace(pair[1]))
+		switch name {
+		case "auto-submitted":
+			if value != "no" {
+				return true
+			}
+		case "precedence":
+			if value == "bulk" || value == "junk" || value == "list" || value == "auto_reply" {
+				return true
+			}
+		case "x-autoreply", "x-autorespond", "list-id", "list-unsubscribe", "feedback-id":
+			return true
+		case "x-auto-response-suppress":
+			if strings.Contains(value, "all") || strings.Contains(value, "autoreply") || strings.Contains(value, "oof") {
+				return true
+			}
+		case "return-path":
+			if value == "<>" {
+				return true
+			}
+		}
+	}
+	return automatedSenders.MatchString(ReplyToOrFrom(message)) ||
+		automatedSenders.MatchString(ParseAddress(message.From))
+}
+
+// ParseContact splits an address like "Maria <MARIA@someone.com>" into the lowercase
+// address and the display name, which may be empty.
+func ParseContact(raw string) (address, name string) {
+	raw = strings.Split(raw, ",")[0]
+	parsed, err := mail.ParseAddress(raw)
+	if err != nil {
+		return strings.ToLower(strings.Trim(strings.TrimSpace(raw), "<>")), ""
+	}
+	return strings.ToLower(parsed.Address), strings.TrimSpace(parsed.Name)
+}
+
+// domains of personal mailboxes, people writing from them don't belong to an organisation.
+var freeMailDomains = map[string]bool{
+	"gmail.com": true, "googlemail.com": true, "yahoo.com": true, "ymail.com": true,
+	"hotmail.com": true, "outlook.com": true, "live.com": true, "msn.com": true,
+	"icloud.com": true, "me.com": true, "mac.com": true, "aol.com": true,
+	"protonmail.com": true, "proton.me": true, "gmx.com": true, "gmx.net": true,
+	"mail.com": true, "yandex.com": true, "yandex.ru": true, "zoho.com": true,
+	"uol.com.br": true, "bol.com.br": true, "terra.com.br": true,
+}
+
+var mailSubdomain = regexp.MustCompile(`^(mail|email|mx|smtp|www)\.`)
+
+// Organisation is the domain of an address, or "" for personal mailboxes.
+func Organisation(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return ""
+	}
+	domain := strings.ToLower(strings.TrimSpace(address[at+1:]))
+	if strings.Count(domain, ".") > 1 {
+		domain = mailSubdomain.ReplaceAllString(domain, "")
+	}
+	if domain == "" || freeMailDomains[domain] || strings.HasPrefix(domain, "yahoo.") || strings.HasPrefix(domain, "hotmail.") {
+		return ""
+	}
+	return domain
+}
+
+var cardReference = regexp.MustCompile(`^(?:https?://trello\.com/c/)?([A-Za-z0-9]{8})(?:[/?#].*)?$`)
+
+// CardShortLink takes a trello card url or shortLink and returns the shortLink, or "".
+func CardShortLink(reference string) string {
+	match := cardReference.FindStringSubmatch(strings.TrimSpace(reference))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+var mergeCommand = regexp.MustCompile(`(?i)^\s*/merge\s+(?:into\s+)?(\S+)`)
+
+// ParseMergeCommand reads comments like "/merge into https://trello.com/c/abcdefgh", which
+// ask for the card where they are posted to be merged into the other.
+func ParseMergeCommand(text string) (target string, ok bool) {
+	match := mergeCommand.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+	target = CardShortLink(match[1])
+	return target, target != ""
+}
+
+var splitCommand = regexp.MustCompile(`(?i)^\s*/split\s+(?:from\s+)?(\S+)`)
+var commentLink = regexp.MustCompile(`#comment-([0-9a-f]{24})$`)
+
+// ParseSplitCommand reads comments like "/split from <link to a comment>" or
+// "/split <message-id>", which ask for the message to be moved to a new card.
+// the message is returned as the comment id or the message id.
+func ParseSplitCommand(text string) (message string, ok bool) {
+	match := splitCommand.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+	if link := commentLink.FindStringSubmatch(match[1]); link != nil {
+		return link[1], true
+	}
+	if strings.HasPrefix(match[1], "<") && strings.HasSuffix(match[1], ">") {
+		return match[1], true
+	}
+	return "", false
+}
+
+var plusTag = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// SplitPlusTag turns "support+billing@x.com" into "support@x.com" and "billing".
+// addresses without a valid tag come back lowercased, with an empty tag.
+func SplitPlusTag(address string) (base, tag string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	plus := strings.Index(address, "+")
+	if at == -1 || plus == -1 || plus > at {
+		return address, ""
+	}
+	tag = address[plus+1 : at]
+	base = address[:plus] + address[at:]
+	if !ValidPlusTag(tag) {
+		return base, ""
+	}
+	return base, tag
+}
+
+func ValidPlusTag(tag string) bool {
+	return len(tag) <= 64 && plusTag.MatchString(tag)
+}
+
+// WithPlusTag is the reverse of SplitPlusTag.
+func WithPlusTag(address, tag string) string {
+	at := strings.LastIndex(address, "@")
+	if tag == "" || at == -1 {
+		return address
+	}
+	return address[:at] + "+" + tag + address[at:]
+}
+
+// card reply tags are plus tags that point to a card, like "c-<shortLink><signature>".
+// addresses are case insensitive and shortLinks are not, so both parts are base32.
+const cardTagPrefix = "c-"
+
+var cardTagEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func cardTagSignature(shortLink, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(shortLink))
+	return strings.ToLower(cardTagEncoding.EncodeToString(mac.Sum(nil)[:10]))
+}
+
+func CardReplyTag(shortLink, secret string) string {
+	return cardTagPrefix +
+		strings.ToLower(cardTagEncoding.EncodeToString([]byte(shortLink))) +
+		cardTagSignature(shortLink, secret)
+}
+
+func IsCardReplyTag(tag string) bool {
+	return strings.HasPrefix(tag, cardTagPrefix)
+}
+
+// ParseCardReplyTag returns the shortLink of the card if the tag was signed with
+// the secret.
+func ParseCardReplyTag(tag, secret string) (shortLink string, ok bool) {
+	if !IsCardReplyTag(tag) || secret == "" {
+		return "", false
+	}
+	token := strings.ToUpper(strings.TrimPrefix(tag, cardTagPrefix))
+	signatureLen := cardTagEncoding.EncodedLen(10)
+	if len(token) <= signatureLen {
+		return "", false
+	}
+	decoded, err := cardTagEncoding.DecodeString(token[:len(token)-signatureLen])
+	if err != nil {
+		return "", false
+	}
+	shortLink = string(decoded)
+	if !hmac.Equal([]byte(strings.ToLower(token[len(token)-signatureLen:])), []byte(cardTagSignature(shortLink, secret))) {
+		return "", false
+	}
+	return shortLink, true
+}
@@ -1,10 +1,12 @@
 package helpers
 
 import (
+	"regexp"
 	"testing"
 
 	. "github.com/franela/goblin"
 	. "github.com/onsi/gomega"
+	mailgunGo "github.com/websitesfortrello/mailgun-go"
 )
 
 func TestDB(t *testing.T) {
@@ -31,5 +33,180 @@ func TestDB(t *testing.T) {
 			Expect(ParseMultipleAddresses("pÉo <ope@poe.eop>, yy<ytue@ut.ey>")).To(BeEquivalentTo([]string{"ope@poe.eop", "ytue@ut.ey"}))
 		})
 
+		g.It("should number card names", func() {
+			Expect(NumberCardName("my printer {maria@someone.com}", 12)).To(Equal("#12 my printer {maria@someone.com}"))
+			Expect(NumberCardName("#11 my printer {maria@someone.com}", 12)).To(Equal("#12 my printer {maria@someone.com}"))
+
+			subject, addr, err := ParseCardName("#12 my printer {maria@someone.com}")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(subject).To(Equal("my printer"))
+			Expect(addr).To(Equal("maria@someone.com"))
+		})
+
+		g.It("should parse contacts and their organisations", func() {
+			address, name := ParseContact("Maria Silva <MARIA@Someone.com>")
+			Expect(address).To(Equal("maria@someone.com"))
+			Expect(name).To(Equal("Maria Silva"))
+			address, name = ParseContact("maria@someone.com")
+			Expect(address).To(Equal("maria@someone.com"))
+			Expect(name).To(BeEmpty())
+
+			Expect(Organisation("maria@someone.com")).To(Equal("someone.com"))
+			Expect(Organisation("maria@mail.someone.com.br")).To(Equal("someone.com.br"))
+			Expect(Organisation("maria@gmail.com")).To(BeEmpty())
+			Expect(Organisation("maria@yahoo.com.br")).To(BeEmpty())
+			Expect(Organisation("maria")).To(BeEmpty())
+		})
+
+		g.It("should parse merge commands", func() {
+			Expect(CardShortLink("https://trello.com/c/AbCd1234/12-my-printer")).To(Equal("AbCd1234"))
+			Expect(CardShortLink("AbCd1234")).To(Equal("AbCd1234"))
+			Expect(CardShortLink("https://example.com/c/AbCd1234")).To(BeEmpty())
+
+			target, ok := ParseMergeCommand("/merge into https://trello.com/c/AbCd1234")
+			Expect(ok).To(Equal(true))
+			Expect(target).To(Equal("AbCd1234"))
+			target, ok = ParseMergeCommand("  /MERGE AbCd1234 please")
+			Expect(ok).To(Equal(true))
+			Expect(target).To(Equal("AbCd1234"))
+			_, ok = ParseMergeCommand("we should /merge into AbCd1234")
+			Expect(ok).To(Equal(false))
+			_, ok = ParseMergeCommand("/merge into that other card")
+			Expect(ok).To(Equal(false))
+		})
+
+		g.It("should parse split commands", func() {
+			message, ok := ParseSplitCommand("/split from https://trello.com/c/AbCd1234/12-my-printer#comment-5f1a2b3c4d5e6f7a8b9c0d1e")
+			Expect(ok).To(Equal(true))
+			Expect(message).To(Equal("5f1a2b3c4d5e6f7a8b9c0d1e"))
+			message, ok = ParseSplitCommand("/split <abc@mail.someone.com>")
+			Expect(ok).To(Equal(true))
+			Expect(message).To(Equal("<abc@mail.someone.com>"))
+			_, ok = ParseSplitCommand("/split this please")
+			Expect(ok).To(Equal(false))
+			_, ok = ParseSplitCommand("/merge into AbCd1234")
+			Expect(ok).To(Equal(false))
+		})
+
+		g.It("should split and join plus tags", func() {
+			base, tag := SplitPlusTag("Support+Billing@boardthreads.com")
+			Expect(base).To(Equal("support@boardthreads.com"))
+			Expect(tag).To(Equal("billing"))
+			base, tag = SplitPlusTag("support@boardthreads.com")
+			Expect(base).To(Equal("support@boardthreads.com"))
+			Expect(tag).To(Equal(""))
+			base, tag = SplitPlusTag("support+@boardthreads.com")
+			Expect(base).To(Equal("support@boardthreads.com"))
+			Expect(tag).To(Equal(""))
+			base, tag = SplitPlusTag("support+a+b@boardthreads.com")
+			Expect(base).To(Equal("support@boardthreads.com"))
+			Expect(tag).To(Equal(""))
+			Expect(WithPlusTag("support@boardthreads.com", "billing")).To(Equal("support+billing@boardthreads.com"))
+			Expect(WithPlusTag("support@boardthreads.com", "")).To(Equal("support@boardthreads.com"))
+		})
+
+		g.It("should sign and check card reply tags", func() {
+			tag := CardReplyTag("AbCd1234", "s3cret")
+			Expect(ValidPlusTag(tag)).To(Equal(true))
+			Expect(IsCardReplyTag(tag)).To(Equal(true))
+
+			// it survives the address being lowercased
+			_, parsed := SplitPlusTag(WithPlusTag("Support@boardthreads.com", tag))
+			shortLink, ok := ParseCardReplyTag(parsed, "s3cret")
+			Expect(ok).To(Equal(true))
+			Expect(shortLink).To(Equal("AbCd1234"))
+
+			_, ok = ParseCardReplyTag(tag, "other")
+			Expect(ok).To(Equal(false))
+			_, ok = ParseCardReplyTag(tag, "")
+			Expect(ok).To(Equal(false))
+			forged := CardReplyTag("XyZw9876", "other")
+			_, ok = ParseCardReplyTag(forged, "s3cret")
+			Expect(ok).To(Equal(false))
+			_, ok = ParseCardReplyTag("c-abc", "s3cret")
+			Expect(ok).To(Equal(false))
+			_, ok = ParseCardReplyTag("billing", "s3cret")
+			Expect(ok).To(Equal(false))
+		})
+
+		g.It("should list the recipients of a message", func() {
+			message := mailgunGo.StoredMessage{MessageHeaders: [][]string{
+				{"From", "maria@someone.com"},
+				{"To", "Sales <SALES@boardthreads.com>, support+billing@boardthreads.com"},
+				{"CC", "support@boardthreads.com, joao@someone.com"},
+			}}
+			Expect(MessageRecipients(message)).To(Equal([]string{
+				"sales@boardthreads.com",
+				"support@boardthreads.com",
+				"joao@someone.com",
+			}))
+		})
+
+		g.It("should redact a person from card descriptions", func() {
+			mentions := MentionsAddress("gone@else.com")
+			message := mailgunGo.StoredMessage{
+				From:           "Gone <gone@else.com>",
+				Recipients:     "help@boardthreads.com",
+				Subject:        "my secret problem",
+				MessageHeaders: [][]string{{"To", "help@boardthreads.com"}},
+			}
+			desc := MakeCardDesc(message) + "\n\n> the details of my problem"
+
+			redacted := RedactCardDesc(desc, mentions, "erased.")
+			Expect(redacted).ToNot(ContainSubstring("gone@else.com"))
+			Expect(redacted).ToNot(ContainSubstring("secret"))
+			Expect(redacted).ToNot(ContainSubstring("details"))
+			Expect(redacted).To(ContainSubstring("to: help@boardthreads.com"))
+			Expect(redacted).To(ContainSubstring("subject: [erased]"))
+			Expect(redacted).To(HaveSuffix("\n\nerased."))
+
+			// messages from others keep their contents
+			message.From = "someone@else.com"
+			desc = MakeCardDesc(message) + "\n\n> I talked to Gone@else.com about it"
+			redacted = RedactCardDesc(desc, mentions, "erased.")
+			Expect(redacted).To(ContainSubstring("subject: my secret problem"))
+			Expect(redacted).To(ContainSubstring("> I talked to [erased] about it"))
+
+			// someone else with a similar address is not them
+			message.From = "Undergone <undergone@else.com>"
+			desc = MakeCardDesc(message)
+			Expect(RedactCardDesc(desc, mentions, "erased.")).To(Equal(desc))
+
+			// and so do descriptions people wrote
+			Expect(RedactCardDesc("call gone@else.com\n---\nno header", mentions, "erased.")).To(Equal("call [erased]\n---\nno header"))
+		})
+
+		g.It("should only match whole addresses", func() {
+			mentions := MentionsAddress("ann@x.com")
+			Expect(mentions.MatchString("ann@x.com")).To(Equal(true))
+			Expect(mentions.MatchString("Ann <ANN@x.com>")).To(Equal(true))
+			Expect(mentions.MatchString("write to ann@x.com.")).To(Equal(true))
+			Expect(mentions.MatchString("joann@x.com")).To(Equal(false))
+			Expect(mentions.MatchString("jo.ann@x.com")).To(Equal(false))
+			Expect(mentions.MatchString("jo+ann@x.com")).To(Equal(false))
+			Expect(mentions.MatchString("ann@x.com.br")).To(Equal(false))
+			Expect(mentions.MatchString("ann@x.company")).To(Equal(false))
+
+			Expect(EraseMentions("ann@x.com, ann@x.com and joann@x.com", mentions)).To(Equal("[erased], [erased] and joann@x.com"))
+			Expect(EraseMentions("<ann@x.com> <ann@x.com>", mentions)).To(Equal("<[erased]> <[erased]>"))
+		})
+
+		g.It("should detect automated messages", func() {
+			message := func(from string, headers ...[]string) mailgunGo.StoredMessage {
+				return mailgunGo.StoredMessage{From: from, MessageHeaders: headers}
+			}
+			Expect(IsAutomated(message("Maria <maria@someone.com>"))).To(Equal(false))
+			Expect(IsAutomated(message("maria@someone.com", []string{"Auto-Submitted", "no"}))).To(Equal(false))
+			Expect(IsAutomated(message("maria@someone.com", []string{"Auto-Submitted", "auto-replied"}))).To(Equal(true))
+			Expect(IsAutomated(message("maria@someone.com", []string{"Precedence", "bulk"}))).To(Equal(true))
+			Expect(IsAutomated(message("maria@someone.com", []string{"List-Unsubscribe", "<mailto:x@y.com>"}))).To(Equal(true))
+			Expect(IsAutomated(message("maria@someone.com", []string{"X-Auto-Response-Suppress", "OOF, AutoReply"}))).To(Equal(true))
+			Expect(IsAutomated(message("maria@someone.com", []string{"Return-Path", "<>"}))).To(Equal(true))
+			Expect(IsAutomated(message("Mail Delivery System <MAILER-DAEMON@mx.com>"))).To(Equal(true))
+			Expect(IsAutomated(message("no-reply@shop.com"))).To(Equal(true))
+			Expect(IsAutomated(message("noreply+1234@shop.com"))).To(Equal(true))
+			Expect(IsAutomated(message("norena@shop.com"))).To(Equal(false))
+		})
+
 	})
 }
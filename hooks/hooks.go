@@ -0,0 +1,229 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// events our users' endpoints can subscribe to.
+const (
+	MAIL_RECEIVED    = "mail.received"
+	MAIL_SENT        = "mail.sent"
+	DELIVERY_FAILED  = "mail.failed"
+	CARD_CLOSED      = "card.closed"
+	SETTINGS_CHANGED = "settings.changed"
+	PING             = "ping" // only sent when the user asks for it
+)
+
+var Events = []string{MAIL_RECEIVED, MAIL_SENT, DELIVERY_FAILED, CARD_CLOSED, SETTINGS_CHANGED}
+
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL only accepts https endpoints, payloads may contain customer emails.
+// hostnames are only checked when delivering, as what they point to can change.
+func CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return errors.New("webhook endpoints must use https")
+	}
+	if u.Host == "" {
+		return errors.New("webhook endpoint has no host")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !Public(ip) {
+		return ErrNotPublic
+	}
+	return nil
+}
+
+var ErrNotPublic = errors.New("webhook endpoints must be on the public internet")
+
+// addresses of our own network, the machine itself and the cloud metadata service.
+var internal = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Public tells if an ip is somewhere we may send requests to.
+func Public(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range internal {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func NewSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func NewId() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Payload is the body of every request, Data depends on Event.
+type Payload struct {
+	Id      string      `json:"id"`
+	Event   string      `json:"event"`
+	Address string      `json:"address"`
+	Date    time.Time   `json:"date"`
+	Data    interface{} `json:"data"`
+}
+
+// Sign produces the X-BoardThreads-Signature header. the timestamp is signed along
+// with the body so receivers can refuse old requests being replayed:
+//
+//	t=<unix timestamp>,v1=<hex hmac-sha256 of "<timestamp>.<body>" with the endpoint secret>
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// the wait before each retry, after the first attempt fails.
+var schedule = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// Backoff is how long to wait after a number of failed attempts, false means give up.
+func Backoff(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts > len(schedule) {
+		return 0, false
+	}
+	return schedule[attempts-1], true
+}
+
+type Result struct {
+	StatusCode int
+	Error      string
+}
+
+func (r Result) Ok() bool {
+	return r.Error == "" && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+var client = newClient(Public)
+
+// newClient only connects to ips allowed says yes to. the name is resolved once and the
+// ip that was checked is the one dialed, so the name can't point somewhere else by then.
+func newClient(allowed func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				if len(ips) == 0 {
+					return nil, fmt.Errorf("no addresses for %s", host)
+				}
+				for _, ip := range ips {
+					if !allowed(ip.IP) {
+						return nil, ErrNotPublic
+					}
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// redirects would send the signed payload somewhere the user didn't register
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Deliver POSTs one payload, it never retries by itself.
+func Deliver(endpoint, secret, deliveryId, event string, body []byte) Result {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "BoardThreads-Webhooks/1.0")
+	req.Header.Set("X-BoardThreads-Event", event)
+	req.Header.Set("X-BoardThreads-Delivery", deliveryId)
+	req.Header.Set("X-BoardThreads-Signature", Sign(secret, time.Now().Unix(), body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	result := Result{StatusCode: resp.StatusCode}
+	if !result.Ok() {
+		result.Error = resp.Status
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestHooks(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("hooks", func() {
+
+		// the test servers are all local
+		public := client
+		allowLocal := func() { client = newClient(func(net.IP) bool { return true }) }
+		g.AfterEach(func() { client = public })
+
+		g.It("should only accept https urls", func() {
+			Expect(CheckURL("https://example.com/hooks")).To(Succeed())
+			Expect(CheckURL("http://example.com/hooks")).ToNot(Succeed())
+			Expect(CheckURL("https:///hooks")).ToNot(Succeed())
+			Expect(CheckURL("example.com")).ToNot(Succeed())
+		})
+
+		g.It("should not accept urls pointing to our own network", func() {
+			Expect(CheckURL("https://8.8.8.8/hooks")).To(Succeed())
+			Expect(CheckURL("https://127.0.0.1/hooks")).To(Equal(ErrNotPublic))
+			Expect(CheckURL("https://169.254.169.254/latest/meta-data")).To(Equal(ErrNotPublic))
+			Expect(CheckURL("https://[::1]:8443/hooks")).To(Equal(ErrNotPublic))
+		})
+
+		g.It("should tell public ips apart", func() {
+			for _, ip := range []string{"8.8.8.8", "151.101.1.69", "2606:4700::1111"} {
+				Expect(Public(net.ParseIP(ip))).To(BeTrue(), ip)
+			}
+			for _, ip := range []string{
+				"0.0.0.0", "10.1.2.3", "100.64.0.1", "127.0.0.1", "169.254.169.254",
+				"172.16.0.1", "192.168.1.1", "::", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+			} {
+				Expect(Public(net.ParseIP(ip))).To(BeFalse(), ip)
+			}
+		})
+
+		g.It("should know the events", func() {
+			Expect(ValidEvent(CARD_CLOSED)).To(BeTrue())
+			Expect(ValidEvent(PING)).To(BeFalse())
+		})
+
+		g.It("should sign the timestamp with the body", func() {
+			body := []byte(`{"event":"ping"}`)
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte("1500000000." + string(body)))
+			Expect(Sign("secret", 1500000000, body)).To(Equal("t=1500000000,v1=" + hex.EncodeToString(mac.Sum(nil))))
+			Expect(Sign("other", 1500000000, body)).ToNot(Equal(Sign("secret", 1500000000, body)))
+		})
+
+		g.It("should back off more and more, then give up", func() {
+			var last time.Duration
+			for attempts := 1; ; attempts++ {
+				wait, ok := Backoff(attempts)
+				if !ok {
+					Expect(attempts).To(BeNumerically(">", 3))
+					break
+				}
+				Expect(wait).To(BeNumerically(">", last))
+				last = wait
+			}
+			_, ok := Backoff(0)
+			Expect(ok).To(BeFalse())
+		})
+
+		g.It("should not deliver to our own network", func() {
+			delivered := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				delivered = true
+			}))
+			defer server.Close()
+
+			result := Deliver(server.URL, "secret", "d1", MAIL_SENT, []byte(`{}`))
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.Error).To(ContainSubstring(ErrNotPublic.Error()))
+
+			// names are checked by what they resolve to
+			result = Deliver(strings.Replace(server.URL, "127.0.0.1", "localhost", 1), "secret", "d1", MAIL_SENT, []byte(`{}`))
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.Error).To(ContainSubstring(ErrNotPublic.Error()))
+			Expect(delivered).To(BeFalse())
+		})
+
+		g.It("should deliver signed payloads", func() {
+			var signature, event, delivery, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signature = r.Header.Get("X-BoardThreads-Signature")
+				event = r.Header.Get("X-BoardThreads-Event")
+				delivery = r.Header.Get("X-BoardThreads-Delivery")
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				w.WriteHeader(204)
+			}))
+			defer server.Close()
+			allowLocal()
+
+			result := Deliver(server.URL, "secret", "d1", MAIL_SENT, []byte(`{"x":1}`))
+			Expect(result.Ok()).To(BeTrue())
+			Expect(result.StatusCode).To(Equal(204))
+			Expect(event).To(Equal(MAIL_SENT))
+			Expect(delivery).To(Equal("d1"))
+			Expect(body).To(Equal(`{"x":1}`))
+			Expect(strings.HasPrefix(signature, "t=")).To(BeTrue())
+			Expect(signature).To(ContainSubstring(",v1="))
+		})
+
+		g.It("should fail on errors and redirects", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/moved" {
+					http.Redirect(w, r, "/elsewhere", 302)
+					return
+				}
+				w.WriteHeader(500)
+			}))
+			defer server.Close()
+			allowLocal()
+
+			result := Deliver(server.URL, "secret", "d1", MAIL_SENT, []byte(`{}`))
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.StatusCode).To(Equal(500))
+			Expect(result.Error).ToNot(BeEmpty())
+
+			result = Deliver(server.URL+"/moved", "secret", "d1", MAIL_SENT, []byte(`{}`))
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.StatusCode).To(Equal(302))
+
+			result = Deliver("http://127.0.0.1:1", "secret", "d1", MAIL_SENT, []byte(`{}`))
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.Error).ToNot(BeEmpty())
+		})
+	})
+}
@@ -1,6 +1,11 @@
 package mailgun
 
-import "strings"
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
 
 func TrimSubject(subject string) string {
 	subject = strings.Trim(subject, " ")
@@ -20,3 +25,29 @@ func TrimSubject(subject string) string {
 	}
 	return strings.TrimSpace(subject)
 }
+
+// tags can't be empty, addresses without one don't thread by ticket.
+var subjectTag = regexp.MustCompile(`\[\s*([^\[\]#\s][^\[\]#]*?)\s*#(\d+)\s*\]`)
+
+// ParseSubjectTag finds a ticket tag like "[Support #1234]" in a subject.
+func ParseSubjectTag(subject string) (tag string, ticket int) {
+	match := subjectTag.FindStringSubmatch(subject)
+	if match == nil {
+		return "", 0
+	}
+	ticket, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0
+	}
+	return match[1], ticket
+}
+
+// TagSubject prepends the ticket tag to a subject, replacing any tag already there.
+func TagSubject(subject, tag string, ticket int) string {
+	subject = TrimSubject(subject)
+	if tag == "" || ticket == 0 {
+		return subject
+	}
+	subject = strings.TrimSpace(subjectTag.ReplaceAllString(subject, ""))
+	return fmt.Sprintf("[%s #%d] %s", tag, ticket, TrimSubject(subject))
+}
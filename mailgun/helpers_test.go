@@ -24,5 +24,30 @@ func TestDB(t *testing.T) {
 			Expect(TrimSubject("re: subject x ")).To(Equal("subject x"))
 		})
 
+		g.It("should parse ticket tags", func() {
+			tag, ticket := ParseSubjectTag("Re: [Support #1234] my printer")
+			Expect(tag).To(Equal("Support"))
+			Expect(ticket).To(Equal(1234))
+			tag, ticket = ParseSubjectTag("[ Help desk #7 ]")
+			Expect(tag).To(Equal("Help desk"))
+			Expect(ticket).To(Equal(7))
+			tag, ticket = ParseSubjectTag("order #1234 [urgent]")
+			Expect(tag).To(Equal(""))
+			Expect(ticket).To(Equal(0))
+			tag, ticket = ParseSubjectTag("Re: [#12] hi")
+			Expect(tag).To(Equal(""))
+			Expect(ticket).To(Equal(0))
+			tag, ticket = ParseSubjectTag("Re: [ #12] hi")
+			Expect(ticket).To(Equal(0))
+		})
+
+		g.It("should tag subjects", func() {
+			Expect(TagSubject("my printer", "Support", 12)).To(Equal("[Support #12] my printer"))
+			Expect(TagSubject("Re: [Support #12] my printer", "Support", 12)).To(Equal("[Support #12] my printer"))
+			Expect(TagSubject("RE: [Old #3] Re: my printer", "Support", 12)).To(Equal("[Support #12] my printer"))
+			Expect(TagSubject("re: my printer", "", 12)).To(Equal("my printer"))
+			Expect(TagSubject("re: my printer", "Support", 0)).To(Equal("my printer"))
+		})
+
 	})
 }
@@ -1,7 +1,9 @@
 package mailgun
 
 import (
+	"bt/metrics"
 	"fmt"
+	"net/http"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,6 +21,21 @@ type Settings struct {
 
 var Client mailgun.Mailgun
 var settings Settings
+var httpClient = &http.Client{Transport: metrics.Transport("mailgun", routes, nil)}
+
+// the mailgun paths we call, for metrics.
+var routes = metrics.NewRoutes("/{version:v[0-9]+}",
+	"/domains",
+	"/domains/{domain}",
+	"/domains/{domain}/verify",
+	"/domains/{domain}/webhooks",
+	"/domains/{domain}/webhooks/{webhook}",
+	"/routes",
+	"/routes/{route}",
+	"/{domain}/messages",
+	"/{domain}/messages.mime",
+	"/{domain}/events",
+)
 
 func init() {
 	var err error
@@ -28,6 +45,7 @@ func init() {
 	}
 
 	Client = mailgun.NewMailgun(settings.BaseDomain, settings.ApiKey, "")
+	Client.SetClient(httpClient)
 }
 
 func Send(params NewMessage) (messageId string, err error) {
@@ -35,6 +53,7 @@ func Send(params NewMessage) (messageId string, err error) {
 	localClient := Client
 	if params.Domain != settings.BaseDomain {
 		localClient = mailgun.NewMailgun(params.Domain, settings.ApiKey, "")
+		localClient.SetClient(httpClient)
 	}
 
 	from := params.From
@@ -55,6 +74,10 @@ func Send(params NewMessage) (messageId string, err error) {
 		message.SetTrackingClicks(false)
 		message.SetTrackingOpens(false)
 	}
+	if params.AutoReply {
+		message.AddHeader("Auto-Submitted", "auto-replied")
+		message.AddHeader("X-Auto-Response-Suppress", "All")
+	}
 	status, messageId, err := localClient.Send(message)
 	if err != nil {
 		log.Print("error sending email: ", status)
@@ -13,6 +13,7 @@ type NewMessage struct {
 	ReplyTo       string
 	CardId        string
 	CommenterId   string
+	AutoReply     bool // mark the message as automatic so other robots don't answer it
 }
 
 type Domain struct {
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bt/access"
+	"bt/blobs"
+	"bt/db"
+	"bt/events"
+	"bt/metrics"
+	"bt/sessions"
 	"encoding/json"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -15,7 +22,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/cors"
-	"github.com/segmentio/analytics-go"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
@@ -29,16 +35,26 @@ type Settings struct {
 	MailgunAPIKey  string `envconfig:"MAILGUN_API_KEY"`
 	TrelloBotId    string `envconfig:"TRELLO_BOT_ID"`
 	SegmentioKey   string `envconfig:"SEGMENTIO_WRITE_KEY"`
+	MetricsToken   string `envconfig:"METRICS_TOKEN"`
+
+	OldSessionSecrets  string `envconfig:"OLD_SESSION_SECRETS"`  // comma-separated, still accepted while rotating SESSION_SECRET
+	ReplyAddressSecret string `envconfig:"REPLY_ADDRESS_SECRET"` // signs the reply address of each card, empty to not use them
+
+	AnalyticsSinks      string `envconfig:"ANALYTICS_SINKS"` // comma-separated: segment, file, webhook or none
+	AnalyticsFile       string `envconfig:"ANALYTICS_FILE"`
+	AnalyticsWebhookURL string `envconfig:"ANALYTICS_WEBHOOK_URL"`
+
+	BlobStore string `envconfig:"BLOB_STORE" default:"data/blobs"` // "memory:" or a directory
 }
 
 var settings Settings
 var router *mux.Router
-var segment *analytics.Client
+var tracking *events.Bus
+var archive blobs.Store
 
 func main() {
 	envconfig.Process("", &settings)
 
-	segment = analytics.New(settings.SegmentioKey)
 	setValidators()
 
 	log.SetLevel(log.DebugLevel)
@@ -47,11 +63,22 @@ func main() {
 		DisableTimestamp: true,
 	})
 
+	tracking = events.NewBus(db.AnalyticsOptedOut, analyticsSinks()...)
+
+	keyring = sessions.NewKeyring(settings.SessionSecret, strings.Split(settings.OldSessionSecrets, ",")...)
+
+	var err error
+	archive, err = blobs.Open(settings.BlobStore)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err.Error(),
+			"store": settings.BlobStore,
+		}).Fatal("couldn't open the blob store")
+	}
+
 	jwtMiddle := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return []byte(settings.SessionSecret), nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
+		ValidationKeyGetter: sessionKey,
+		SigningMethod:       jwt.SigningMethodHS256,
 	})
 
 	middle := interpose.New()
@@ -81,26 +108,60 @@ func main() {
 	router = mux.NewRouter()
 	middle.UseHandler(router)
 
+	// routes that need a session, checked against their rule in access/access.go
+	guard := &access.Guard{
+		Router: router,
+		Session: func(next http.Handler) http.Handler {
+			return jwtMiddle.Handler(checkSession(next))
+		},
+		UserId: sessionUser,
+		Lookup: accessStore().Level,
+		Denied: accessDenied,
+	}
+	protected := guard.Handle
+
+	router.Path("/metrics").Methods("GET").Handler(metrics.Handler(settings.MetricsToken))
 	router.Path("/api/session").Methods("POST").HandlerFunc(SetSession)
-	router.Path("/api/account").Methods("GET").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(GetAccount)))
-	router.Path("/api/account").Methods("PUT").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(SetAccount)))
-	router.Path("/api/addresses/{address}").Methods("GET").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(GetAddress)))
-	router.Path("/api/addresses/{address}").Methods("PUT").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(SetAddress)))
-	router.Path("/api/addresses/{address}").Methods("DELETE").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(DeleteAddress)))
-	router.Path("/api/addresses/{address}/settings").Methods("PUT").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(ChangeAddressSettings)))
-	router.Path("/api/check-dns/{domain}").Methods("POST").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(CheckDomainDNS)))
-
-	router.Path("/billing/{address}/paypal").Methods("GET").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(UpgradeList)))
-	router.Path("/billing/{address}/paypal").Methods("DELETE").
-		Handler(jwtMiddle.Handler(http.HandlerFunc(DowngradeAddress)))
+	router.Path("/api/session/refresh").Methods("POST").HandlerFunc(RefreshSession)
+	protected("DELETE", "/api/session", Logout)
+	protected("DELETE", "/api/sessions", LogoutEverywhere)
+	protected("GET", "/api/account", GetAccount)
+	protected("PUT", "/api/account", SetAccount)
+	protected("GET", "/api/addresses/{address}", GetAddress)
+	protected("PUT", "/api/addresses/{address}", SetAddress)
+	protected("DELETE", "/api/addresses/{address}", DeleteAddress)
+	protected("PUT", "/api/addresses/{address}/settings", ChangeAddressSettings)
+	protected("GET", "/api/addresses/{address}/sla", GetAddressSLA)
+	protected("GET", "/api/cards/{card}/sla", GetCardSLA)
+	protected("GET", "/api/addresses/{address}/statuses", GetAddressStatuses)
+	protected("GET", "/api/cards/{card}/status", GetCardStatus)
+	protected("GET", "/api/cards/{card}/export", ExportThread)
+	protected("POST", "/api/cards/{card}/merge", MergeCard)
+	protected("POST", "/api/cards/{card}/split", SplitCard)
+	protected("GET", "/api/contacts", GetContacts)
+	protected("GET", "/api/contacts/{contact}", GetContact)
+	protected("GET", "/api/privacy/export", ExportSubjectData)
+	protected("POST", "/api/privacy/erase", EraseSubjectData)
+	protected("GET", "/api/privacy/requests", GetPrivacyRequests)
+	protected("GET", "/api/addresses/{address}/reports", GetAddressReport)
+	protected("GET", "/api/addresses/{address}/aliases", GetAliases)
+	protected("POST", "/api/addresses/{address}/aliases", AddAlias)
+	protected("PUT", "/api/addresses/{address}/aliases/primary", SetPrimaryAlias)
+	protected("DELETE", "/api/addresses/{address}/aliases/{alias}", RemoveAlias)
+	protected("GET", "/api/addresses/{address}/members", GetMembers)
+	protected("PUT", "/api/addresses/{address}/members/{member}", SetMember)
+	protected("DELETE", "/api/addresses/{address}/members/{member}", RemoveMember)
+	protected("GET", "/api/addresses/{address}/endpoints", GetEndpoints)
+	protected("POST", "/api/addresses/{address}/endpoints", CreateEndpoint)
+	protected("DELETE", "/api/addresses/{address}/endpoints/{endpoint}", DeleteEndpoint)
+	protected("GET", "/api/addresses/{address}/endpoints/{endpoint}/deliveries", GetEndpointDeliveries)
+	protected("POST", "/api/addresses/{address}/endpoints/{endpoint}/ping", PingEndpoint)
+	protected("GET", "/api/search", SearchMails)
+	protected("GET", "/api/mails", GetMail)
+	protected("POST", "/api/check-dns/{domain}", CheckDomainDNS)
+
+	protected("GET", "/billing/{address}/paypal", UpgradeList)
+	protected("DELETE", "/billing/{address}/paypal", DowngradeAddress)
 	router.Path("/billing/{address}/paypal/success").Methods("GET").
 		Handler(http.HandlerFunc(PaypalSuccess)).
 		Name("paypal-success")
@@ -129,11 +190,14 @@ func main() {
 		},
 	}
 
+	startScheduler()
+
 	log.Print("Listening at " + settings.Port + "...")
 	stop := server.StopChan()
 	server.ListenAndServe()
 
 	<-stop
+	tracking.Close()
 	log.Print("Exiting...")
 }
 
@@ -169,3 +233,36 @@ func randStringBytesMaskImprSrc(src rand.Source, n int) string {
 
 	return string(b)
 }
+
+func analyticsSinks() (sinks []events.Sink) {
+	names := settings.AnalyticsSinks
+	if names == "" && settings.SegmentioKey != "" {
+		// what we did before sinks were configurable
+		names = "segment"
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "segment":
+			sinks = append(sinks, events.NewSegmentSink(settings.SegmentioKey))
+		case "file":
+			sink, err := events.NewFileSink(settings.AnalyticsFile)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":  err.Error(),
+					"file": settings.AnalyticsFile,
+				}).Fatal("couldn't open the analytics file")
+			}
+			sinks = append(sinks, sink)
+		case "webhook":
+			if settings.AnalyticsWebhookURL == "" {
+				log.Fatal("ANALYTICS_WEBHOOK_URL is needed by the webhook analytics sink")
+			}
+			sinks = append(sinks, events.NewWebhookSink(settings.AnalyticsWebhookURL))
+		default:
+			log.WithField("sink", name).Fatal("unknown analytics sink")
+		}
+	}
+	return sinks
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bt/db"
+	"bt/trello"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// board members get roles on addresses, see db/roles.go.
+
+func GetMembers(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	members, err := db.ListMembers(address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func SetMember(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   invites a trello user, by id or username, with {role: "admin"|"agent"|"viewer"}.
+	   "none" revokes them, even if they are members of the board.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	data := struct {
+		Role db.Role `json:"role"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	if !data.Role.ValidGrant() && data.Role != db.NO_ROLE {
+		sendJSONError(w, errors.New("invalid role: "+string(data.Role)), 400, logger)
+		return
+	}
+
+	member, err := trello.Client.Member(vars["member"])
+	if err != nil {
+		sendJSONError(w, errors.New("couldn't find trello user "+vars["member"]), 404, logger)
+		return
+	}
+	if member.Id == userId {
+		sendJSONError(w, errors.New("the owner's role can't be changed"), 400, logger)
+		return
+	}
+
+	err = db.SetRole(address, member.Id, data.Role, userId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":    userId,
+		"address": address,
+		"member":  member.Id,
+		"role":    data.Role,
+	}).Info("set member role")
+
+	members, err := db.ListMembers(address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func RemoveMember(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   forgets an invite or revocation, the user gets back whatever role their board
+	   membership gives them.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	vars := mux.Vars(r)
+	address := vars["address"] + "@" + settings.BaseDomain
+
+	err := db.RemoveRole(address, vars["member"])
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":    userId,
+		"address": address,
+		"member":  vars["member"],
+	}).Info("removed member role")
+
+	w.WriteHeader(200)
+}
@@ -0,0 +1,23 @@
+package metrics
+
+var (
+	InboundMails = NewCounter("bt_inbound_mails_total",
+		"Emails received from mailgun, by how they were handled.", "result")
+	InboundMailDuration = NewHistogram("bt_inbound_mail_duration_seconds",
+		"Time taken to post an incoming email to trello.", nil)
+	CardsCreated = NewCounter("bt_cards_created_total",
+		"Cards created, by what created them.", "source")
+	AttachmentUploads = NewCounter("bt_attachment_uploads_total",
+		"Attachments uploaded to trello cards, by result.", "result")
+	OutboundMails = NewCounter("bt_outbound_mails_total",
+		"Emails sent through mailgun, by kind and result.", "kind", "result")
+	MailgunFailures = NewCounter("bt_mailgun_failures_total",
+		"Delivery failures reported by mailgun.")
+	WebhookDecodeErrors = NewCounter("bt_webhook_decode_errors_total",
+		"Webhook payloads we couldn't understand, by webhook.", "webhook")
+	WebhookDeliveries = NewCounter("bt_webhook_deliveries_total",
+		"Attempts at delivering events to our users' endpoints, by result.", "result")
+
+	ExternalCallDuration = NewHistogram("bt_external_call_duration_seconds",
+		"Latency of calls to trello, mailgun and neo4j, by operation.", nil, "service", "operation")
+)
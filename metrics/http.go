@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Handler serves the metrics to whoever has the token, either as a
+// "Bearer" authorization or as the "token" query parameter.
+// An empty token disables the endpoint.
+func Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		given := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteAll(w)
+	})
+}
+
+type transport struct {
+	service string
+	routes  *Routes
+	next    http.RoundTripper
+}
+
+// Transport times every request made through next as calls to service,
+// with the operation being the method and the route the path matched.
+func Transport(service string, routes *Routes, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{service, routes, next}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer ExternalCallDuration.Since(time.Now(), t.service, t.routes.Operation(req.Method, req.URL.Path))
+	return t.next.RoundTrip(req)
+}
+
+// Routes are the path templates of an api we call. ids are told apart by where they
+// are on the path, each variable of a template becomes a placeholder.
+type Routes struct {
+	router *mux.Router
+}
+
+// NewRoutes takes the templates in the order they should be tried, prefix is matched
+// but left out of the operation names.
+func NewRoutes(prefix string, templates ...string) *Routes {
+	router := mux.NewRouter()
+	for _, template := range templates {
+		router.Path(prefix + template).Name(template)
+	}
+	return &Routes{router}
+}
+
+var templateVar = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+// Operation turns "GET /1/cards/5720b4fa8d6d8c4f4eb9b6d2/actions" into
+// "GET /cards/:card/actions" so labels don't explode. paths that match no
+// template are all counted together.
+func (rs *Routes) Operation(method, path string) string {
+	var match mux.RouteMatch
+	req := &http.Request{Method: method, URL: &url.URL{Path: path}}
+	if rs == nil || !rs.router.Match(req, &match) {
+		return method + " other"
+	}
+	return method + " " + templateVar.ReplaceAllString(match.Route.GetName(), ":$1")
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestMetrics(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("metrics", func() {
+
+		g.It("should count by label", func() {
+			c := NewCounter("test_things_total", "Things.", "kind")
+			c.Inc("a")
+			c.Inc("a")
+			c.Add(3, "b")
+			Expect(c.Value("a")).To(Equal(2.0))
+			Expect(c.Value("b")).To(Equal(3.0))
+
+			var buf bytes.Buffer
+			c.write(&buf)
+			Expect(buf.String()).To(Equal(`# HELP test_things_total Things.
+# TYPE test_things_total counter
+test_things_total{kind="a"} 2
+test_things_total{kind="b"} 3
+`))
+		})
+
+		g.It("should show unlabelled counters even before counting", func() {
+			var buf bytes.Buffer
+			NewCounter("test_nothing_total", "Nothing.").write(&buf)
+			Expect(buf.String()).To(ContainSubstring("\ntest_nothing_total 0\n"))
+		})
+
+		g.It("should put observations in cumulative buckets", func() {
+			h := NewHistogram("test_latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+			h.Observe(0.05, "get")
+			h.Observe(0.5, "get")
+			h.Observe(5, "get")
+			Expect(h.Count("get")).To(BeEquivalentTo(3))
+			Expect(h.Count("put")).To(BeEquivalentTo(0))
+
+			var buf bytes.Buffer
+			h.write(&buf)
+			Expect(buf.String()).To(Equal(`# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="get",le="0.1"} 1
+test_latency_seconds_bucket{op="get",le="1"} 2
+test_latency_seconds_bucket{op="get",le="+Inf"} 3
+test_latency_seconds_sum{op="get"} 5.55
+test_latency_seconds_count{op="get"} 3
+`))
+		})
+
+		g.It("should name operations by their route", func() {
+			trello := NewRoutes("/1", "/members/me", "/members/{member}", "/cards/{card}/actions", "/cards/{card}/idLabels")
+			Expect(trello.Operation("GET", "/1/cards/5720b4fa8d6d8c4f4eb9b6d2/actions")).To(Equal("GET /cards/:card/actions"))
+			Expect(trello.Operation("PUT", "/1/cards/x7Ae2b9Q/idLabels")).To(Equal("PUT /cards/:card/idLabels"))
+			Expect(trello.Operation("PUT", "/1/cards/xAebQ/idLabels")).To(Equal("PUT /cards/:card/idLabels"))
+			Expect(trello.Operation("GET", "/1/members/me")).To(Equal("GET /members/me"))
+			Expect(trello.Operation("GET", "/1/members/fiatjaf")).To(Equal("GET /members/:member"))
+			Expect(trello.Operation("GET", "/1/boards/5720b4fa8d6d8c4f4eb9b6d2")).To(Equal("GET other"))
+			Expect(trello.Operation("GET", "/2/members/me")).To(Equal("GET other"))
+
+			mailgun := NewRoutes("/{version:v[0-9]+}", "/domains/{domain}", "/{domain}/messages")
+			Expect(mailgun.Operation("POST", "/v3/mail.maria.com/messages")).To(Equal("POST /:domain/messages"))
+			Expect(mailgun.Operation("GET", "/v2/domains/mail.maria.com")).To(Equal("GET /domains/:domain"))
+
+			var none *Routes
+			Expect(none.Operation("GET", "/anything/123")).To(Equal("GET other"))
+		})
+
+		g.It("should only serve metrics with the token", func() {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/metrics", nil)
+			Handler("").ServeHTTP(w, r)
+			Expect(w.Code).To(Equal(404))
+
+			w = httptest.NewRecorder()
+			Handler("s3cret").ServeHTTP(w, r)
+			Expect(w.Code).To(Equal(401))
+
+			w = httptest.NewRecorder()
+			r.Header.Set("Authorization", "Bearer s3cret")
+			Handler("s3cret").ServeHTTP(w, r)
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(ContainSubstring("# TYPE bt_inbound_mails_total counter"))
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("GET", "/metrics?token=s3cret", nil)
+			Handler("s3cret").ServeHTTP(w, r)
+			Expect(w.Code).To(Equal(200))
+		})
+
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bt/db"
+	"bt/export"
+	"bt/helpers"
+	"bt/hooks"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+)
+
+// answers to data subjects, people on the other side of the threads asking what we
+// hold on them or to be forgotten. every run leaves an audit record.
+
+func subjectAddress(raw string) (string, error) {
+	address, _ := helpers.ParseContact(raw)
+	if !strings.Contains(address, "@") {
+		return "", errors.New("an email address is needed")
+	}
+	return address, nil
+}
+
+// subjectHash identifies the subject in the audit records without keeping their address.
+func subjectHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(address)))
+	return hex.EncodeToString(sum[:])
+}
+
+func ExportSubjectData(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   a zip with everything we hold on an external address, ?address=
+	   record.json lists every mail and card, mails/ has the messages.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	address, err := subjectAddress(r.URL.Query().Get("address"))
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	mails, err := db.FindSubjectMails(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	type recordMail struct {
+		Id       string    `json:"id"`
+		Address  string    `json:"address"`
+		Card     string    `json:"card,omitempty"`
+		Date     time.Time `json:"date"`
+		Subject  string    `json:"subject,omitempty"`
+		From     string    `json:"from,omitempty"`
+		Inbound  bool      `json:"inbound"`
+		Archived bool      `json:"archived"`
+	}
+	record := struct {
+		Subject   string       `json:"subject"`
+		Generated time.Time    `json:"generated"`
+		Mails     []recordMail `json:"mails"`
+	}{address, time.Now().UTC(), make([]recordMail, 0, len(mails))}
+	cards := make(map[string]bool)
+	for _, m := range mails {
+		rm := recordMail{
+			Id:       m.Id,
+			Address:  m.Address,
+			Date:     time.Unix(0, m.Date*int64(time.Millisecond)).UTC(),
+			Subject:  m.Subject,
+			From:     m.From,
+			Inbound:  m.Inbound,
+			Archived: m.Body != "",
+		}
+		if m.CardShortLink != "" {
+			rm.Card = "https://trello.com/c/" + m.CardShortLink
+			cards[m.CardId] = true
+		}
+		record.Mails = append(record.Mails, rm)
+	}
+	recordJSON, _ := json.MarshalIndent(record, "", "  ")
+
+	var buf bytes.Buffer
+	err = export.WriteEMLZipWith(&buf, map[string][]byte{"record.json": recordJSON}, "mails", SubjectAccessFlow(mails))
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	err = db.SavePrivacyRequest(userId, db.PrivacyRequest{
+		Id:          hooks.NewId(),
+		Kind:        "export",
+		SubjectHash: subjectHash(address),
+		Mails:       len(mails),
+		Cards:       len(cards),
+		Trello:      TRELLO_KEEP,
+	})
+	if err != nil {
+		// no export without its audit record
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="subject-access.zip"`)
+	w.Write(buf.Bytes())
+}
+
+func EraseSubjectData(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   erases an external address from all the user's addresses: archived bodies and
+	   attachments are deleted and the mails anonymized.
+	   "trello" is what to do with the comments: "keep" (default), "redact" or "delete".
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	data := struct {
+		Address string `json:"address"`
+		Trello  string `json:"trello"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	address, err := subjectAddress(data.Address)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+	switch data.Trello {
+	case "":
+		data.Trello = TRELLO_KEEP
+	case TRELLO_KEEP, TRELLO_REDACT, TRELLO_DELETE:
+	default:
+		sendJSONError(w, errors.New(`trello should be "keep", "redact" or "delete"`), 400, logger)
+		return
+	}
+
+	mails, err := db.FindSubjectMails(userId, address)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	// no erasure without its audit record, it is saved first and completed after
+	id := hooks.NewId()
+	err = db.SavePrivacyRequest(userId, db.PrivacyRequest{
+		Id:          id,
+		Kind:        "erasure",
+		SubjectHash: subjectHash(address),
+		Mails:       len(mails),
+		Trello:      data.Trello,
+	})
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	request := EraseSubjectFlow(userId, address, mails, data.Trello)
+	request.Id = id
+	request.SubjectHash = subjectHash(address)
+	err = db.CompletePrivacyRequest(userId, request)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"err":     err,
+			"request": request,
+		}).Error("couldn't complete the audit record of an erasure")
+	}
+	request.Date = time.Now().UnixNano() / int64(time.Millisecond)
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+func GetPrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	requests, err := db.ListPrivacyRequests(userId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
@@ -0,0 +1,68 @@
+package reports
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var Tables = []string{"daily", "weekly", "senders", "members"}
+
+func ValidTable(table string) bool {
+	for _, t := range Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCSV writes one of the tables of the report, CSV can't hold all of them at once.
+func WriteCSV(w io.Writer, report Report, table string) error {
+	var rows [][]string
+
+	switch table {
+	case "daily", "weekly":
+		buckets := report.Daily
+		if table == "weekly" {
+			buckets = report.Weekly
+		}
+		rows = append(rows, []string{
+			"start", "inbound", "outbound", "new_threads", "answered",
+			"median_first_response_seconds", "p90_first_response_seconds",
+		})
+		for _, b := range buckets {
+			rows = append(rows, []string{
+				b.Start,
+				strconv.Itoa(b.Inbound),
+				strconv.Itoa(b.Outbound),
+				strconv.Itoa(b.NewThreads),
+				strconv.Itoa(b.Answered),
+				strconv.FormatInt(b.MedianFirstResponse, 10),
+				strconv.FormatInt(b.P90FirstResponse, 10),
+			})
+		}
+	case "senders", "members":
+		counts := report.Senders
+		header := []string{"sender", "messages"}
+		if table == "members" {
+			counts = report.Members
+			header = []string{"member", "name", "replies"}
+		}
+		rows = append(rows, header)
+		for _, c := range counts {
+			if table == "members" {
+				rows = append(rows, []string{c.Key, c.Name, strconv.Itoa(c.Count)})
+			} else {
+				rows = append(rows, []string{c.Key, strconv.Itoa(c.Count)})
+			}
+		}
+	default:
+		return fmt.Errorf("unknown report table %s", table)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.WriteAll(rows)
+	return writer.Error()
+}
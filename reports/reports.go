@@ -0,0 +1,234 @@
+package reports
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is one mail of a thread, as far as reports care.
+type Message struct {
+	Thread  string
+	Date    time.Time
+	Inbound bool
+	From    string // the customer, for inbound messages
+	Member  string // who replied, for outbound messages
+}
+
+// Bucket is a day or a week of activity. first response times are of the threads
+// created in the bucket, in seconds.
+type Bucket struct {
+	Start               string `json:"start"`
+	Inbound             int    `json:"inbound"`
+	Outbound            int    `json:"outbound"`
+	NewThreads          int    `json:"newThreads"`
+	Answered            int    `json:"answered"`
+	MedianFirstResponse int64  `json:"medianFirstResponse"`
+	P90FirstResponse    int64  `json:"p90FirstResponse"`
+}
+
+type Count struct {
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Count int    `json:"count"`
+}
+
+type Report struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	TimeZone string   `json:"timezone"`
+	Total    Bucket   `json:"total"`
+	Daily    []Bucket `json:"daily"`
+	Weekly   []Bucket `json:"weekly"`
+	Senders  []Count  `json:"topSenders"`
+	Members  []Count  `json:"members"`
+}
+
+const TOP_SENDERS = 10
+
+const DAY = "2006-01-02"
+
+// Build aggregates messages between the days from and to, both included, as seen in loc.
+// messages must contain every message of the threads involved, even the ones outside
+// the range, so we can tell new threads from old ones.
+func Build(messages []Message, from, to time.Time, loc *time.Location) Report {
+	start := day(from, loc)
+	end := day(to, loc).AddDate(0, 0, 1)
+
+	report := Report{
+		From:     start.Format(DAY),
+		To:       end.AddDate(0, 0, -1).Format(DAY),
+		TimeZone: loc.String(),
+		Senders:  make([]Count, 0),
+		Members:  make([]Count, 0),
+	}
+
+	daily := newBuckets(start, end, 1)
+	weekly := newBuckets(weekStart(start), end, 7)
+	var total bucketStats
+	senders := make(map[string]int)
+	members := make(map[string]int)
+
+	sorted := make([]Message, len(messages))
+	copy(sorted, messages)
+	sort.Stable(byDate(sorted))
+
+	threads := make(map[string]*thread)
+	for _, m := range sorted {
+		t, ok := threads[m.Thread]
+		if !ok {
+			t = &thread{start: m.Date, inbound: m.Inbound}
+			threads[m.Thread] = t
+		} else if t.inbound && !m.Inbound && t.firstResponse.IsZero() {
+			t.firstResponse = m.Date
+		}
+
+		if m.Date.Before(start) || !m.Date.Before(end) {
+			continue
+		}
+		local := m.Date.In(loc)
+		for _, stats := range []*bucketStats{daily.at(local), weekly.at(local), &total} {
+			if m.Inbound {
+				stats.Inbound++
+			} else {
+				stats.Outbound++
+			}
+		}
+		if m.Inbound && m.From != "" {
+			senders[strings.ToLower(m.From)]++
+		} else if !m.Inbound && m.Member != "" {
+			members[m.Member]++
+		}
+	}
+
+	for _, t := range threads {
+		if t.start.Before(start) || !t.start.Before(end) {
+			continue
+		}
+		local := t.start.In(loc)
+		for _, stats := range []*bucketStats{daily.at(local), weekly.at(local), &total} {
+			stats.NewThreads++
+			if t.inbound && !t.firstResponse.IsZero() {
+				stats.responses = append(stats.responses, t.firstResponse.Sub(t.start))
+			}
+		}
+	}
+
+	report.Total = total.bucket(report.From)
+	report.Daily = daily.result()
+	report.Weekly = weekly.result()
+	report.Senders = top(senders, TOP_SENDERS)
+	report.Members = top(members, 0)
+	return report
+}
+
+// Percentile by the nearest-rank method, durations must be sorted.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type thread struct {
+	start         time.Time
+	inbound       bool // started by a customer
+	firstResponse time.Time
+}
+
+type bucketStats struct {
+	Bucket
+	responses []time.Duration
+}
+
+func (s *bucketStats) bucket(start string) Bucket {
+	b := s.Bucket
+	b.Start = start
+	b.Answered = len(s.responses)
+	sort.Sort(byDuration(s.responses))
+	b.MedianFirstResponse = int64(Percentile(s.responses, .5) / time.Second)
+	b.P90FirstResponse = int64(Percentile(s.responses, .9) / time.Second)
+	return b
+}
+
+type buckets struct {
+	starts []time.Time
+	stats  []bucketStats
+}
+
+func newBuckets(start, end time.Time, days int) *buckets {
+	b := &buckets{}
+	for s := start; s.Before(end); s = s.AddDate(0, 0, days) {
+		b.starts = append(b.starts, s)
+		b.stats = append(b.stats, bucketStats{})
+	}
+	return b
+}
+
+// at returns the bucket for a local time, which is always inside the range.
+func (b *buckets) at(local time.Time) *bucketStats {
+	i := sort.Search(len(b.starts), func(i int) bool { return b.starts[i].After(local) }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return &b.stats[i]
+}
+
+func (b *buckets) result() []Bucket {
+	result := make([]Bucket, len(b.stats))
+	for i := range b.stats {
+		result[i] = b.stats[i].bucket(b.starts[i].Format(DAY))
+	}
+	return result
+}
+
+func day(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// weeks start on monday.
+func weekStart(d time.Time) time.Time {
+	offset := (int(d.Weekday()) + 6) % 7
+	return d.AddDate(0, 0, -offset)
+}
+
+func top(counts map[string]int, limit int) []Count {
+	result := make([]Count, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, Count{Key: key, Count: count})
+	}
+	sort.Sort(byCount(result))
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+type byDate []Message
+
+func (s byDate) Len() int           { return len(s) }
+func (s byDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDate) Less(i, j int) bool { return s[i].Date.Before(s[j].Date) }
+
+type byDuration []time.Duration
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
+
+type byCount []Count
+
+func (s byCount) Len() int      { return len(s) }
+func (s byCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Key < s[j].Key
+}
@@ -0,0 +1,122 @@
+package reports
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestReports(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	at := func(s string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", s, saoPaulo)
+		return t
+	}
+
+	// monday 2016-07-04 to sunday 2016-07-10, then monday 2016-07-11
+	messages := []Message{
+		// an old thread, answered again in the range
+		{Thread: "old", Date: at("2016-06-20 10:00"), Inbound: true, From: "old@customer.com"},
+		{Thread: "old", Date: at("2016-07-04 10:00"), Inbound: true, From: "Old@customer.com"},
+		{Thread: "old", Date: at("2016-07-04 11:00"), Member: "ana"},
+		// answered in one hour
+		{Thread: "a", Date: at("2016-07-04 09:00"), Inbound: true, From: "a@customer.com"},
+		{Thread: "a", Date: at("2016-07-04 10:00"), Member: "ana"},
+		{Thread: "a", Date: at("2016-07-04 10:30"), Inbound: true, From: "a@customer.com"},
+		// answered in three hours, late at night in são paulo is the next day in utc
+		{Thread: "b", Date: at("2016-07-05 22:00"), Inbound: true, From: "b@customer.com"},
+		{Thread: "b", Date: at("2016-07-06 01:00"), Member: "bia"},
+		// never answered
+		{Thread: "c", Date: at("2016-07-06 09:00"), Inbound: true, From: "c@customer.com"},
+		// started by us
+		{Thread: "d", Date: at("2016-07-07 09:00"), Member: "bia"},
+		// answered after the range ends
+		{Thread: "e", Date: at("2016-07-10 23:00"), Inbound: true, From: "a@customer.com"},
+		{Thread: "e", Date: at("2016-07-11 09:00"), Member: "ana"},
+	}
+
+	report := Build(messages, at("2016-07-04 00:00"), at("2016-07-10 00:00"), saoPaulo)
+
+	g.Describe("reports", func() {
+
+		g.It("should cover the range", func() {
+			Expect(report.From).To(Equal("2016-07-04"))
+			Expect(report.To).To(Equal("2016-07-10"))
+			Expect(report.TimeZone).To(Equal("America/Sao_Paulo"))
+			Expect(report.Daily).To(HaveLen(7))
+			Expect(report.Weekly).To(HaveLen(1))
+			Expect(report.Weekly[0].Start).To(Equal("2016-07-04"))
+		})
+
+		g.It("should count messages and new threads", func() {
+			Expect(report.Total.Inbound).To(Equal(6))
+			Expect(report.Total.Outbound).To(Equal(4))
+			Expect(report.Total.NewThreads).To(Equal(5))
+			Expect(report.Weekly[0].Inbound).To(Equal(report.Total.Inbound))
+
+			Expect(report.Daily[0].Start).To(Equal("2016-07-04"))
+			Expect(report.Daily[0].Inbound).To(Equal(3))
+			Expect(report.Daily[0].Outbound).To(Equal(2))
+			Expect(report.Daily[0].NewThreads).To(Equal(1))
+			Expect(report.Daily[1].Inbound).To(Equal(1)) // the 22:00 message stays on the 5th
+			Expect(report.Daily[1].Outbound).To(Equal(0))
+		})
+
+		g.It("should compute first response times of the new threads", func() {
+			Expect(report.Total.Answered).To(Equal(3))
+			Expect(report.Total.MedianFirstResponse).To(Equal(int64(3 * 60 * 60)))
+			Expect(report.Total.P90FirstResponse).To(Equal(int64(10 * 60 * 60)))
+			Expect(report.Daily[0].MedianFirstResponse).To(Equal(int64(60 * 60)))
+			Expect(report.Daily[2].Answered).To(Equal(0))
+			Expect(report.Daily[2].MedianFirstResponse).To(Equal(int64(0)))
+		})
+
+		g.It("should rank senders and members", func() {
+			Expect(report.Senders[0]).To(Equal(Count{Key: "a@customer.com", Count: 3}))
+			Expect(report.Senders).To(HaveLen(4))
+			Expect(report.Members).To(Equal([]Count{
+				{Key: "ana", Count: 2},
+				{Key: "bia", Count: 2},
+			}))
+		})
+
+		g.It("should split weeks on mondays", func() {
+			r := Build(messages, at("2016-07-06 00:00"), at("2016-07-11 00:00"), saoPaulo)
+			Expect(r.Weekly).To(HaveLen(2))
+			Expect(r.Weekly[0].Start).To(Equal("2016-07-04"))
+			Expect(r.Weekly[1].Start).To(Equal("2016-07-11"))
+			Expect(r.Weekly[1].Outbound).To(Equal(1))
+		})
+
+		g.It("should take percentiles by nearest rank", func() {
+			durations := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+			Expect(Percentile(durations, .5)).To(Equal(time.Duration(5)))
+			Expect(Percentile(durations, .9)).To(Equal(time.Duration(9)))
+			Expect(Percentile(nil, .9)).To(Equal(time.Duration(0)))
+		})
+
+		g.It("should write tables as csv", func() {
+			var buf bytes.Buffer
+			Expect(WriteCSV(&buf, report, "daily")).To(Succeed())
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			Expect(lines).To(HaveLen(8))
+			Expect(lines[0]).To(HavePrefix("start,inbound,outbound,new_threads"))
+			Expect(lines[1]).To(Equal("2016-07-04,3,2,1,1,3600,3600"))
+
+			buf.Reset()
+			Expect(WriteCSV(&buf, report, "members")).To(Succeed())
+			Expect(buf.String()).To(Equal("member,name,replies\nana,,2\nbia,,2\n"))
+
+			Expect(WriteCSV(&buf, report, "nothing")).ToNot(Succeed())
+			Expect(ValidTable("weekly")).To(BeTrue())
+		})
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type job struct {
+	name  string
+	every time.Duration
+	run   func()
+}
+
+var jobs = []job{
+	{"sla-breaches", time.Minute, CheckSLABreachesFlow},
+	{"reminders", 5 * time.Minute, RemindAwaitingThreadsFlow},
+	{"webhook-deliveries", time.Minute, RetryWebhookDeliveriesFlow},
+	{"webhook-log", 24 * time.Hour, PruneWebhookDeliveriesFlow},
+	{"contacts-backfill", time.Hour, BackfillContactsFlow},
+	{"inbound-receipts", 24 * time.Hour, PruneReceiptsFlow},
+	{"board-members", time.Hour, SyncBoardMembersFlow},
+	{"sessions", 24 * time.Hour, PruneSessionsFlow},
+}
+
+func startScheduler() {
+	for _, j := range jobs {
+		go func(j job) {
+			ticker := time.NewTicker(j.every)
+			for range ticker.C {
+				runJob(j)
+			}
+		}(j)
+	}
+}
+
+func runJob(j job) {
+	defer func() {
+		// a failing job shouldn't take the whole server down
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"job": j.name,
+				"err": r,
+			}).Error("scheduled job panicked")
+		}
+	}()
+	j.run()
+}
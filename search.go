@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bt/blobs"
+	"bt/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+)
+
+const (
+	DEFAULT_SEARCH_RESULTS = 50
+	MAX_SEARCH_RESULTS     = 200
+	SNIPPET_LENGTH         = 160
+)
+
+func SearchMails(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   searches the archived mails of all the user's addresses.
+	   ?q=words that must all be present
+	   ?from=part of the sender address
+	   ?address=only this address (the part before @)
+	   ?since=2016-07-01&until=2016-07-31 (both included, UTC)
+	   ?limit=50
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+	query := r.URL.Query()
+
+	params := db.SearchParams{
+		Terms:  blobs.SearchTerms(query.Get("q")),
+		Sender: query.Get("from"),
+		Limit:  DEFAULT_SEARCH_RESULTS,
+	}
+	if address := query.Get("address"); address != "" {
+		params.Address = address + "@" + settings.BaseDomain
+	}
+
+	for param, millis := range map[string]*int64{"since": &params.Since, "until": &params.Until} {
+		if value := query.Get(param); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				sendJSONError(w, fmt.Errorf("%s should be a date like 2006-01-02", param), 400, logger)
+				return
+			}
+			if param == "until" {
+				date = date.AddDate(0, 0, 1)
+			}
+			*millis = date.UnixNano() / int64(time.Millisecond)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit < 1 || params.Limit > MAX_SEARCH_RESULTS {
+			sendJSONError(w, fmt.Errorf("limit must be a number between 1 and %d", MAX_SEARCH_RESULTS), 400, logger)
+			return
+		}
+	}
+
+	if len(params.Terms) == 0 && params.Sender == "" {
+		sendJSONError(w, errors.New("search for something"), 400, logger)
+		return
+	}
+
+	results, err := db.SearchMails(userId, params)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	for i := range results {
+		results[i].Snippet = blobs.Snippet(results[i].Text, params.Terms, SNIPPET_LENGTH)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func GetMail(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   the archived body of a mail, ?id=<message-id>
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	key, err := db.GetArchivedMail(userId, r.URL.Query().Get("id"))
+	if err != nil {
+		sendJSONError(w, err, 404, logger)
+		return
+	}
+
+	message, err := blobs.GetMessage(archive, key)
+	if err == blobs.ErrNotFound {
+		sendJSONError(w, err, 404, logger)
+		return
+	} else if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bt/db"
+	"bt/sessions"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+)
+
+// clients get a short-lived jwt for a session we keep, and a refresh token to get the
+// next one. see sessions/sessions.go.
+
+const ACCESS_TOKEN_TTL = 15 * time.Minute
+const SESSION_DAYS = 30 // since the last refresh, trello tokens we ask for last as long
+
+// LEGACY_TOKEN_GRACE is how long jwts from before sessions, with the trello token inside,
+// are still accepted after being issued. clients get new ones on every page load.
+const LEGACY_TOKEN_GRACE = 24 * time.Hour
+
+var keyring *sessions.Keyring
+
+type sessionTokens struct {
+	JWT     string `json:"jwt"`
+	Refresh string `json:"refresh"`
+	Expires int64  `json:"expires"` // of the jwt, in seconds
+}
+
+// sessionKey gives the jwt middleware the secret a token was signed with.
+func sessionKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		// from before sessions, signed with what was the secret then
+		_, secret := keyring.Current()
+		return []byte(secret), nil
+	}
+	secret, ok := keyring.Secret(kid)
+	if !ok {
+		return nil, errors.New("unknown session key")
+	}
+	return []byte(secret), nil
+}
+
+func accessToken(userId, sessionId string) (jwtString string, expires time.Time, err error) {
+	kid, secret := keyring.Current()
+	expires = time.Now().Add(ACCESS_TOKEN_TTL)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = kid
+	token.Claims["id"] = userId
+	token.Claims["sid"] = sessionId
+	token.Claims["iat"] = time.Now().Unix()
+	token.Claims["exp"] = expires.Unix()
+	jwtString, err = token.SignedString([]byte(secret))
+	return
+}
+
+func startSession(userId, trelloToken string) (tokens sessionTokens, err error) {
+	sessionId, err := sessions.NewId()
+	if err != nil {
+		return
+	}
+	refresh, hash, err := sessions.NewRefreshToken(sessionId)
+	if err != nil {
+		return
+	}
+	sealed, err := keyring.Seal(trelloToken)
+	if err != nil {
+		return
+	}
+
+	err = db.CreateSession(db.Session{
+		Id:          sessionId,
+		UserId:      userId,
+		RefreshHash: hash,
+		TrelloToken: sealed,
+		Expires:     sessionExpiration(),
+	})
+	if err != nil {
+		return
+	}
+
+	jwtString, expires, err := accessToken(userId, sessionId)
+	return sessionTokens{jwtString, refresh, expires.Unix()}, err
+}
+
+func sessionExpiration() int64 {
+	return time.Now().AddDate(0, 0, SESSION_DAYS).UnixNano() / int64(time.Millisecond)
+}
+
+// checkSession makes logging out take effect before the jwt expires.
+func checkSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+		token := context.Get(r, "user").(*jwt.Token)
+		userId, _ := token.Claims["id"].(string)
+		sessionId, _ := token.Claims["sid"].(string)
+
+		if sessionId == "" {
+			iat, _ := token.Claims["iat"].(float64)
+			issued := time.Unix(int64(iat), 0)
+			revokedAt, err := db.SessionsRevokedAt(userId)
+			if err != nil {
+				sendJSONError(w, err, 500, logger)
+				return
+			}
+			if time.Since(issued) > LEGACY_TOKEN_GRACE || issued.UnixNano()/int64(time.Millisecond) <= revokedAt {
+				sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := db.GetSession(sessionId)
+		if err != nil {
+			sendJSONError(w, err, 500, logger)
+			return
+		}
+		if session == nil || session.UserId != userId {
+			sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+			return
+		}
+		context.Set(r, "session", session)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionTrelloToken is the trello token the user logged in with.
+func sessionTrelloToken(r *http.Request) (string, error) {
+	if session, ok := context.Get(r, "session").(*db.Session); ok {
+		return keyring.Open(session.TrelloToken)
+	}
+	if token, ok := context.Get(r, "user").(*jwt.Token).Claims["token"].(string); ok && token != "" {
+		return token, nil
+	}
+	return "", errors.New("no trello token on this session")
+}
+
+func RefreshSession(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   takes {refresh}, returns a new jwt and refresh token like POST /api/session.
+	   each refresh token works only once.
+	*/
+
+	data := struct {
+		Refresh string `json:"refresh"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
+	sessionId, hash, err := sessions.ParseRefreshToken(data.Refresh)
+	if err != nil {
+		sendJSONError(w, err, 401, logger)
+		return
+	}
+	session, err := db.GetSession(sessionId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if session == nil {
+		sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+		return
+	}
+	if !hmac.Equal([]byte(hash), []byte(session.RefreshHash)) {
+		// an old refresh token being used again means someone else may have it
+		logger.WithFields(log.Fields{
+			"user":    session.UserId,
+			"session": sessionId,
+		}).Warn("refresh token reused, ending session")
+		db.DeleteSession(session.UserId, sessionId)
+		sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+		return
+	}
+
+	// tokens sealed with a previous secret move to the current one
+	sealed := session.TrelloToken
+	if keyring.Stale(sealed) {
+		trelloToken, err := keyring.Open(sealed)
+		if err != nil {
+			db.DeleteSession(session.UserId, sessionId)
+			sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+			return
+		}
+		sealed, err = keyring.Seal(trelloToken)
+		if err != nil {
+			sendJSONError(w, err, 500, logger)
+			return
+		}
+	}
+
+	refresh, newHash, err := sessions.NewRefreshToken(sessionId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	refreshed, err := db.RefreshSession(sessionId, hash, newHash, sealed, sessionExpiration())
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+	if !refreshed {
+		sendJSONError(w, errors.New("session expired, please log in again"), 401, logger)
+		return
+	}
+
+	jwtString, expires, err := accessToken(session.UserId, sessionId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionTokens{jwtString, refresh, expires.Unix()})
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+
+	claims := context.Get(r, "user").(*jwt.Token).Claims
+	userId := claims["id"].(string)
+
+	if sessionId, _ := claims["sid"].(string); sessionId != "" {
+		err := db.DeleteSession(userId, sessionId)
+		if err != nil {
+			sendJSONError(w, err, 500, logger)
+			return
+		}
+	}
+
+	logger.WithFields(log.Fields{"user": userId}).Info("logged out")
+	w.WriteHeader(200)
+}
+
+func LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{"ip": r.RemoteAddr})
+	/*
+	   ends all sessions of the user, including this one.
+	*/
+
+	userId := context.Get(r, "user").(*jwt.Token).Claims["id"].(string)
+
+	err := db.DeleteSessions(userId)
+	if err != nil {
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
+	logger.WithFields(log.Fields{"user": userId}).Info("logged out everywhere")
+	w.WriteHeader(200)
+}
@@ -0,0 +1,146 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// sessions live on our database, clients get a short-lived jwt pointing to one and a
+// refresh token to get the next. the trello token of each session is sealed with a key
+// derived from the session secret, and old secrets are kept around while rotating.
+
+var (
+	ErrUnknownKey   = errors.New("sealed with a key we don't have")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Keyring holds the current secret, used for everything new, and the previous ones that
+// are still accepted.
+type Keyring struct {
+	current string
+	secrets map[string]string
+}
+
+func NewKeyring(current string, previous ...string) *Keyring {
+	k := &Keyring{secrets: make(map[string]string)}
+	for _, secret := range previous {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			k.secrets[KeyId(secret)] = secret
+		}
+	}
+	k.current = KeyId(current)
+	k.secrets[k.current] = current
+	return k
+}
+
+// KeyId names a secret without giving it away, it goes on the header of our jwts.
+func KeyId(secret string) string {
+	sum := sha256.Sum256([]byte("kid:" + secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (k *Keyring) Current() (kid, secret string) {
+	return k.current, k.secrets[k.current]
+}
+
+func (k *Keyring) Secret(kid string) (secret string, ok bool) {
+	secret, ok = k.secrets[kid]
+	return
+}
+
+// Seal encrypts with the current key, the result says which key that was.
+func (k *Keyring) Seal(plain string) (string, error) {
+	kid, secret := k.Current()
+	aead, err := sealer(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(kid))
+	return kid + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (k *Keyring) Open(sealed string) (string, error) {
+	parts := strings.SplitN(sealed, ":", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	secret, ok := k.secrets[parts[0]]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	aead, err := sealer(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", ErrInvalidToken
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(plain), nil
+}
+
+// Stale tells if something was sealed with a key other than the current one.
+func (k *Keyring) Stale(sealed string) bool {
+	return !strings.HasPrefix(sealed, k.current+":")
+}
+
+func sealer(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("seal:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func NewId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewRefreshToken returns a token for the session and its hash, only the hash is stored.
+func NewRefreshToken(sessionId string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	return sessionId + "." + secret, HashRefresh(secret), nil
+}
+
+// ParseRefreshToken returns the session a refresh token is for and the hash to compare
+// with the stored one.
+func ParseRefreshToken(token string) (sessionId, hash string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidToken
+	}
+	return parts[0], HashRefresh(parts[1]), nil
+}
+
+func HashRefresh(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestSessions(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("sessions", func() {
+
+		g.It("should name keys without giving them away", func() {
+			Expect(KeyId("secret")).To(Equal(KeyId("secret")))
+			Expect(KeyId("secret")).ToNot(Equal(KeyId("other")))
+			Expect(KeyId("secret")).ToNot(ContainSubstring("secret"))
+		})
+
+		g.It("should use the current key and accept the previous ones", func() {
+			k := NewKeyring("new", "old", " ", "older")
+			kid, secret := k.Current()
+			Expect(kid).To(Equal(KeyId("new")))
+			Expect(secret).To(Equal("new"))
+
+			old, ok := k.Secret(KeyId("old"))
+			Expect(ok).To(BeTrue())
+			Expect(old).To(Equal("old"))
+			older, ok := k.Secret(KeyId("older"))
+			Expect(ok).To(BeTrue())
+			Expect(older).To(Equal("older"))
+			_, ok = k.Secret(KeyId(" "))
+			Expect(ok).To(BeFalse())
+			_, ok = k.Secret("")
+			Expect(ok).To(BeFalse())
+		})
+
+		g.It("should seal and open", func() {
+			k := NewKeyring("secret")
+			sealed, err := k.Seal("trello-token")
+			Expect(err).To(BeNil())
+			Expect(sealed).ToNot(ContainSubstring("trello-token"))
+			Expect(sealed).To(HavePrefix(KeyId("secret") + ":"))
+			Expect(k.Open(sealed)).To(Equal("trello-token"))
+
+			again, _ := k.Seal("trello-token")
+			Expect(again).ToNot(Equal(sealed))
+		})
+
+		g.It("should open what was sealed before a rotation, but not after the old key is gone", func() {
+			sealed, _ := NewKeyring("old").Seal("trello-token")
+
+			rotated := NewKeyring("new", "old")
+			Expect(rotated.Open(sealed)).To(Equal("trello-token"))
+			Expect(rotated.Stale(sealed)).To(BeTrue())
+
+			resealed, _ := rotated.Seal("trello-token")
+			Expect(rotated.Stale(resealed)).To(BeFalse())
+
+			_, err := NewKeyring("new").Open(sealed)
+			Expect(err).To(Equal(ErrUnknownKey))
+		})
+
+		g.It("should not open tampered or garbage values", func() {
+			k := NewKeyring("secret")
+			sealed, _ := k.Seal("trello-token")
+			parts := strings.SplitN(sealed, ":", 2)
+
+			for _, bad := range []string{
+				"",
+				"garbage",
+				parts[0] + ":",
+				parts[0] + ":" + strings.ToUpper(parts[1]),
+				parts[0] + ":!!!",
+			} {
+				_, err := k.Open(bad)
+				Expect(err).To(Equal(ErrInvalidToken), bad)
+			}
+
+			// the key id is bound to the ciphertext
+			other := NewKeyring("secret", "old")
+			_, err := other.Open(KeyId("old") + ":" + parts[1])
+			Expect(err).To(Equal(ErrInvalidToken))
+		})
+
+		g.It("should make unique ids and refresh tokens", func() {
+			a, _ := NewId()
+			b, _ := NewId()
+			Expect(a).To(HaveLen(32))
+			Expect(a).ToNot(Equal(b))
+
+			token, hash, err := NewRefreshToken(a)
+			Expect(err).To(BeNil())
+			Expect(token).To(HavePrefix(a + "."))
+			other, otherHash, _ := NewRefreshToken(a)
+			Expect(other).ToNot(Equal(token))
+			Expect(otherHash).ToNot(Equal(hash))
+		})
+
+		g.It("should parse refresh tokens back", func() {
+			token, hash, _ := NewRefreshToken("s1")
+			Expect(token).ToNot(ContainSubstring(hash))
+
+			sessionId, parsedHash, err := ParseRefreshToken(token)
+			Expect(err).To(BeNil())
+			Expect(sessionId).To(Equal("s1"))
+			Expect(parsedHash).To(Equal(hash))
+
+			for _, bad := range []string{"", "s1", "s1.", ".abc", "s1.a.b"} {
+				_, _, err := ParseRefreshToken(bad)
+				Expect(err).To(Equal(ErrInvalidToken), bad)
+			}
+		})
+	})
+}
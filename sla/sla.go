@@ -0,0 +1,97 @@
+package sla
+
+import (
+	"bt/calendar"
+	"sort"
+	"time"
+)
+
+type Policy struct {
+	FirstResponse time.Duration
+	NextResponse  time.Duration
+	Calendar      *calendar.Calendar // targets are counted in business time, nil means always open
+}
+
+type Message struct {
+	Date    time.Time
+	Inbound bool
+}
+
+type Kind string
+
+const (
+	NONE           Kind = ""
+	FIRST_RESPONSE Kind = "first-response"
+	NEXT_RESPONSE  Kind = "next-response"
+)
+
+type Timer struct {
+	Kind         Kind
+	WaitingSince time.Time
+	Due          time.Time
+}
+
+func (t Timer) Running() bool {
+	return t.Kind != NONE && !t.Due.IsZero()
+}
+
+func (t Timer) Breached(now time.Time) bool {
+	return t.Running() && now.After(t.Due)
+}
+
+type byDate []Message
+
+func (m byDate) Len() int           { return len(m) }
+func (m byDate) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byDate) Less(i, j int) bool { return m[i].Date.Before(m[j].Date) }
+
+// Compute returns the timer for the response we owe to the customer, if any.
+// the customer is waiting since the first inbound message after our last reply.
+func Compute(policy Policy, messages []Message) Timer {
+	sorted := make([]Message, len(messages))
+	copy(sorted, messages)
+	sort.Stable(byDate(sorted))
+
+	var answered bool
+	var waitingSince time.Time
+	for _, m := range sorted {
+		if m.Inbound {
+			if waitingSince.IsZero() {
+				waitingSince = m.Date
+			}
+		} else {
+			answered = true
+			waitingSince = time.Time{}
+		}
+	}
+
+	if waitingSince.IsZero() {
+		// nobody is waiting for us
+		return Timer{}
+	}
+
+	kind, target := FIRST_RESPONSE, policy.FirstResponse
+	if answered {
+		kind, target = NEXT_RESPONSE, policy.NextResponse
+	}
+	if target <= 0 {
+		// no policy for this kind of response
+		return Timer{}
+	}
+
+	hours := policy.Calendar
+	if hours == nil {
+		hours = calendar.Always
+	}
+	due := hours.Add(waitingSince, target)
+	if due.IsZero() {
+		// the calendar never opens
+		return Timer{}
+	}
+
+	return Timer{
+		Kind:         kind,
+		WaitingSince: waitingSince,
+		Due:          due,
+	}
+}
@@ -0,0 +1,88 @@
+package sla
+
+import (
+	"bt/calendar"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+)
+
+func TestSLA(t *testing.T) {
+
+	g := Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	start := time.Date(2016, 3, 10, 9, 0, 0, 0, time.UTC)
+	policy := Policy{FirstResponse: 4 * time.Hour, NextResponse: 8 * time.Hour}
+
+	g.Describe("sla timers", func() {
+
+		g.It("should not run when nobody wrote us", func() {
+			Expect(Compute(policy, nil).Running()).To(Equal(false))
+			Expect(Compute(policy, []Message{{start, false}}).Running()).To(Equal(false))
+		})
+
+		g.It("should start a first response timer", func() {
+			timer := Compute(policy, []Message{{start, true}})
+			Expect(timer.Kind).To(Equal(FIRST_RESPONSE))
+			Expect(timer.WaitingSince).To(Equal(start))
+			Expect(timer.Due).To(Equal(start.Add(4 * time.Hour)))
+			Expect(timer.Breached(start.Add(3 * time.Hour))).To(Equal(false))
+			Expect(timer.Breached(start.Add(5 * time.Hour))).To(Equal(true))
+		})
+
+		g.It("should count from the first unanswered message", func() {
+			timer := Compute(policy, []Message{
+				{start.Add(2 * time.Hour), true},
+				{start, true},
+			})
+			Expect(timer.Kind).To(Equal(FIRST_RESPONSE))
+			Expect(timer.WaitingSince).To(Equal(start))
+		})
+
+		g.It("should stop when we reply", func() {
+			timer := Compute(policy, []Message{
+				{start, true},
+				{start.Add(time.Hour), false},
+			})
+			Expect(timer.Running()).To(Equal(false))
+		})
+
+		g.It("should start a next response timer after a reply", func() {
+			timer := Compute(policy, []Message{
+				{start, true},
+				{start.Add(time.Hour), false},
+				{start.Add(2 * time.Hour), true},
+				{start.Add(3 * time.Hour), true},
+			})
+			Expect(timer.Kind).To(Equal(NEXT_RESPONSE))
+			Expect(timer.WaitingSince).To(Equal(start.Add(2 * time.Hour)))
+			Expect(timer.Due).To(Equal(start.Add(10 * time.Hour)))
+		})
+
+		g.It("should count business hours only", func() {
+			office, _ := calendar.New("UTC", map[string][]calendar.Span{
+				"thursday": {{Start: "09:00", End: "17:00"}},
+				"friday":   {{Start: "09:00", End: "17:00"}},
+			}, nil)
+			thursdayNight := time.Date(2016, 3, 10, 20, 0, 0, 0, time.UTC)
+			timer := Compute(Policy{FirstResponse: 4 * time.Hour, Calendar: office}, []Message{
+				{thursdayNight, true},
+			})
+			Expect(timer.WaitingSince).To(Equal(thursdayNight))
+			Expect(timer.Due).To(BeTemporally("==", time.Date(2016, 3, 11, 13, 0, 0, 0, time.UTC)))
+		})
+
+		g.It("should not run without a policy", func() {
+			timer := Compute(Policy{FirstResponse: time.Hour}, []Message{
+				{start, true},
+				{start.Add(time.Hour), false},
+				{start.Add(2 * time.Hour), true},
+			})
+			Expect(timer.Running()).To(Equal(false))
+		})
+
+	})
+}
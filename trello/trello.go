@@ -2,10 +2,13 @@ package trello
 
 import (
 	"bt/helpers"
+	"bt/metrics"
 	"encoding/json"
 	"errors"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -18,6 +21,57 @@ var Client *trello.Client
 var Bot *trello.Member
 var settings Settings
 
+// the trello paths we call, for metrics.
+var routes = metrics.NewRoutes("/1",
+	"/webhooks",
+	"/labels",
+	"/cards",
+	"/boards/{board}",
+	"/boards/{board}/lists",
+	"/boards/{board}/labels",
+	"/boards/{board}/members",
+	"/boards/{board}/memberships",
+	"/boards/{board}/checklists",
+	"/boards/{board}/cards",
+	"/boards/{board}/cards/{card}",
+	"/boards/{board}/members/{member}",
+	"/boards/{board}/members/{member}/cards",
+	"/card/{card}",
+	"/card/{card}/checklists",
+	"/cards/{card}",
+	"/cards/{card}/actions/comments",
+	"/cards/{card}/actions/{action}/comments",
+	"/cards/{card}/attachments/{attachment}",
+	"/cards/{card}/idLabels/{label}",
+	"/cards/{card}/idMembers/{member}",
+	"/cards/{card}/members",
+	"/cards/{card}/attachments",
+	"/cards/{card}/actions",
+	"/cards/{card}/checklists",
+	"/cards/{card}/desc",
+	"/cards/{card}/name",
+	"/cards/{card}/due",
+	"/cards/{card}/closed",
+	"/cards/{card}/idList",
+	"/cards/{card}/pos",
+	"/cards/{card}/idLabels",
+	"/cards/{card}/idMembers",
+	"/checklist/{checklist}/checkItems",
+	"/checklists/{checklist}",
+	"/checklists/{checklist}/checkItems/{item}",
+	"/lists/{list}",
+	"/lists/{list}/cards",
+	"/lists/{list}/actions",
+	"/members/me",
+	"/members/{member}",
+	"/members/{member}/boards",
+	"/members/{member}/notifications",
+	"/notifications/{notification}",
+	"/organization/{organization}",
+	"/organization/{organization}/members",
+	"/organizations/{organization}/boards",
+)
+
 type Settings struct {
 	ApiKey    string `envconfig:"TRELLO_API_KEY"`
 	ApiSecret string `envconfig:"TRELLO_API_SECRET"`
@@ -31,7 +85,9 @@ func init() {
 		log.Fatal(err.Error())
 	}
 
-	Client, err = trello.NewAuthClient(settings.ApiKey, settings.BotToken)
+	Client, err = trello.NewCustomClient(&http.Client{
+		Transport: metrics.Transport("trello", routes, trello.NewBearerTokenTransport(settings.ApiKey, settings.BotToken)),
+	})
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -132,3 +188,176 @@ func CreateWebhook(entityId, endpoint string) (string, error) {
 
 	return data.Id, nil
 }
+
+func SetName(card *trello.Card, name string) error {
+	params := url.Values{}
+	params.Add("value", name)
+
+	_, err := Client.Put("/cards/"+card.Id+"/name", params)
+	if err != nil {
+		return err
+	}
+	card.Name = name
+	return nil
+}
+
+func SetDue(card *trello.Card, due time.Time) error {
+	params := url.Values{}
+	if due.IsZero() {
+		params.Add("value", "null")
+	} else {
+		params.Add("value", due.UTC().Format(time.RFC3339))
+	}
+
+	_, err := Client.Put("/cards/"+card.Id+"/due", params)
+	return err
+}
+
+type Label struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+func EnsureLabel(boardId, name, color string) (label Label, err error) {
+	body, err := Client.Get("/boards/" + boardId + "/labels?fields=name,color&limit=1000")
+	if err != nil {
+		return
+	}
+
+	var labels []Label
+	if err = json.Unmarshal(body, &labels); err != nil {
+		return
+	}
+	for _, l := range labels {
+		if strings.ToLower(l.Name) == strings.ToLower(name) {
+			return l, nil
+		}
+	}
+
+	// there's no label with this name on the board, create it
+	params := url.Values{}
+	params.Add("name", name)
+	params.Add("color", color)
+	params.Add("idBoard", boardId)
+	body, err = Client.Post("/labels", params)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &label)
+	return
+}
+
+func AddLabel(card *trello.Card, name, color string) error {
+	label, err := EnsureLabel(card.IdBoard, name, color)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range card.Labels {
+		if l.Name == label.Name {
+			// already there
+			return nil
+		}
+	}
+
+	params := url.Values{}
+	params.Add("value", label.Id)
+	_, err = Client.Post("/cards/"+card.Id+"/idLabels", params)
+	return err
+}
+
+func RemoveLabel(card *trello.Card, name string) error {
+	var has bool
+	for _, l := range card.Labels {
+		if strings.ToLower(l.Name) == strings.ToLower(name) {
+			has = true
+		}
+	}
+	if !has {
+		return nil
+	}
+
+	body, err := Client.Get("/boards/" + card.IdBoard + "/labels?fields=name,color&limit=1000")
+	if err != nil {
+		return err
+	}
+	var labels []Label
+	if err = json.Unmarshal(body, &labels); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		if strings.ToLower(l.Name) == strings.ToLower(name) {
+			_, err = Client.Delete("/cards/" + card.Id + "/idLabels/" + l.Id)
+			return err
+		}
+	}
+	return nil
+}
+
+// EditComment only works for comments made by the bot.
+func EditComment(card *trello.Card, commentId, text string) error {
+	params := url.Values{}
+	params.Add("text", text)
+	_, err := Client.Put("/cards/"+card.Id+"/actions/"+commentId+"/comments", params)
+	return err
+}
+
+// DeleteComment works for comments made by the bot, or by anyone if the bot is a board admin.
+func DeleteComment(card *trello.Card, commentId string) error {
+	_, err := Client.Delete("/cards/" + card.Id + "/actions/" + commentId + "/comments")
+	return err
+}
+
+func DeleteAttachment(card *trello.Card, attachmentId string) error {
+	_, err := Client.Delete("/cards/" + card.Id + "/attachments/" + attachmentId)
+	return err
+}
+
+type Membership struct {
+	IdMember   string `json:"idMember"`
+	MemberType string `json:"memberType"` // "admin", "normal" or "observer"
+}
+
+func BoardMemberships(boardId string) (memberships []Membership, err error) {
+	body, err := Client.Get("/boards/" + boardId + "/memberships")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &memberships)
+	return
+}
+
+// Comments returns the text of every comment on a card by its action id.
+// Trello only returns the latest actions by default, so we page back through
+// them with `before` until a page comes short.
+func Comments(card *trello.Card) (comments map[string]string, err error) {
+	comments = make(map[string]string)
+	before := ""
+	for {
+		resource := "/cards/" + card.Id + "/actions?filter=commentCard&limit=1000"
+		if before != "" {
+			resource += "&before=" + before
+		}
+		body, err := Client.Get(resource)
+		if err != nil {
+			return comments, err
+		}
+		var actions []struct {
+			Id   string `json:"id"`
+			Data struct {
+				Text string `json:"text"`
+			} `json:"data"`
+		}
+		if err = json.Unmarshal(body, &actions); err != nil {
+			return comments, err
+		}
+		for _, action := range actions {
+			comments[action.Id] = action.Data.Text
+		}
+		if len(actions) < 1000 {
+			return comments, nil
+		}
+		before = actions[len(actions)-1].Id
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bt/blobs"
 	"bt/cache"
 	"bt/db"
+	"bt/events"
 	"bt/helpers"
+	"bt/hooks"
 	"bt/mailgun"
+	"bt/metrics"
 	"bt/trello"
 	"bytes"
 	"errors"
@@ -22,7 +26,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
-	"github.com/segmentio/analytics-go"
 	gfm "github.com/shurcooL/github_flavored_markdown"
 
 	goTrello "github.com/websitesfortrello/go-trello"
@@ -54,7 +57,8 @@ func MailgunSuccess(w http.ResponseWriter, r *http.Request) {
 		"commenter":  commenterId,
 	}).Info("mailgun success")
 
-	if params.AddReplier {
+	// automatic messages have no commenter
+	if params.AddReplier && commenterId != "" {
 		card, err := trello.Client.Card(cardId)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -96,6 +100,7 @@ func MailgunFailure(w http.ResponseWriter, r *http.Request) {
 		"card":      cardId,
 		"recipient": r.FormValue("recipient"),
 	}).Warn("mailgun failure")
+	metrics.MailgunFailures.Inc()
 
 	notice := fmt.Sprintf("**mail could not be delivered to %s**\n\n---\n\n%s", r.FormValue("recipient"), r.FormValue("description"))
 
@@ -112,6 +117,21 @@ func MailgunFailure(w http.ResponseWriter, r *http.Request) {
 		"card":      cardId,
 		"recipient": r.PostFormValue("recipient"),
 	}).Debug("posted notice to the card")
+
+	address, err := db.GetAddressForCard(card.Id)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't find the address of the card")
+		return
+	}
+	NotifyEndpointsFlow(address, hooks.DELIVERY_FAILED, struct {
+		Card        hookCard `json:"card"`
+		Recipient   string   `json:"recipient"`
+		Description string   `json:"description"`
+	}{
+		newHookCard(card.Id, card.ShortLink),
+		r.FormValue("recipient"),
+		r.FormValue("description"),
+	})
 }
 
 func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
@@ -129,25 +149,37 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 	   post message as markdown as a comment to the card
 	*/
 	logger := log.WithFields(log.Fields{"req-id": context.Get(r, "request-id")})
+	defer metrics.InboundMailDuration.Since(time.Now())
 
 	r.ParseForm()
-	inboundAddr := r.PostFormValue("recipient")
+	recipient := r.PostFormValue("recipient")
 	url := r.PostFormValue("message-url")
 
 	logger.WithFields(log.Fields{
-		"recipient": inboundAddr,
+		"recipient": recipient,
 		"sender":    r.PostFormValue("from"),
 		"url":       url,
 	}).Info("got mail")
 
+	// mails to address+tag@ or to an alias are handled as if sent to the address
+	recipient, tag := helpers.SplitPlusTag(recipient)
+	inboundAddr, err := db.ResolveAlias(recipient)
+	if err != nil {
+		metrics.InboundMails.Inc("error")
+		sendJSONError(w, err, 500, logger)
+		return
+	}
+
 	// target list for this email
 	listId, err := db.GetTargetListForEmailAddress(inboundAddr)
 	if err != nil {
+		metrics.InboundMails.Inc("error")
 		sendJSONError(w, err, 500, logger)
 		return
 	}
 	if listId == "" {
 		// logger.Debug("no list registered for address " + inboundAddr)
+		metrics.InboundMails.Inc("no-list")
 		sendJSONError(w, errors.New("no list registered for address."), 406, logger)
 		return
 	}
@@ -167,6 +199,8 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal([]byte(r.PostFormValue("message-headers")), &headers)
 	if err != nil {
 		logger.WithField("err", err).Warn("couldn't build the message from the post parameters also")
+		metrics.WebhookDecodeErrors.Inc("mailgun")
+		metrics.InboundMails.Inc("error")
 		sendJSONError(w, err, 503, logger)
 		return
 	}
@@ -215,7 +249,46 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 		logger.WithField("err", err).Warn("couldn't fetch receiving preferences")
 	}
 
+	// unknown tags are just the address
+	route, routed := prefs.PlusTag(tag)
+	if tag != "" && !routed && !helpers.IsCardReplyTag(tag) {
+		logger.WithFields(log.Fields{
+			"address": inboundAddr,
+			"tag":     tag,
+		}).Info("unknown plus tag, using the address")
+	}
+	if route.ListId != "" {
+		listId = route.ListId
+	}
+
+	// mail sent to more than one of our addresses is posted once for each of them, it
+	// should end up once on each list
+	messageId := helpers.MessageHeader(message, "Message-Id")
+	internal, err := db.InternalAddresses(helpers.MessageRecipients(message))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check the other recipients of the message")
+	}
+	multiple := len(internal) > 1 && messageId != ""
+	if multiple {
+		claimed, err := db.ClaimInboundMail(messageId, listId, INBOUND_CLAIM_LEASE)
+		if err != nil {
+			metrics.InboundMails.Inc("error")
+			sendJSONError(w, err, 500, logger)
+			return
+		}
+		if !claimed {
+			logger.WithFields(log.Fields{
+				"message": messageId,
+				"list":    listId,
+			}).Info("message already handled for this list")
+			metrics.InboundMails.Inc("duplicate")
+			w.WriteHeader(200)
+			return
+		}
+	}
+
 	// card creation process
+	var created bool
 	createCard := func() *goTrello.Card {
 		card, err := trello.CreateCardFromMessage(listId, message)
 		if err != nil {
@@ -240,17 +313,32 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 			return nil
 		}
 
+		created = true
+		metrics.CardsCreated.Inc("email")
+		NumberCardFlow(card)
 		return card
 	}
 
 	// get card for this mail message, if exists (and is valid)
-	shortLink, err := db.GetCardForMessage(
-		helpers.MessageHeader(message, "In-Reply-To"),
-		message.Subject,
-		helpers.ReplyToOrFrom(message),
-		inboundAddr,
-	)
+	var shortLink, previous string
+	if helpers.IsCardReplyTag(tag) {
+		// sent to the reply address of a card, forged or unknown ones start a new thread
+		if cardShortLink, ok := helpers.ParseCardReplyTag(tag, settings.ReplyAddressSecret); ok {
+			shortLink, err = db.GetCardForReplyTag(cardShortLink, inboundAddr)
+		} else {
+			logger.WithField("tag", tag).Info("invalid card reply address, starting a new thread")
+		}
+		tag = ""
+	} else {
+		shortLink, previous, err = db.GetCardForMessage(
+			helpers.MessageHeader(message, "In-Reply-To"),
+			message.Subject,
+			helpers.ReplyToOrFrom(message),
+			inboundAddr,
+		)
+	}
 	if err != nil {
+		metrics.InboundMails.Inc("error")
 		sendJSONError(w, err, 404, logger)
 		return
 	}
@@ -276,13 +364,33 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 
 			// then proceed to the card creation process
 			card = createCard()
+		} else if card.Closed && (prefs.ThreadingMode == db.LINK || prefs.ThreadingMode == db.NEW_CARD) {
+			// archived cards are not revived in these modes, with LINK the new card will
+			// reference this one
+			logger.WithFields(log.Fields{
+				"card": shortLink,
+			}).Info("card is archived, will create a new one")
+			if prefs.ThreadingMode == db.LINK {
+				previous = shortLink
+			}
+			card = createCard()
 		} else {
 			// card exists on trello, revive it
 			_, err = card.SendToBoard()
 			if err != nil {
+				metrics.InboundMails.Inc("error")
 				sendJSONError(w, err, 503, logger)
 				return
 			}
+			if prefs.CustomerReplyList != "" && prefs.CustomerReplyList != card.IdList {
+				_, err = card.MoveToList(prefs.CustomerReplyList)
+				if err != nil {
+					logger.WithFields(log.Fields{
+						"err":  err,
+						"list": prefs.CustomerReplyList,
+					}).Warn("couldn't move card to the customer reply list")
+				}
+			}
 			if prefs.MoveToTop {
 				_, err = card.MoveToPos(0)
 				if err != nil {
@@ -305,17 +413,34 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 
 	// if something fails during the card creation process `card` will be nil
 	if card == nil {
+		metrics.InboundMails.Inc("error")
 		return
 	}
 
+	// a new card for an old thread should point to the card where the old thread is
+	if previous != "" && previous != card.ShortLink {
+		CommentWithPreviousCard(card, previous)
+	}
+
+	if routed {
+		PlusTagRouteFlow(card, route)
+	}
+
 	// if something fails during the card creation process `card` will be nil
 	// now upload attachments
 	logger.WithFields(log.Fields{"quantity": len(message.Attachments)}).Debug("uploading attachments")
 	dir := filepath.Join("/tmp", "bt", message.From, message.Subject)
 	os.MkdirAll(dir, 0777)
 	attachmentUrls := make(map[string]string)
+	archivedAttachments := make([]blobs.AttachmentRef, 0, len(message.Attachments))
+	// a mail this address already archived keeps its attachments, see ArchiveMailFlow
+	archived, err := db.IsArchived(inboundAddr, messageId)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check if the mail was archived")
+		archived = true
+	}
 
-	for _, mailAttachment := range message.Attachments {
+	for i, mailAttachment := range message.Attachments {
 		if mailAttachment.Size < 100000000 {
 			filedst := filepath.Join(dir, mailAttachment.Name)
 			err = helpers.DownloadFile(filedst, mailAttachment.Url, "api", settings.MailgunAPIKey)
@@ -338,13 +463,23 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 							"err":  err.Error(),
 							"card": card.ShortLink,
 						}).Warn("attachment download failed for the second time")
+						metrics.AttachmentUploads.Inc("error")
 						continue
 					}
 				} else {
+					metrics.AttachmentUploads.Inc("error")
 					continue
 				}
 			}
 
+			// keep a copy with the archived message
+			if !archived {
+				ref, err := ArchiveAttachmentFlow(inboundAddr, messageId, i, filedst, mailAttachment)
+				if err == nil {
+					archivedAttachments = append(archivedAttachments, ref)
+				}
+			}
+
 			// before uploading, check if file is already on this trello card
 			if cache.Has(card.Id, filedst) {
 				attachmentUrls[mailAttachment.Url] = cache.Url()
@@ -356,10 +491,12 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 						"err":  err.Error(),
 						"card": card.ShortLink,
 					}).Warn("attachment upload failed")
+					metrics.AttachmentUploads.Inc("error")
 					continue
 				}
 				attachmentUrls[mailAttachment.Url] = trelloAttachment.Url
 				cache.Save(trelloAttachment.Url)
+				metrics.AttachmentUploads.Inc("ok")
 			}
 		}
 	}
@@ -442,6 +579,7 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 			"card": card.ShortLink,
 			"err":  err.Error(),
 		}).Error("couldn't post the comment")
+		metrics.InboundMails.Inc("error")
 		return
 		// do not return an error or the webhook will retry and more cards will be created
 	}
@@ -471,21 +609,94 @@ func MailgunIncoming(w http.ResponseWriter, r *http.Request) {
 			"comment": comment.Id,
 			"err":     err.Error(),
 		}).Error("couldn't save the email received")
+		metrics.InboundMails.Inc("error")
 		return
 		// do not return an error or the webhook will retry and more cards will be created
 	}
 
+	if multiple {
+		others, err := db.FinishInboundMail(messageId, listId, inboundAddr, card.ShortLink)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't finish the receipt of the message")
+		}
+		for _, other := range others {
+			LinkCardsFlow(card.ShortLink, inboundAddr, other.CardShortLink, other.Address)
+		}
+	}
+
+	err = db.SaveMailArrival(card.ShortLink, messageId, recipient, tag)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"card":      card.ShortLink,
+			"recipient": recipient,
+			"err":       err.Error(),
+		}).Warn("couldn't save the alias the mail arrived on")
+	}
+
 	w.WriteHeader(200)
+	metrics.InboundMails.Inc("ok")
+
+	archivedHeaders := make([][2]string, 0, len(message.MessageHeaders))
+	for _, pair := range message.MessageHeaders {
+		if len(pair) == 2 {
+			archivedHeaders = append(archivedHeaders, [2]string{pair[0], pair[1]})
+		}
+	}
+	ArchiveMailFlow(inboundAddr, blobs.Message{
+		Id:      helpers.MessageHeader(message, "Message-Id"),
+		Inbound: true,
+		Subject: message.Subject,
+		From:    helpers.ReplyToOrFrom(message),
+		To:      strings.Split(message.Recipients, ","),
+		Date:    time.Now().UnixNano() / int64(time.Millisecond),
+		Text:    message.BodyPlain,
+		HTML:    message.BodyHtml,
+		Headers: archivedHeaders,
+
+		Attachments: archivedAttachments,
+	})
+
+	contact := helpers.MessageHeader(message, "Reply-To")
+	if contact == "" {
+		contact = message.From
+	}
+	SaveContactFlow(helpers.MessageHeader(message, "Message-Id"), contact, true)
+	if created {
+		CommentWithPreviousConversationsFlow(card, contact)
+	}
+
+	UpdateSLAFlow(card.ShortLink)
+	if created {
+		UpdateStatusFlow(card.Id, db.NEW, false)
+	} else {
+		UpdateStatusFlow(card.Id, db.WAITING_ON_US, false)
+	}
+
+	// let the customer know we've got the message
+	if created && prefs.AutoAck {
+		SendAcknowledgementFlow(card, inboundAddr, message)
+	}
+
+	NotifyEndpointsFlow(inboundAddr, hooks.MAIL_RECEIVED, struct {
+		Card      hookCard `json:"card"`
+		NewThread bool     `json:"newThread"`
+		From      string   `json:"from"`
+		Subject   string   `json:"subject"`
+		MessageId string   `json:"messageId"`
+	}{
+		newHookCard(card.Id, card.ShortLink),
+		created,
+		helpers.ReplyToOrFrom(message),
+		message.Subject,
+		helpers.MessageHeader(message, "Message-Id"),
+	})
 
 	// tracking
-	segment.Track(&analytics.Track{
-		Event:  "Received mail",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"card":    card.Id,
-			"from":    helpers.ReplyToOrFrom(message),
-			"address": inboundAddr,
-		},
+	tracking.Publish(events.MailReceived{
+		UserId:  userId,
+		Address: inboundAddr,
+		Card:    card.Id,
+		From:    helpers.ReplyToOrFrom(message),
 	})
 }
 
@@ -503,15 +714,35 @@ func TrelloCardWebhook(w http.ResponseWriter, r *http.Request) {
 	*/
 	logger := log.WithFields(log.Fields{"req-id": context.Get(r, "request-id")})
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		metrics.WebhookDecodeErrors.Inc("trello-card")
+		sendJSONError(w, err, 400, logger)
+		return
+	}
+
 	var wh struct {
 		Action goTrello.Action `json:"action"`
 	}
-	err := json.NewDecoder(r.Body).Decode(&wh)
+	err = json.Unmarshal(body, &wh)
 	if err != nil {
+		metrics.WebhookDecodeErrors.Inc("trello-card")
 		sendJSONError(w, err, 400, logger)
 		return
 	}
 
+	// go-trello doesn't tell us if the card is archived
+	var archiving struct {
+		Action struct {
+			Data struct {
+				Card struct {
+					Closed *bool `json:"closed"`
+				} `json:"card"`
+			} `json:"data"`
+		} `json:"action"`
+	}
+	json.Unmarshal(body, &archiving)
+
 	var strippedText string
 
 	// filter out bot actions
@@ -558,6 +789,27 @@ func TrelloCardWebhook(w http.ResponseWriter, r *http.Request) {
 		logger.WithFields(log.Fields{"type": wh.Action.Type, "card": wh.Action.Data.Card.ShortLink}).Info("webhook")
 		text := wh.Action.Data.Text
 
+		if target, ok := helpers.ParseMergeCommand(text); ok {
+			err := MergeCardsFlow(wh.Action.Data.Card.Id, target)
+			if err != nil {
+				logger.WithFields(log.Fields{"err": err, "target": target}).Info("couldn't merge cards")
+				if card, cerr := trello.Client.Card(wh.Action.Data.Card.Id); cerr == nil {
+					card.AddComment("Couldn't merge this card: " + err.Error() + ".")
+				}
+			}
+			goto abort
+		}
+		if message, ok := helpers.ParseSplitCommand(text); ok {
+			_, err := SplitThreadFlow(wh.Action.Data.Card.Id, message)
+			if err != nil {
+				logger.WithFields(log.Fields{"err": err, "message": message}).Info("couldn't split thread")
+				if card, cerr := trello.Client.Card(wh.Action.Data.Card.Id); cerr == nil {
+					card.AddComment("Couldn't split this thread: " + err.Error() + ".")
+				}
+			}
+			goto abort
+		}
+
 		envelopePrefix := helpers.CommentEnvelopePrefix(text)
 		if envelopePrefix == 0 {
 			// comment doesn't have prefix
@@ -569,6 +821,18 @@ func TrelloCardWebhook(w http.ResponseWriter, r *http.Request) {
 	case "updateCard":
 		logger.WithField("type", wh.Action.Type).Info("webhook")
 		logger = logger.WithFields(log.Fields{"card": wh.Action.Data.Card.Id})
+		if archiving.Action.Data.Card.Closed != nil && *archiving.Action.Data.Card.Closed {
+			UpdateStatusFlow(wh.Action.Data.Card.Id, db.CLOSED, false)
+		}
+		if wh.Action.Data.ListAfter.Id != "" {
+			// the list where the card was moved may stand for a status
+			status, err := db.GetStatusForList(wh.Action.Data.Card.Id, wh.Action.Data.ListAfter.Id)
+			if err != nil {
+				logger.WithField("err", err).Warn("couldn't check the status for the list")
+			} else if status != "" {
+				UpdateStatusFlow(wh.Action.Data.Card.Id, status, true)
+			}
+		}
 		if wh.Action.Data.Old.Name != "" {
 			// updated name, maybe we wanna change the subject or update the addressee?
 			subjectold, toold, _ := helpers.ParseCardName(wh.Action.Data.Old.Name)
@@ -647,7 +911,12 @@ sendMail:
 		// post a comment on the card telling about the error
 		card, perr := trello.Client.Card(wh.Action.Data.Card.ShortLink)
 		if perr == nil {
-			_, perr = card.AddComment("Due to a misterious error, replies in this card can't be send. Please report this issue.")
+			if merged, _ := db.GetMergedInto(wh.Action.Data.Card.Id); merged != "" {
+				_, perr = card.AddComment(
+					fmt.Sprintf("This thread was merged into https://trello.com/c/%s, please reply there.", merged))
+			} else {
+				_, perr = card.AddComment("Due to a misterious error, replies in this card can't be send. Please report this issue.")
+			}
 		}
 
 		if err == nil {
@@ -659,32 +928,13 @@ sendMail:
 	}
 
 	// check outbound email address validity
-	sendingAddr := params.OutboundAddr
-	if params.OutboundAddr == "" {
-		sendingAddr = params.InboundAddr
-	} else {
-		domain := strings.Split(params.OutboundAddr, "@")[1]
-		logger.Debug("trying to send from " + sendingAddr)
-		if domain != settings.BaseDomain {
-			canSend, canReceive := mailgun.DomainCanSendReceive(domain)
-			if !canSend {
-				sendingAddr = params.InboundAddr
-			}
-			if canReceive {
-				params.ReplyTo = params.OutboundAddr
-			}
-		}
-	}
+	sendingAddr, replyTo := sendingAddresses(sendingIdentity(params.InboundAddr, params.OutboundAddr, params.ReplyTo, params.SendAs))
+	params.ReplyTo = cardReplyTo(replyTo, wh.Action.Data.Card.ShortLink, params.PlusTag)
 	logger.WithFields(log.Fields{
 		"to":   params.Recipients,
 		"from": sendingAddr,
 	}).Info("sending email")
 
-	// the default, safe replyTo address
-	if params.ReplyTo == "" || !isEmail(params.ReplyTo) {
-		params.ReplyTo = params.InboundAddr
-	}
-
 	// add signature, if specified
 	for {
 		var err error
@@ -720,24 +970,28 @@ sendMail:
 	}
 
 	// actually send
+	html := string(gfm.Markdown([]byte(strippedText)))
+	subject := mailgun.TagSubject(params.LastMailSubject, params.TicketTag, params.Ticket)
 	messageId, err := mailgun.Send(mailgun.NewMessage{
 		ApplyMetadata: true,
-		HTML:          string(gfm.Markdown([]byte(strippedText))),
+		HTML:          html,
 		Text:          strippedText,
 		Recipients:    params.Recipients,
 		FromName:      params.SenderName,
 		From:          sendingAddr,
 		Domain:        strings.Split(sendingAddr, "@")[1],
-		Subject:       mailgun.TrimSubject(params.LastMailSubject),
+		Subject:       subject,
 		InReplyTo:     params.LastMailId,
 		ReplyTo:       params.ReplyTo,
 		CardId:        wh.Action.Data.Card.Id,
 		CommenterId:   wh.Action.MemberCreator.Id,
 	})
 	if err != nil {
+		metrics.OutboundMails.Inc("reply", "error")
 		sendJSONError(w, err, 503, logger)
 		return
 	}
+	metrics.OutboundMails.Inc("reply", "ok")
 
 	// save email sent
 	commentId := wh.Action.Data.Action.Id
@@ -754,19 +1008,57 @@ sendMail:
 		sendJSONError(w, err, 500, logger)
 		return
 	}
+	for _, recipient := range params.Recipients {
+		SaveContactFlow(messageId, recipient, false)
+	}
 
 	w.WriteHeader(200)
 
+	ArchiveMailFlow(params.InboundAddr, blobs.Message{
+		Id:      messageId,
+		Subject: subject,
+		From:    sendingAddr,
+		To:      params.Recipients,
+		Date:    time.Now().UnixNano() / int64(time.Millisecond),
+		Text:    strippedText,
+		HTML:    html,
+		Headers: [][2]string{
+			{"From", sendingAddr},
+			{"To", strings.Join(params.Recipients, ", ")},
+			{"Subject", subject},
+			{"In-Reply-To", params.LastMailId},
+			{"Reply-To", params.ReplyTo},
+			{"Message-Id", messageId},
+		},
+	})
+
+	UpdateSLAFlow(wh.Action.Data.Card.ShortLink)
+	UpdateStatusFlow(wh.Action.Data.Card.Id, db.WAITING_ON_CUSTOMER, false)
+	if params.AgentReplyList != "" {
+		MoveCardToListFlow(wh.Action.Data.Card.Id, params.AgentReplyList)
+	}
+
+	NotifyEndpointsFlow(params.InboundAddr, hooks.MAIL_SENT, struct {
+		Card      hookCard `json:"card"`
+		To        []string `json:"to"`
+		Subject   string   `json:"subject"`
+		MessageId string   `json:"messageId"`
+		Author    string   `json:"author"`
+	}{
+		newHookCard(wh.Action.Data.Card.Id, wh.Action.Data.Card.ShortLink),
+		params.Recipients,
+		params.LastMailSubject,
+		messageId,
+		wh.Action.MemberCreator.Username,
+	})
+
 	// tracking
 	userId, _ := db.GetUserForAddress(params.InboundAddr)
-	segment.Track(&analytics.Track{
-		Event:  "Sent mail",
-		UserId: userId,
-		Properties: map[string]interface{}{
-			"card":    wh.Action.Data.Card.Id,
-			"to":      params.Recipients,
-			"address": params.InboundAddr,
-		},
+	tracking.Publish(events.MailSent{
+		UserId:  userId,
+		Address: params.InboundAddr,
+		Card:    wh.Action.Data.Card.Id,
+		To:      params.Recipients,
 	})
 }
 
@@ -784,6 +1076,7 @@ func TrelloBotWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 	err := json.NewDecoder(r.Body).Decode(&wh)
 	if err != nil {
+		metrics.WebhookDecodeErrors.Inc("trello-bot")
 		sendJSONError(w, err, 400, logger)
 		return
 	}
@@ -877,18 +1170,19 @@ func TrelloBotWebhook(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		metrics.CardsCreated.Inc("trello")
+		if card != nil {
+			NumberCardFlow(card)
+		}
 		CommentWithNewSendingParams(wh.Action.Data.Card.Id)
 
 		// tracking
 		userId, _ := db.GetUserForAddress(addr)
-		segment.Track(&analytics.Track{
-			Event:  "Created outbound email thread",
-			UserId: userId,
-			Properties: map[string]interface{}{
-				"card":    wh.Action.Data.Card.Id,
-				"to":      to,
-				"address": addr,
-			},
+		tracking.Publish(events.OutboundThreadCreated{
+			UserId:  userId,
+			Address: addr,
+			Card:    wh.Action.Data.Card.Id,
+			To:      to,
 		})
 
 	default: